@@ -1,18 +1,78 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
+	"time"
 
-	"github.com/yourusername/tvm/pkg/flintlock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/agent"
+	"github.com/yourusername/tvm/pkg/audit"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"github.com/yourusername/tvm/pkg/image"
+	"github.com/yourusername/tvm/pkg/metrics"
+	"github.com/yourusername/tvm/pkg/tracing"
 )
 
 func main() {
 	// Parse command line flags
 	baseDir := flag.String("base-dir", "/var/lib/flintlock", "Base directory for flintlock data")
+	listenAddr := flag.String("listen-addr", ":9090", "Address the host agent listens on")
+	metricsAddr := flag.String("metrics-addr", ":8080", "Address the metrics endpoint binds to, empty to disable")
+	nodeName := flag.String("node-name", os.Getenv("NODE_NAME"), "Name of the node the agent runs on")
+	tlsCert := flag.String("tls-cert", "", "Certificate of the host agent")
+	tlsKey := flag.String("tls-key", "", "Private key of the host agent")
+	clientCA := flag.String("client-ca", "", "CA client certificates are verified with")
+	kernel := flag.String("kernel", "/var/lib/flintlock/vmlinux", "Default kernel image of VMs")
+	rootfs := flag.String("rootfs", "/var/lib/flintlock/rootfs.ext4", "Default rootfs image of VMs")
+	kernelDir := flag.String("kernel-dir", flintlock.DefaultKernelDir, "Directory holding the kernel catalog")
+	volumeDir := flag.String("volume-dir", flintlock.DefaultVolumeDir, "Directory holding the backing files of volumes, the only place they may be")
+	firecrackerBinary := flag.String("firecracker-binary", "firecracker", "Path to the firecracker binary")
+	seccompFilter := flag.String("seccomp-filter", "", "Compiled seccomp filter of the VMMs, the Firecracker default if empty")
+	jailer := flintlock.JailerConfig{
+		CgroupParent: os.Getenv("TVM_CGROUP_PARENT"),
+		UIDBase:      flintlock.DefaultJailerUIDBase,
+		UIDCount:     flintlock.DefaultJailerUIDCount,
+	}
+	if jailer.CgroupParent == "" {
+		jailer.CgroupParent = flintlock.DefaultJailerCgroupParent
+	}
+	// The VMs of a KVM slot run under the UIDs following the slot's own
+	if base, count, ok := slotUIDs(); ok {
+		jailer.UIDBase, jailer.UIDCount = base, count
+	}
+	flag.StringVar(&jailer.Binary, "jailer-binary", "jailer", "Path to the jailer binary, empty to run VMs without the jailer")
+	flag.StringVar(&jailer.ChrootBase, "jailer-chroot-base", os.Getenv("TVM_JAILER_ROOT"), "Directory the chroots of VMs are created in, <base-dir>/jailer if empty")
+	flag.StringVar(&jailer.CgroupParent, "jailer-cgroup-parent", jailer.CgroupParent, "cgroup v2 path the cgroups of VMs are created in")
+	flag.IntVar(&jailer.UIDBase, "jailer-uid-base", jailer.UIDBase, "First UID and GID given to VMs, after TVM_JAILER_UID if set")
+	flag.IntVar(&jailer.UIDCount, "jailer-uid-count", jailer.UIDCount, "Number of UIDs given to VMs, TVM_JAILER_UID_COUNT if set")
+	imageLayoutDir := flag.String("image-layout-dir", "", "OCI image layout directory images are read from")
+	imageMirror := flag.String("image-mirror", "", "Registry mirror images are pulled from")
+	guestAgent := flag.String("guest-agent", "", "Guest agent binary installed into image rootfs")
+	imageMaxAge := flag.Duration("image-max-age", 24*time.Hour, "How long unused images stay cached")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long in-flight executions are drained on shutdown")
+	fileTransport := flag.Bool("file-transport", false, "Serve the legacy file based hand-off instead of the host agent")
+	var traceOpts tracing.Options
+	flag.StringVar(&traceOpts.Exporter, "trace-exporter", tracing.ExporterNone, "Where traces are exported: otlp, stdout or none")
+	flag.StringVar(&traceOpts.Endpoint, "otlp-endpoint", "", "OTLP collector traces are sent to, OTEL_EXPORTER_OTLP_ENDPOINT if empty")
+	flag.BoolVar(&traceOpts.Insecure, "otlp-insecure", false, "Send traces to the OTLP collector without TLS")
+	flag.Float64Var(&traceOpts.SampleRatio, "trace-sample-ratio", 1, "Fraction of new traces that are recorded")
+	var auditOpts audit.Options
+	flag.StringVar(&auditOpts.Path, "audit-log", "", "File the audit log is appended to, empty to disable")
+	flag.IntVar(&auditOpts.MaxSizeMB, "audit-max-size-mb", audit.DefaultMaxSizeMB, "Size in MB at which the audit log is rotated")
+	flag.DurationVar(&auditOpts.Retention, "audit-retention", 90*24*time.Hour, "How long rotated audit logs are kept, 0 to keep them forever")
+	flag.StringVar(&auditOpts.WebhookURL, "audit-webhook", "", "URL every audit event is posted to, empty to disable")
 	flag.Parse()
 
 	// Configure logging
@@ -22,11 +82,97 @@ func main() {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
 
+	shutdownTracing, err := tracing.Setup(context.Background(), "tvm-agent", traceOpts)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer flushTraces(shutdownTracing)
+
+	// Create the VM manager
+	manager, err := flintlock.NewFirecrackerManager(*baseDir, *kernel, *rootfs)
+	if err != nil {
+		log.Fatalf("Failed to create VM manager: %v", err)
+	}
+	manager.FirecrackerBinary = *firecrackerBinary
+	manager.SeccompFilter = *seccompFilter
+	if jailer.Binary != "" {
+		manager.Jailer = &jailer
+	} else {
+		log.Warn("No jailer configured, VMMs run as root on the node")
+	}
+	manager.Kernels = flintlock.NewKernelCatalog(*kernelDir)
+	manager.VolumeDir = *volumeDir
+
+	auditLog, err := audit.NewLogger("tvm-agent", auditOpts)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	manager.Audit = auditLog
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	stopCh := make(chan struct{})
+	if *imageLayoutDir != "" || *imageMirror != "" {
+		cache, err := image.NewCache(filepath.Join(*baseDir, "images"), *imageLayoutDir, *imageMirror, *guestAgent)
+		if err != nil {
+			log.Fatalf("Failed to create image cache: %v", err)
+		}
+		manager.Images = cache
+		go cache.RunGC(stopCh, time.Hour, *imageMaxAge)
+	}
+
+	if *fileTransport {
+		runFileTransport(*baseDir, manager)
+		close(stopCh)
+		return
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *clientCA != "" {
+		tlsConfig, err = agent.ServerTLSConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+	} else {
+		log.Warn("No TLS certificates configured, the host agent accepts unauthenticated plaintext connections")
+	}
+
+	lis, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *listenAddr, err)
+	}
+
+	server := agent.NewServer(manager, *nodeName, tlsConfig)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(lis)
+	}()
+
+	// Wait for signal to exit
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sigCh:
+	case err := <-errCh:
+		log.Fatalf("Host agent failed: %v", err)
+	}
+
+	// Stop the agent, letting in-flight executions finish
+	server.Shutdown(*shutdownTimeout)
+	close(stopCh)
+}
+
+// runFileTransport serves the legacy file based hand-off in baseDir, executing in the VMs of manager
+func runFileTransport(baseDir string, manager *flintlock.FirecrackerManager) {
 	// Create flintlock server
-	server, err := flintlock.NewServer(*baseDir)
+	server, err := flintlock.NewServer(baseDir)
 	if err != nil {
 		log.Fatalf("Failed to create flintlock server: %v", err)
 	}
+	server.Execute = manager.ExecuteCode
 
 	// Start server
 	if err := server.Start(); err != nil {
@@ -42,4 +188,41 @@ func main() {
 	if err := server.Stop(); err != nil {
 		log.Fatalf("Failed to stop flintlock server: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+// flushTraces exports the spans still buffered before exiting
+func flushTraces(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.Errorf("Failed to flush traces: %v", err)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics of the agent on addr
+func serveMetrics(addr string) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics.Register(registry)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	log.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Metrics server failed: %v", err)
+	}
+}
+
+// slotUIDs returns the UID range of the VMs of the KVM slot of the pod, the
+// UIDs following the slot's own UID that kvm-device-plugin reserved for it
+func slotUIDs() (base, count int, ok bool) {
+	uid, err := strconv.Atoi(os.Getenv("TVM_JAILER_UID"))
+	if err != nil {
+		return 0, 0, false
+	}
+	count, err = strconv.Atoi(os.Getenv("TVM_JAILER_UID_COUNT"))
+	if err != nil || count < 1 {
+		log.Fatalf("TVM_JAILER_UID is set without a valid TVM_JAILER_UID_COUNT")
+	}
+	return uid + 1, count, true
+}
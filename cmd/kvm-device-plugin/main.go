@@ -1,65 +1,173 @@
 package main
 
 import (
-	"fmt"
+	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/yourusername/tvm/pkg/deviceplugin"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// retryInterval is how long to wait before starting the plugins again after a failure
+const retryInterval = 5 * time.Second
+
 func main() {
-	fmt.Println("Starting kvm-device-plugin...")
-	
-	// Create a channel to handle device discovery
-	go discoverDevices()
-	
-	// Keep the main goroutine alive
-	for {
-		fmt.Println("KVM device plugin running...")
-		time.Sleep(60 * time.Second)
+	// Parse command line flags
+	klog.InitFlags(nil)
+	slots := flag.Int("slots", 0, "Number of devices advertised per resource, 0 to derive it from the node resources")
+	slotState := flag.String("slot-state", deviceplugin.DefaultSlotStatePath, "File the derived slot count is kept in")
+	slotMemoryMB := flag.Int("slot-memory-mb", deviceplugin.DefaultSlotMemoryMB, "Memory of a VM in MB assumed when deriving the slot count")
+	healthAddr := flag.String("health-addr", ":8081", "Address the /healthz endpoint binds to, empty to disable")
+	nodeName := flag.String("node-name", os.Getenv("NODE_NAME"), "Node annotated with its VM capacity, empty to disable reporting")
+	capacityInterval := flag.Duration("capacity-interval", time.Minute, "How often the VM capacity of the node is reported")
+	vmDir := flag.String("vm-dir", deviceplugin.DefaultVMDir, "Directory flintlock keeps its VMs in")
+	reservedVCPU := flag.Int64("reserved-vcpu", 0, "vCPUs of the node kept for the host rather than VMs")
+	reservedMemoryMB := flag.Int64("reserved-memory-mb", 0, "Memory in MB of the node kept for the host rather than VMs")
+	jail := deviceplugin.NewJail()
+	flag.StringVar(&jail.Root, "jailer-root", deviceplugin.DefaultJailerRoot, "Directory the jailer chroots of the KVM slots are created in")
+	flag.StringVar(&jail.CgroupRoot, "cgroup-root", deviceplugin.DefaultCgroupRoot, "cgroup v2 directory the cgroups of the KVM slots are created in, empty to disable")
+	flag.IntVar(&jail.BaseUID, "base-uid", deviceplugin.DefaultBaseUID, "UID and GID of the first KVM slot, each slot has a range of 1000 UIDs for itself and its VMs")
+	flag.Parse()
+
+	count, err := deviceplugin.ResolveSlots(*slots, *slotState, *slotMemoryMB)
+	if err != nil {
+		klog.Fatalf("Failed to resolve the slot count: %v", err)
 	}
-}
 
-func discoverDevices() {
-	fmt.Println("Starting device discovery...")
-	
-	// Simulate device discovery
+	// Healthy while all plugins are registered with kubelet
+	var registered atomic.Bool
+	if *healthAddr != "" {
+		go serveHealth(*healthAddr, &registered)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if *nodeName != "" {
+		reporter, err := newCapacityReporter(*nodeName)
+		if err != nil {
+			klog.Fatalf("Failed to create capacity reporter: %v", err)
+		}
+		reporter.VMDir = *vmDir
+		reporter.ReservedVCPU = *reservedVCPU
+		reporter.ReservedMemoryMB = *reservedMemoryMB
+		go reporter.Run(*capacityInterval, stopCh)
+	} else {
+		klog.Warning("No node name configured, the VM capacity of the node isn't reported")
+	}
+
+	// Kubelet removes all plugin sockets when it restarts, watch for its
+	// socket being recreated to start the plugins again
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(pluginapi.DevicePluginPath); err != nil {
+		klog.Fatalf("Failed to watch %s: %v", pluginapi.DevicePluginPath, err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	var plugins []*deviceplugin.DevicePlugin
+	restart := true
 	for {
-		// Check for KVM devices
-		fmt.Println("Checking for KVM devices...")
-		
-		// Check if /dev/kvm exists
-		if _, err := os.Stat("/dev/kvm"); os.IsNotExist(err) {
-			fmt.Println("KVM device not found")
-		} else {
-			fmt.Println("KVM device found")
-			
-			// Write to a status file
-			writeToFile("/var/lib/flintlock/kvm_status.txt", "KVM device available")
+		if restart {
+			restart = false
+			stopPlugins(plugins)
+			registered.Store(false)
+			plugins, err = startPlugins(count, jail)
+			if err != nil {
+				klog.Errorf("Failed to start device plugins, retrying in %v: %v", retryInterval, err)
+			} else {
+				registered.Store(true)
+			}
+		}
+
+		var retry <-chan time.Time
+		if !registered.Load() {
+			retry = time.After(retryInterval)
+		}
+
+		select {
+		case sig := <-sigCh:
+			klog.Infof("Received %v, stopping device plugins", sig)
+			stopPlugins(plugins)
+			return
+		case event := <-watcher.Events:
+			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
+				klog.Info("Kubelet restarted, restarting device plugins")
+				restart = true
+			}
+		case err := <-watcher.Errors:
+			klog.Errorf("Watcher error: %v", err)
+		case <-retry:
+			restart = true
 		}
-		
-		// Sleep for a while
-		time.Sleep(30 * time.Second)
 	}
 }
 
-func writeToFile(filename, content string) {
-	// Create the directory if it doesn't exist
-	dir := "/var/lib/flintlock"
-	os.MkdirAll(dir, 0755)
-	
-	// Write the content to the file
-	file, err := os.Create(filename)
+// newCapacityReporter creates a reporter for nodeName with the in-cluster config
+func newCapacityReporter(nodeName string) (*deviceplugin.CapacityReporter, error) {
+	config, err := rest.InClusterConfig()
 	if err != nil {
-		fmt.Printf("Error creating file %s: %v\n", filename, err)
-		return
+		return nil, err
 	}
-	defer file.Close()
-	
-	_, err = file.WriteString(content)
+	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		fmt.Printf("Error writing to file %s: %v\n", filename, err)
-		return
+		return nil, err
+	}
+	return deviceplugin.NewCapacityReporter(client, nodeName), nil
+}
+
+// startPlugins starts and registers a plugin advertising count devices for
+// every resource, the KVM slots in jail. On failure the plugins already
+// started are stopped.
+func startPlugins(count int, jail *deviceplugin.Jail) ([]*deviceplugin.DevicePlugin, error) {
+	var plugins []*deviceplugin.DevicePlugin
+	for _, resource := range deviceplugin.Resources() {
+		plugin := deviceplugin.NewDevicePlugin(resource, count)
+		if resource.Name == deviceplugin.ResourceName {
+			plugin.Jail = jail
+		}
+		if err := plugin.Start(); err != nil {
+			plugin.Stop()
+			stopPlugins(plugins)
+			return nil, err
+		}
+		klog.Infof("Registered %d devices of %s", count, resource.Name)
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+// stopPlugins stops plugins, deregistering them from kubelet
+func stopPlugins(plugins []*deviceplugin.DevicePlugin) {
+	for _, plugin := range plugins {
+		plugin.Stop()
+	}
+}
+
+// serveHealth serves /healthz on addr, failing while the plugins aren't registered
+func serveHealth(addr string, registered *atomic.Bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !registered.Load() {
+			http.Error(w, "device plugins not registered", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Fatalf("Failed to serve health endpoint: %v", err)
 	}
-	
-	fmt.Printf("Successfully wrote to file %s\n", filename)
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// runFileTransport runs the file based hand-off to flintlock on the shared
+// hostPath instead of the controllers, executing the sample in the VM of the
+// MCPSession session, given as namespace/name
+func runFileTransport(session string) {
+	fmt.Println("Starting lime-ctrl with the file transport...")
+
+	// Create a channel to handle MicroVM requests
+	go handleMicroVMRequests()
+
+	// Create a channel to handle MCPSession requests
+	go handleMCPSessionRequests()
+
+	// Create a channel to handle code execution requests
+	go handleCodeExecutionRequests(flintlock.NewFileClient("/var/lib/flintlock"), session)
+
+	// Keep the main goroutine alive
+	for {
+		fmt.Println("Lime controller running...")
+
+		// Check if there are any status files
+		checkStatusFiles()
+
+		time.Sleep(60 * time.Second)
+	}
+}
+
+func handleMicroVMRequests() {
+	fmt.Println("Starting MicroVM request handler...")
+
+	// Simulate handling MicroVM requests
+	for {
+		// Check if there are any MicroVM requests
+		fmt.Println("Checking for MicroVM requests...")
+
+		// Write to the flintlock request file
+		writeToFile("/var/lib/flintlock/microvms/requests.txt", "MicroVM request from lime-ctrl")
+
+		// Sleep for a while
+		time.Sleep(30 * time.Second)
+	}
+}
+
+func handleMCPSessionRequests() {
+	fmt.Println("Starting MCPSession request handler...")
+
+	// Simulate handling MCPSession requests
+	for {
+		// Check if there are any MCPSession requests
+		fmt.Println("Checking for MCPSession requests...")
+
+		// Write to the flintlock request file
+		writeToFile("/var/lib/flintlock/microvms/mcp_requests.txt", "MCPSession request from lime-ctrl")
+
+		// Sleep for a while
+		time.Sleep(45 * time.Second)
+	}
+}
+
+func handleCodeExecutionRequests(client *flintlock.FileClient, name string) {
+	fmt.Println("Starting code execution request handler...")
+
+	// Executions run on behalf of the session, for the audit log
+	session, err := getMCPSession(name)
+	if err != nil {
+		fmt.Printf("Not executing code requests: %v\n", err)
+		return
+	}
+
+	// Simulate handling code execution requests
+	for {
+		// Check if there are any code execution requests
+		fmt.Println("Checking for code execution requests...")
+
+		// Create a sample Python code execution request
+		request := createSampleCodeExecutionRequest()
+		request.UserID = session.Spec.UserID
+		request.GroupID = session.Spec.GroupID
+		request.SessionID = session.Name
+
+		// Executions run concurrently, each request has its own ID
+		go executeRequest(client, session.Spec.VMID, request)
+
+		// Sleep for a while
+		time.Sleep(20 * time.Second)
+	}
+}
+
+func createSampleCodeExecutionRequest() *flintlock.ExecutionRequest {
+	// Create a sample Python script
+	pythonScript := `
+import os
+import sys
+import json
+import time
+from datetime import datetime
+
+def main():
+    print("=== Virtual VM (VVM) System Demo ===")
+    print("Current time:", datetime.now().strftime("%Y-%m-%d %H:%M:%S"))
+    print("Python version:", sys.version)
+    print("Process ID:", os.getpid())
+    
+    # Simulate some computation
+    print("\\nPerforming computation...")
+    result = 0
+    for i in range(1000000):
+        result += i
+    print("Sum of numbers from 0 to 999999:", result)
+    
+    # Simulate file operations
+    print("\\nPerforming file operations...")
+    with open("/tmp/vvm_test_file.txt", "w") as f:
+        f.write("This file was created by the VVM system\\n")
+        f.write("Current time: " + datetime.now().strftime("%Y-%m-%d %H:%M:%S") + "\\n")
+    
+    print("File created successfully")
+    with open("/tmp/vvm_test_file.txt", "r") as f:
+        content = f.read()
+    print("File content:\\n" + content)
+    
+    # Return a JSON result
+    result_dict = {
+        "status": "success",
+        "timestamp": datetime.now().strftime("%Y-%m-%d %H:%M:%S"),
+        "computation_result": result,
+        "file_created": "/tmp/vvm_test_file.txt"
+    }
+    
+    print("\\nJSON result:")
+    print(json.dumps(result_dict, indent=2))
+    return result_dict
+
+if __name__ == "__main__":
+    main()
+`
+
+	// Write the Python script to a file
+	writeToFile("/var/lib/flintlock/sample_script.py", pythonScript)
+
+	// Create an execution request
+	return &flintlock.ExecutionRequest{
+		Command: "python3",
+		Args:    []string{"/var/lib/flintlock/sample_script.py"},
+		Env: map[string]string{
+			"VVM_EXECUTION_ID": "test-123",
+			"VVM_USER":         "user123",
+		},
+		Timeout: 60,
+	}
+}
+
+// getMCPSession reads the MCPSession name, given as namespace/name
+func getMCPSession(name string) (*v1alpha1.MCPSession, error) {
+	namespace, sessionName, ok := strings.Cut(name, "/")
+	if !ok || namespace == "" || sessionName == "" {
+		return nil, fmt.Errorf("MCPSession %q must be given as namespace/name", name)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to register vvm types: %v", err)
+	}
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster config: %v", err)
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	session := &v1alpha1.MCPSession{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: sessionName}, session); err != nil {
+		return nil, fmt.Errorf("failed to get MCPSession %s: %v", name, err)
+	}
+	if session.Spec.VMID == "" {
+		return nil, fmt.Errorf("MCPSession %s has no VM", name)
+	}
+	return session, nil
+}
+
+// executeRequest sends an execution request to flintlock and prints the response
+func executeRequest(client *flintlock.FileClient, vmID string, request *flintlock.ExecutionRequest) {
+	fmt.Printf("Forwarding execution request to flintlock: %+v\n", *request)
+
+	// Leave flintlock time to report the timeout itself
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Second+30*time.Second)
+	defer cancel()
+
+	response, err := client.ExecuteCode(ctx, vmID, request)
+	if err != nil {
+		fmt.Printf("Error executing request: %v\n", err)
+		return
+	}
+	fmt.Printf("Execution response: %+v\n", *response)
+}
+
+func checkStatusFiles() {
+	// Check if there are any status files
+	if _, err := os.Stat("/var/lib/flintlock/microvms/microvm-status.json"); err == nil {
+		// Read the status file
+		data, err := ioutil.ReadFile("/var/lib/flintlock/microvms/microvm-status.json")
+		if err == nil {
+			fmt.Printf("MicroVM status: %s\n", string(data))
+		}
+	}
+
+	if _, err := os.Stat("/var/lib/flintlock/microvms/mcpsession-status.json"); err == nil {
+		// Read the status file
+		data, err := ioutil.ReadFile("/var/lib/flintlock/microvms/mcpsession-status.json")
+		if err == nil {
+			fmt.Printf("MCPSession status: %s\n", string(data))
+		}
+	}
+}
+
+func writeToFile(filename, content string) {
+	// Create the directory if it doesn't exist
+	dir := "/var/lib/flintlock/microvms"
+	os.MkdirAll(dir, 0755)
+
+	// Write the content to the file
+	file, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error creating file %s: %v\n", filename, err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		fmt.Printf("Error writing to file %s: %v\n", filename, err)
+		return
+	}
+
+	fmt.Printf("Successfully wrote to file %s\n", filename)
+}
@@ -1,272 +1,198 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"context"
+	"flag"
+	"net/http"
 	"os"
 	"time"
-)
 
-// ExecutionRequest represents a request to execute code in a MicroVM
-type ExecutionRequest struct {
-	Command string            `json:"command"`
-	Args    []string          `json:"args"`
-	Env     map[string]string `json:"env"`
-	Timeout int               `json:"timeout"`
-}
+	"github.com/yourusername/tvm/pkg/agent"
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/audit"
+	"github.com/yourusername/tvm/pkg/controller"
+	"github.com/yourusername/tvm/pkg/mcp"
+	"github.com/yourusername/tvm/pkg/metrics"
+	"github.com/yourusername/tvm/pkg/tracing"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
 
-// ExecutionResponse represents the response from executing code in a MicroVM
-type ExecutionResponse struct {
-	Status   string `json:"status"`
-	Output   string `json:"output"`
-	ExitCode int    `json:"exitCode"`
-	Error    string `json:"error,omitempty"`
-}
+var setupLog = ctrl.Log.WithName("setup")
 
 func main() {
-	fmt.Println("Starting lime-ctrl...")
-	
-	// Create a channel to handle MicroVM requests
-	go handleMicroVMRequests()
-	
-	// Create a channel to handle MCPSession requests
-	go handleMCPSessionRequests()
-	
-	// Create a channel to handle code execution requests
-	go handleCodeExecutionRequests()
-	
-	// Keep the main goroutine alive
-	for {
-		fmt.Println("Lime controller running...")
-		
-		// Check if there are any status files
-		checkStatusFiles()
-		
-		time.Sleep(60 * time.Second)
+	// Parse command line flags
+	var opts controller.Options
+	flag.StringVar(&opts.FlintlockEndpoint, "flintlock-endpoint", "", "Flintlock endpoint used when no node has a host agent")
+	flag.BoolVar(&opts.FlintlockClient.TLS, "flintlock-tls", false, "Connect to flintlock with TLS")
+	flag.StringVar(&opts.FlintlockClient.CAFile, "flintlock-ca", "", "CA the flintlock certificate is verified with, the system roots if empty")
+	flag.StringVar(&opts.FlintlockClient.CertFile, "flintlock-cert", "", "Client certificate presented to flintlock for mutual TLS")
+	flag.StringVar(&opts.FlintlockClient.KeyFile, "flintlock-key", "", "Private key of the flintlock client certificate")
+	flag.StringVar(&opts.FlintlockClient.ServerName, "flintlock-server-name", "", "Name the flintlock certificate is verified against, the endpoint host if empty")
+	flag.StringVar(&opts.FlintlockClient.TokenFile, "flintlock-token-file", "", "File holding the flintlock basic auth token")
+	flag.DurationVar(&opts.FlintlockClient.HealthCheckInterval, "flintlock-health-interval", 30*time.Second, "How often the flintlock connection is health checked, 0 to disable")
+	flag.StringVar(&opts.AgentNamespace, "agent-namespace", "vvm-system", "Namespace of the host agent pods")
+	flag.StringVar(&opts.AgentSelector, "agent-selector", "app=flintlock", "Label selector of the host agent pods")
+	flag.IntVar(&opts.AgentPort, "agent-port", 9090, "gRPC port of the host agents")
+	agentTLSCert := flag.String("agent-tls-cert", "", "Client certificate presented to the host agents")
+	agentTLSKey := flag.String("agent-tls-key", "", "Private key of the host agent client certificate")
+	agentCA := flag.String("agent-ca", "", "CA the host agent certificates are verified with")
+	flag.StringVar(&opts.PlacementStrategy, "placement-strategy", controller.PlacementSpread, "How VMs are placed on nodes: spread or binpack")
+	rateLimitConfig := flag.String("rate-limit-config", "", "YAML file with the default and maximum I/O rate limits of VMs, a built-in ceiling if empty")
+	metricsAddr := flag.String("metrics-addr", ":8080", "Address the metrics endpoint binds to")
+	probeAddr := flag.String("health-probe-addr", ":8081", "Address the health probes bind to")
+	mcpAddr := flag.String("mcp-addr", ":8082", "Address the MCP server binds to")
+	fileTransport := flag.Bool("file-transport", false, "Use the file based hand-off to flintlock instead of the controllers")
+	fileTransportSession := flag.String("file-transport-session", "", "MCPSession, as namespace/name, the file transport executes its sample for")
+	var traceOpts tracing.Options
+	flag.StringVar(&traceOpts.Exporter, "trace-exporter", tracing.ExporterNone, "Where traces are exported: otlp, stdout or none")
+	flag.StringVar(&traceOpts.Endpoint, "otlp-endpoint", "", "OTLP collector traces are sent to, OTEL_EXPORTER_OTLP_ENDPOINT if empty")
+	flag.BoolVar(&traceOpts.Insecure, "otlp-insecure", false, "Send traces to the OTLP collector without TLS")
+	flag.Float64Var(&traceOpts.SampleRatio, "trace-sample-ratio", 1, "Fraction of new traces that are recorded")
+	var auditOpts audit.Options
+	flag.StringVar(&auditOpts.Path, "audit-log", "", "File the audit log is appended to, empty to disable")
+	flag.IntVar(&auditOpts.MaxSizeMB, "audit-max-size-mb", audit.DefaultMaxSizeMB, "Size in MB at which the audit log is rotated")
+	flag.DurationVar(&auditOpts.Retention, "audit-retention", 90*24*time.Hour, "How long rotated audit logs are kept, 0 to keep them forever")
+	flag.StringVar(&auditOpts.WebhookURL, "audit-webhook", "", "URL every audit event is posted to, empty to disable")
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	ctrl.SetLogger(klog.NewKlogr())
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "lime-ctrl", traceOpts)
+	if err != nil {
+		setupLog.Error(err, "Failed to set up tracing")
+		os.Exit(1)
 	}
-}
 
-func handleMicroVMRequests() {
-	fmt.Println("Starting MicroVM request handler...")
-	
-	// Simulate handling MicroVM requests
-	for {
-		// Check if there are any MicroVM requests
-		fmt.Println("Checking for MicroVM requests...")
-		
-		// Write to the flintlock request file
-		writeToFile("/var/lib/flintlock/microvms/requests.txt", "MicroVM request from lime-ctrl")
-		
-		// Sleep for a while
-		time.Sleep(30 * time.Second)
+	if *fileTransport {
+		runFileTransport(*fileTransportSession)
+		flushTraces(shutdownTracing)
+		return
 	}
-}
 
-func handleMCPSessionRequests() {
-	fmt.Println("Starting MCPSession request handler...")
-	
-	// Simulate handling MCPSession requests
-	for {
-		// Check if there are any MCPSession requests
-		fmt.Println("Checking for MCPSession requests...")
-		
-		// Write to the flintlock request file
-		writeToFile("/var/lib/flintlock/microvms/mcp_requests.txt", "MCPSession request from lime-ctrl")
-		
-		// Sleep for a while
-		time.Sleep(45 * time.Second)
+	if err := opts.FlintlockClient.Validate(); err != nil {
+		setupLog.Error(err, "Invalid flintlock client flags")
+		os.Exit(1)
 	}
-}
 
-func handleCodeExecutionRequests() {
-	fmt.Println("Starting code execution request handler...")
-	
-	// Simulate handling code execution requests
-	for {
-		// Check if there are any code execution requests
-		fmt.Println("Checking for code execution requests...")
-		
-		// Create a sample Python code execution request
-		createSampleCodeExecutionRequest()
-		
-		// Process any execution requests
-		processExecutionRequests()
-		
-		// Sleep for a while
-		time.Sleep(20 * time.Second)
+	if *rateLimitConfig != "" {
+		policy, err := controller.LoadRateLimitPolicy(*rateLimitConfig)
+		if err != nil {
+			setupLog.Error(err, "Failed to load rate limit policy")
+			os.Exit(1)
+		}
+		opts.RateLimits = policy
+	} else {
+		setupLog.Info("No rate limit policy configured, capping VMs at the built-in ceiling")
 	}
-}
 
-func createSampleCodeExecutionRequest() {
-	// Create a sample Python script
-	pythonScript := `
-import os
-import sys
-import json
-import time
-from datetime import datetime
+	if *agentTLSCert != "" || *agentTLSKey != "" || *agentCA != "" {
+		tlsConfig, err := agent.ClientTLSConfig(*agentTLSCert, *agentTLSKey, *agentCA)
+		if err != nil {
+			setupLog.Error(err, "Failed to configure host agent TLS")
+			os.Exit(1)
+		}
+		opts.AgentTLS = tlsConfig
+	} else {
+		setupLog.Info("No host agent TLS certificates configured, connecting to agents in plaintext")
+	}
 
-def main():
-    print("=== Virtual VM (VVM) System Demo ===")
-    print("Current time:", datetime.now().strftime("%Y-%m-%d %H:%M:%S"))
-    print("Python version:", sys.version)
-    print("Process ID:", os.getpid())
-    
-    # Simulate some computation
-    print("\\nPerforming computation...")
-    result = 0
-    for i in range(1000000):
-        result += i
-    print("Sum of numbers from 0 to 999999:", result)
-    
-    # Simulate file operations
-    print("\\nPerforming file operations...")
-    with open("/tmp/vvm_test_file.txt", "w") as f:
-        f.write("This file was created by the VVM system\\n")
-        f.write("Current time: " + datetime.now().strftime("%Y-%m-%d %H:%M:%S") + "\\n")
-    
-    print("File created successfully")
-    with open("/tmp/vvm_test_file.txt", "r") as f:
-        content = f.read()
-    print("File content:\\n" + content)
-    
-    # Return a JSON result
-    result_dict = {
-        "status": "success",
-        "timestamp": datetime.now().strftime("%Y-%m-%d %H:%M:%S"),
-        "computation_result": result,
-        "file_created": "/tmp/vvm_test_file.txt"
-    }
-    
-    print("\\nJSON result:")
-    print(json.dumps(result_dict, indent=2))
-    return result_dict
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		setupLog.Error(err, "Failed to register core types")
+		os.Exit(1)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		setupLog.Error(err, "Failed to register vvm types")
+		os.Exit(1)
+	}
 
-if __name__ == "__main__":
-    main()
-`
-	
-	// Write the Python script to a file
-	writeToFile("/var/lib/flintlock/sample_script.py", pythonScript)
-	
-	// Create an execution request
-	request := ExecutionRequest{
-		Command: "python3",
-		Args:    []string{"/var/lib/flintlock/sample_script.py"},
-		Env: map[string]string{
-			"VVM_EXECUTION_ID": "test-123",
-			"VVM_USER":         "user123",
-		},
-		Timeout: 60,
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: *metricsAddr},
+		HealthProbeBindAddress: *probeAddr,
+	})
+	if err != nil {
+		setupLog.Error(err, "Failed to create manager")
+		os.Exit(1)
 	}
-	
-	// Marshal the request to JSON
-	requestJSON, err := json.Marshal(request)
+
+	metrics.Register(ctrlmetrics.Registry)
+
+	// Executions through the Flintlock fallback are recorded by lime-ctrl,
+	// the host agent records its own
+	auditLog, err := audit.NewLogger("lime-ctrl", auditOpts)
 	if err != nil {
-		fmt.Printf("Error marshaling execution request: %v\n", err)
-		return
+		setupLog.Error(err, "Failed to open audit log")
+		os.Exit(1)
 	}
-	
-	// Write the request to a file
-	writeToFile("/var/lib/flintlock/microvms/execute_request.txt", string(requestJSON))
-	fmt.Println("Created sample code execution request")
-}
 
-func processExecutionRequests() {
-	// Check if there's an execution request file
-	if _, err := os.Stat("/var/lib/flintlock/microvms/execute_request.txt"); err == nil {
-		fmt.Println("Found execution request, processing...")
-		
-		// Read the request file
-		requestData, err := ioutil.ReadFile("/var/lib/flintlock/microvms/execute_request.txt")
-		if err != nil {
-			fmt.Printf("Error reading execution request: %v\n", err)
-			return
-		}
-		
-		// Parse the request
-		var request ExecutionRequest
-		if err := json.Unmarshal(requestData, &request); err != nil {
-			fmt.Printf("Error parsing execution request: %v\n", err)
-			return
-		}
-		
-		// Forward the request to flintlock
-		fmt.Printf("Forwarding execution request to flintlock: %+v\n", request)
-		
-		// In a real implementation, we would send the request to flintlock
-		// and wait for the response. For now, we'll just simulate a response.
-		
-		// Simulate a response
-		response := ExecutionResponse{
-			Status:   "success",
-			Output:   "Execution completed successfully",
-			ExitCode: 0,
-		}
-		
-		// Marshal the response to JSON
-		responseJSON, err := json.Marshal(response)
-		if err != nil {
-			fmt.Printf("Error marshaling execution response: %v\n", err)
-			return
-		}
-		
-		// Write the response to a file
-		writeToFile("/var/lib/flintlock/microvms/execute_response.txt", string(responseJSON))
-		fmt.Println("Processed execution request")
-		
-		// Remove the request file
-		os.Remove("/var/lib/flintlock/microvms/execute_request.txt")
+	opts.FlintlockClient.Audit = auditLog
+	if err := controller.Add(mgr, opts); err != nil {
+		setupLog.Error(err, "Failed to create MicroVM controller")
+		os.Exit(1)
 	}
-}
 
-func checkStatusFiles() {
-	// Check if there are any status files
-	if _, err := os.Stat("/var/lib/flintlock/microvms/microvm-status.json"); err == nil {
-		// Read the status file
-		data, err := ioutil.ReadFile("/var/lib/flintlock/microvms/microvm-status.json")
-		if err == nil {
-			fmt.Printf("MicroVM status: %s\n", string(data))
-		}
+	// The MCP server resumes the VMs the MCPSession controller pauses
+	mcpServer := mcp.NewServer(*mcpAddr)
+	mcpServer.Audit = auditLog
+	mcpServer.Client = mgr.GetClient()
+	if err := controller.AddMCPSession(mgr, mcpServer); err != nil {
+		setupLog.Error(err, "Failed to create MCPSession controller")
+		os.Exit(1)
 	}
-	
-	if _, err := os.Stat("/var/lib/flintlock/microvms/mcpsession-status.json"); err == nil {
-		// Read the status file
-		data, err := ioutil.ReadFile("/var/lib/flintlock/microvms/mcpsession-status.json")
-		if err == nil {
-			fmt.Printf("MCPSession status: %s\n", string(data))
+
+	// Run the MCP server for as long as the manager
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			mcpServer.Stop(shutdownCtx)
+		}()
+		if err := mcpServer.Start(); err != nil && err != http.ErrServerClosed {
+			return err
 		}
+		return nil
+	}))
+	if err != nil {
+		setupLog.Error(err, "Failed to add MCP server")
+		os.Exit(1)
 	}
-	
-	// Check for execution responses
-	if _, err := os.Stat("/var/lib/flintlock/microvms/execute_response.txt"); err == nil {
-		// Read the response file
-		data, err := ioutil.ReadFile("/var/lib/flintlock/microvms/execute_response.txt")
-		if err == nil {
-			fmt.Printf("Execution response: %s\n", string(data))
-		}
+
+	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		setupLog.Error(err, "Failed to add health check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+		setupLog.Error(err, "Failed to add ready check")
+		os.Exit(1)
 	}
-}
 
-func writeToFile(filename, content string) {
-	// Create the directory if it doesn't exist
-	dir := "/var/lib/flintlock/microvms"
-	os.MkdirAll(dir, 0755)
-	
-	// Write the content to the file
-	file, err := os.Create(filename)
-	if err != nil {
-		fmt.Printf("Error creating file %s: %v\n", filename, err)
-		return
+	setupLog.Info("Starting lime-ctrl")
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	flushTraces(shutdownTracing)
+	if closeErr := auditLog.Close(); closeErr != nil {
+		setupLog.Error(closeErr, "Failed to close audit log")
 	}
-	defer file.Close()
-	
-	_, err = file.WriteString(content)
 	if err != nil {
-		fmt.Printf("Error writing to file %s: %v\n", filename, err)
-		return
+		setupLog.Error(err, "Manager exited")
+		os.Exit(1)
+	}
+}
+
+// flushTraces exports the spans still buffered before exiting
+func flushTraces(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		setupLog.Error(err, "Failed to flush traces")
 	}
-	
-	fmt.Printf("Successfully wrote to file %s\n", filename)
 }
@@ -0,0 +1,148 @@
+// Package agent implements the per-node host agent that runs Firecracker VMs
+// for lime-ctrl, and its client. The agent is a gRPC service with JSON encoded
+// messages, so it needs no generated code.
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	// ServiceName is the gRPC service name of the host agent
+	ServiceName = "tvm.agent.v1.HostAgent"
+
+	// Version is the protocol version, agents and clients must agree on the major version
+	Version = "2.0"
+
+	// ServerName is the name agent certificates are issued for and verified against
+	ServerName = "tvm-agent"
+
+	// versionHeader carries the protocol version of the client on every call
+	versionHeader = "tvm-agent-version"
+
+	// codecName is the gRPC content subtype of the JSON codec
+	codecName = "json"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes gRPC messages as JSON
+type jsonCodec struct{}
+
+// Marshal implements encoding.Codec
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements encoding.Codec
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name implements encoding.Codec
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+// HandshakeRequest is sent by clients when they connect
+type HandshakeRequest struct {
+	Version string `json:"version"`
+}
+
+// HandshakeResponse identifies the agent
+type HandshakeResponse struct {
+	Version string `json:"version"`
+	Node    string `json:"node"`
+}
+
+// CreateVMRequest creates and boots a VM
+type CreateVMRequest struct {
+	Config flintlock.VMConfig `json:"config"`
+}
+
+// VMRequest identifies a VM
+type VMRequest struct {
+	VMID string `json:"vmId"`
+}
+
+// VMResponse describes a VM
+type VMResponse struct {
+	VM *flintlock.VMInfo `json:"vm"`
+}
+
+// ListVMsRequest lists all VMs of the agent
+type ListVMsRequest struct{}
+
+// ListVMsResponse holds all VMs of the agent
+type ListVMsResponse struct {
+	VMs []*flintlock.VMInfo `json:"vms"`
+}
+
+// ExecuteRequest executes code in a VM
+type ExecuteRequest struct {
+	VMID    string                      `json:"vmId"`
+	Request *flintlock.ExecutionRequest `json:"request"`
+}
+
+// ExecuteResponse is the result of an execution
+type ExecuteResponse struct {
+	Response *flintlock.ExecutionResponse `json:"response"`
+}
+
+// SnapshotRequest takes a snapshot of a VM
+type SnapshotRequest struct {
+	VMID string `json:"vmId"`
+	Name string `json:"name"`
+}
+
+// SnapshotResponse describes a snapshot
+type SnapshotResponse struct {
+	Snapshot *flintlock.SnapshotInfo `json:"snapshot"`
+}
+
+// BalloonRequest resizes the memory balloon of a VM
+type BalloonRequest struct {
+	VMID     string `json:"vmId"`
+	AmountMB int    `json:"amountMB"`
+}
+
+// VolumeRequest addresses a volume file in the volume directory of the agent
+type VolumeRequest struct {
+	// Namespace is the namespace the volume belongs to, the path must be one of its volumes
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+}
+
+// WatchRequest subscribes to the state changes of all VMs
+type WatchRequest struct{}
+
+// Empty is returned by calls without a result
+type Empty struct{}
+
+// compatible reports whether a peer version has the same major version
+func compatible(version string) bool {
+	major, _, _ := strings.Cut(version, ".")
+	own, _, _ := strings.Cut(Version, ".")
+	return major != "" && major == own
+}
+
+// vmState maps the information of a VM to a MicroVM state and error
+func vmState(info *flintlock.VMInfo) (v1alpha1.MicroVMState, string) {
+	if info.Running && info.Paused {
+		return v1alpha1.MicroVMStatePaused, ""
+	}
+	if info.Running {
+		return v1alpha1.MicroVMStateRunning, ""
+	}
+	if info.ExitError != "" {
+		return v1alpha1.MicroVMStateError, "firecracker exited: " + info.ExitError
+	}
+	return v1alpha1.MicroVMStateStopped, ""
+}
@@ -0,0 +1,351 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// handshakeTimeout bounds the version handshake when connecting
+const handshakeTimeout = 10 * time.Second
+
+// Client is a client for the host agent of a node
+type Client struct {
+	endpoint string
+	conn     *grpc.ClientConn
+	// caller retries calls and breaks the circuit to the agent
+	caller *flintlock.Caller
+	// node is the node the agent runs on, as reported by the handshake
+	node string
+}
+
+var _ flintlock.Backend = &Client{}
+
+// NewClient connects to the agent at endpoint and checks that its version is
+// compatible. Without a TLS config the connection is plaintext.
+func NewClient(endpoint string, tlsConfig *tls.Config) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(endpoint,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to host agent: %v", err)
+	}
+	c := &Client{endpoint: endpoint, conn: conn, caller: flintlock.NewCaller(endpoint)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	resp := &HandshakeResponse{}
+	err = conn.Invoke(withVersion(ctx), "/"+ServiceName+"/Handshake", &HandshakeRequest{Version: Version}, resp)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with host agent %s failed: %v", endpoint, err)
+	}
+	if !compatible(resp.Version) {
+		conn.Close()
+		return nil, fmt.Errorf("host agent %s has incompatible version %q", endpoint, resp.Version)
+	}
+	c.node = resp.Node
+
+	log.Infof("Connected to host agent %s on node %s (version %s)", endpoint, resp.Node, resp.Version)
+	return c, nil
+}
+
+// Node returns the node the agent runs on
+func (c *Client) Node() string {
+	return c.node
+}
+
+// Close closes the connection to the agent
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// CreateMicroVM creates the VM of a MicroVM on the node of the agent
+func (c *Client) CreateMicroVM(ctx context.Context, vm *v1alpha1.MicroVM) error {
+	config, err := vmConfig(vm)
+	if err != nil {
+		return err
+	}
+
+	resp := &VMResponse{}
+	if err := c.invoke(ctx, "create microVM", "CreateVM", false, &CreateVMRequest{Config: config}, resp); err != nil {
+		return err
+	}
+
+	vm.Status.VMID = resp.VM.ID
+	vm.Status.State = v1alpha1.MicroVMStateRunning
+	return nil
+}
+
+// DeleteMicroVM deletes a VM. Deleting a VM the agent doesn't know succeeds.
+func (c *Client) DeleteMicroVM(ctx context.Context, vmID string) error {
+	err := c.invoke(ctx, "delete microVM", "DeleteVM", true, &VMRequest{VMID: vmID}, &Empty{})
+	if err != nil && !errors.Is(err, flintlock.ErrVMNotFound) {
+		return err
+	}
+	return nil
+}
+
+// GetVM describes a VM
+func (c *Client) GetVM(ctx context.Context, vmID string) (*flintlock.VMInfo, error) {
+	resp := &VMResponse{}
+	if err := c.invoke(ctx, "get microVM", "GetVM", true, &VMRequest{VMID: vmID}, resp); err != nil {
+		return nil, err
+	}
+	return resp.VM, nil
+}
+
+// ListVMs describes all VMs of the agent
+func (c *Client) ListVMs(ctx context.Context) ([]*flintlock.VMInfo, error) {
+	resp := &ListVMsResponse{}
+	if err := c.invoke(ctx, "list microVMs", "ListVMs", true, &ListVMsRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp.VMs, nil
+}
+
+// UpdateMicroVMStatus updates the status of a MicroVM from its VM
+func (c *Client) UpdateMicroVMStatus(ctx context.Context, vm *v1alpha1.MicroVM) error {
+	info, err := c.GetVM(ctx, vm.Status.VMID)
+	if err != nil {
+		return err
+	}
+
+	vm.Status.State, vm.Status.Error = vmState(info)
+	vm.Status.RootfsDeltaMB = int32(info.RootfsDeltaBytes >> 20)
+	vm.Status.Balloon = balloonStatus(info.Balloon)
+	return nil
+}
+
+// PauseMicroVM pauses a VM
+func (c *Client) PauseMicroVM(ctx context.Context, vmID string) error {
+	return c.invoke(ctx, "pause microVM", "PauseVM", true, &VMRequest{VMID: vmID}, &Empty{})
+}
+
+// ResumeMicroVM resumes a paused VM
+func (c *Client) ResumeMicroVM(ctx context.Context, vmID string) error {
+	return c.invoke(ctx, "resume microVM", "ResumeVM", true, &VMRequest{VMID: vmID}, &Empty{})
+}
+
+// ResizeBalloon inflates or deflates the memory balloon of a VM to amountMB
+func (c *Client) ResizeBalloon(ctx context.Context, vmID string, amountMB int) error {
+	return c.invoke(ctx, "resize balloon", "ResizeBalloon", true, &BalloonRequest{VMID: vmID, AmountMB: amountMB}, &Empty{})
+}
+
+// DeleteVolume removes the volume file of namespace at path in the volume directory of the agent
+func (c *Client) DeleteVolume(ctx context.Context, namespace, path string) error {
+	return c.invoke(ctx, "delete volume", "DeleteVolume", true, &VolumeRequest{Namespace: namespace, Path: path}, &Empty{})
+}
+
+// ExecuteCode executes code in a VM
+func (c *Client) ExecuteCode(ctx context.Context, vmID string, req *flintlock.ExecutionRequest) (*flintlock.ExecutionResponse, error) {
+	resp := &ExecuteResponse{}
+	if err := c.invoke(ctx, "execute code", "Execute", false, &ExecuteRequest{VMID: vmID, Request: req}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Response, nil
+}
+
+// SnapshotVM takes a snapshot of a VM
+func (c *Client) SnapshotVM(ctx context.Context, vmID, name string) (*flintlock.SnapshotInfo, error) {
+	resp := &SnapshotResponse{}
+	if err := c.invoke(ctx, "snapshot microVM", "Snapshot", false, &SnapshotRequest{VMID: vmID, Name: name}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Snapshot, nil
+}
+
+// WatchMicroVMs streams the state changes of the VMs of the agent until ctx
+// is done. A broken stream is reopened after interval.
+func (c *Client) WatchMicroVMs(ctx context.Context, interval time.Duration) <-chan flintlock.VMEvent {
+	events := make(chan flintlock.VMEvent)
+
+	go func() {
+		defer close(events)
+
+		for {
+			err := c.watch(ctx, events)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("Watch of host agent %s ended: %v", c.endpoint, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	return events
+}
+
+// watch forwards the events of one watch stream until it breaks
+func (c *Client) watch(ctx context.Context, events chan<- flintlock.VMEvent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	desc := &grpc.StreamDesc{StreamName: "Watch", ServerStreams: true}
+	stream, err := c.conn.NewStream(withVersion(ctx), desc, "/"+ServiceName+"/Watch")
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&WatchRequest{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var event flintlock.VMEvent
+		if err := stream.RecvMsg(&event); err != nil {
+			return err
+		}
+
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// invoke calls a unary method of the agent to do op, retrying transient failures
+func (c *Client) invoke(ctx context.Context, op, method string, idempotent bool, req, resp interface{}) error {
+	return c.caller.Call(ctx, op, idempotent, func(ctx context.Context) error {
+		return c.conn.Invoke(withVersion(ctx), "/"+ServiceName+"/"+method, req, resp)
+	})
+}
+
+// withVersion attaches the protocol version of the client to a call
+func withVersion(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, versionHeader, Version)
+}
+
+// vmConfig converts a MicroVM to the configuration of its VM
+func vmConfig(vm *v1alpha1.MicroVM) (flintlock.VMConfig, error) {
+	config := flintlock.VMConfig{
+		VCPU:      int(vm.Spec.CPU),
+		Memory:    int(vm.Spec.Memory),
+		Image:     vm.Spec.Image,
+		Namespace: vm.Namespace,
+	}
+	if config.VCPU == 0 {
+		config.VCPU = 1
+	}
+	if config.Memory == 0 {
+		config.Memory = 512
+	}
+
+	if k := vm.Spec.Kernel; k != nil {
+		if err := flintlock.ValidateKernel(k); err != nil {
+			return config, err
+		}
+		if k.Image != "" {
+			return config, fmt.Errorf("kernel image %s is not supported by the host agent, use a kernel from the node catalog", k.Image)
+		}
+		config.KernelName = k.Name
+		config.KernelArgs = k.Args
+
+		if initrd := k.Initrd; initrd != nil {
+			if initrd.Image != "" {
+				return config, fmt.Errorf("initrd image %s is not supported by the host agent, use an initrd from the node catalog", initrd.Image)
+			}
+			config.InitrdName = initrd.Name
+		}
+	}
+
+	// File backed volumes use the path resolved by the controller into the
+	// status, ephemeral ones are allocated by the agent
+	if err := flintlock.ValidateVolumes(vm.Spec.Volumes); err != nil {
+		return config, err
+	}
+	for _, vol := range vm.Spec.Volumes {
+		drive := flintlock.DriveConfig{
+			ID:        vol.Name,
+			SizeMB:    vol.SizeMB,
+			ReadOnly:  vol.ReadOnly,
+			MountPath: vol.MountPath,
+		}
+		for _, s := range vm.Status.Volumes {
+			if s.Name == vol.Name {
+				drive.PathOnHost = s.Path
+			}
+		}
+		config.Drives = append(config.Drives, drive)
+	}
+
+	// The rate limits resolved by the controller into the status
+	if limits := vm.Status.RateLimits; limits != nil {
+		if limits.Network != nil {
+			return config, fmt.Errorf("network rate limits are not supported by the host agent, VMs have no network interfaces")
+		}
+		config.DiskRateLimit = rateLimit(limits.Disk)
+	}
+
+	// The balloon starts inflated by the memory above the target
+	if vm.Spec.Balloon != nil || vm.Spec.MemoryTarget != nil {
+		config.Balloon = &flintlock.BalloonConfig{
+			AmountMB:             flintlock.BalloonAmount(vm),
+			StatsIntervalSeconds: 5,
+		}
+		if b := vm.Spec.Balloon; b != nil {
+			config.Balloon.DeflateOnOOM = b.DeflateOnOOM
+			if b.StatsIntervalSeconds != nil {
+				config.Balloon.StatsIntervalSeconds = int(*b.StatsIntervalSeconds)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// balloonStatus converts the balloon of a VM to that of its MicroVM
+func balloonStatus(stats *flintlock.BalloonStats) *v1alpha1.BalloonStatus {
+	if stats == nil {
+		return nil
+	}
+	return &v1alpha1.BalloonStatus{
+		TargetMB:          stats.TargetMB,
+		ActualMB:          stats.ActualMB,
+		TotalMemoryMB:     stats.TotalMemoryMB,
+		FreeMemoryMB:      stats.FreeMemoryMB,
+		AvailableMemoryMB: stats.AvailableMemoryMB,
+		MajorFaults:       stats.MajorFaults,
+		MinorFaults:       stats.MinorFaults,
+	}
+}
+
+// rateLimit converts a rate limit of a MicroVM to that of its VM
+func rateLimit(limit *v1alpha1.RateLimit) *flintlock.RateLimit {
+	if limit == nil {
+		return nil
+	}
+	return &flintlock.RateLimit{
+		BandwidthBytesPerSec: limit.BandwidthBytesPerSec,
+		BandwidthBurstBytes:  limit.BandwidthBurstBytes,
+		OpsPerSec:            limit.OpsPerSec,
+		OpsBurst:             limit.OpsBurst,
+	}
+}
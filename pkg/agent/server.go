@@ -0,0 +1,359 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Server is the host agent of a node. It serves the VMs of a FirecrackerManager over gRPC.
+type Server struct {
+	manager    *flintlock.FirecrackerManager
+	node       string
+	grpcServer *grpc.Server
+	// executions is the number of executions in flight
+	executions atomic.Int64
+	// subscribers receive the VM events of the manager
+	subscribers map[chan flintlock.VMEvent]struct{}
+	// stopCh ends the watch streams on shutdown
+	stopCh chan struct{}
+	mutex  sync.Mutex
+}
+
+// NewServer creates a host agent for the VMs of manager. Without a TLS config the agent serves plaintext.
+func NewServer(manager *flintlock.FirecrackerManager, node string, tlsConfig *tls.Config) *Server {
+	s := &Server{
+		manager:     manager,
+		node:        node,
+		subscribers: make(map[chan flintlock.VMEvent]struct{}),
+		stopCh:      make(chan struct{}),
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryVersionCheck),
+		grpc.ChainStreamInterceptor(streamVersionCheck),
+		// Continue the traces of callers
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s.grpcServer = grpc.NewServer(opts...)
+	s.grpcServer.RegisterService(&serviceDesc, s)
+
+	return s
+}
+
+// Serve publishes the VM events of the manager and serves the agent on lis until Shutdown
+func (s *Server) Serve(lis net.Listener) error {
+	go s.broadcast()
+
+	log.Infof("Host agent for node %s listening on %s", s.node, lis.Addr())
+	return s.grpcServer.Serve(lis)
+}
+
+// Shutdown stops accepting calls and waits up to timeout for in-flight
+// executions to finish before closing the remaining connections
+func (s *Server) Shutdown(timeout time.Duration) {
+	// Watch streams never finish on their own
+	close(s.stopCh)
+
+	log.Infof("Stopping host agent, draining %d in-flight executions", s.executions.Load())
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warnf("Timed out draining host agent, aborting %d executions", s.executions.Load())
+		s.grpcServer.Stop()
+	}
+}
+
+// broadcast forwards the VM events of the manager to all watch streams
+func (s *Server) broadcast() {
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case event := <-s.manager.Events():
+			s.mutex.Lock()
+			for ch := range s.subscribers {
+				select {
+				case ch <- event:
+				default:
+					log.Warnf("Dropping event of VM %s for slow watcher", event.VMID)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// subscribe registers a watch stream for VM events
+func (s *Server) subscribe() chan flintlock.VMEvent {
+	ch := make(chan flintlock.VMEvent, 64)
+	s.mutex.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mutex.Unlock()
+	return ch
+}
+
+// unsubscribe removes a watch stream
+func (s *Server) unsubscribe(ch chan flintlock.VMEvent) {
+	s.mutex.Lock()
+	delete(s.subscribers, ch)
+	s.mutex.Unlock()
+}
+
+// handshake checks the version of a client and identifies the agent
+func (s *Server) handshake(ctx context.Context, req *HandshakeRequest) (*HandshakeResponse, error) {
+	if !compatible(req.Version) {
+		return nil, status.Errorf(codes.FailedPrecondition, "client version %q is incompatible with agent version %s", req.Version, Version)
+	}
+	return &HandshakeResponse{Version: Version, Node: s.node}, nil
+}
+
+// createVM creates and boots a VM
+func (s *Server) createVM(ctx context.Context, req *CreateVMRequest) (*VMResponse, error) {
+	vmID, err := s.manager.CreateVM(ctx, req.Config)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	info, err := s.manager.GetVM(vmID)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	log.Infof("Created VM %s", vmID)
+	return &VMResponse{VM: info}, nil
+}
+
+// deleteVM stops a VM and removes its data
+func (s *Server) deleteVM(ctx context.Context, req *VMRequest) (*Empty, error) {
+	if err := s.manager.DeleteVM(ctx, req.VMID); err != nil {
+		return nil, toStatus(err)
+	}
+	log.Infof("Deleted VM %s", req.VMID)
+	return &Empty{}, nil
+}
+
+// getVM describes a VM
+func (s *Server) getVM(ctx context.Context, req *VMRequest) (*VMResponse, error) {
+	info, err := s.manager.GetVM(req.VMID)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &VMResponse{VM: info}, nil
+}
+
+// listVMs describes all VMs
+func (s *Server) listVMs(ctx context.Context, req *ListVMsRequest) (*ListVMsResponse, error) {
+	return &ListVMsResponse{VMs: s.manager.ListVMs()}, nil
+}
+
+// execute executes code in a VM
+func (s *Server) execute(ctx context.Context, req *ExecuteRequest) (*ExecuteResponse, error) {
+	if req.Request == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing execution request")
+	}
+
+	s.executions.Add(1)
+	defer s.executions.Add(-1)
+
+	resp, err := s.manager.ExecuteCode(ctx, req.VMID, req.Request)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &ExecuteResponse{Response: resp}, nil
+}
+
+// snapshot takes a snapshot of a VM
+func (s *Server) snapshot(ctx context.Context, req *SnapshotRequest) (*SnapshotResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing snapshot name")
+	}
+
+	info, err := s.manager.SnapshotVM(ctx, req.VMID, req.Name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	log.Infof("Created snapshot %s of VM %s", req.Name, req.VMID)
+	return &SnapshotResponse{Snapshot: info}, nil
+}
+
+// pauseVM pauses a VM
+func (s *Server) pauseVM(ctx context.Context, req *VMRequest) (*Empty, error) {
+	if err := s.manager.PauseVM(ctx, req.VMID); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// resumeVM resumes a paused VM
+func (s *Server) resumeVM(ctx context.Context, req *VMRequest) (*Empty, error) {
+	if err := s.manager.ResumeVM(ctx, req.VMID); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// resizeBalloon resizes the memory balloon of a VM
+func (s *Server) resizeBalloon(ctx context.Context, req *BalloonRequest) (*Empty, error) {
+	if req.AmountMB < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid balloon size %d", req.AmountMB)
+	}
+
+	if err := s.manager.ResizeBalloon(ctx, req.VMID, req.AmountMB); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// deleteVolume removes a volume file that is no longer used by any VM
+func (s *Server) deleteVolume(ctx context.Context, req *VolumeRequest) (*Empty, error) {
+	if err := s.manager.DeleteVolume(req.Namespace, req.Path); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.Infof("Deleted volume %s", req.Path)
+	return &Empty{}, nil
+}
+
+// watch streams the current state of all VMs followed by their state changes
+func (s *Server) watch(req *WatchRequest, stream grpc.ServerStream) error {
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+
+	for _, info := range s.manager.ListVMs() {
+		state, message := vmState(info)
+		event := &flintlock.VMEvent{VMID: info.ID, State: state, Error: message}
+		if err := stream.SendMsg(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.stopCh:
+			return status.Error(codes.Unavailable, "agent is shutting down")
+		case event := <-ch:
+			if err := stream.SendMsg(&event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// toStatus converts a manager error to a gRPC status
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, flintlock.ErrVMNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, flintlock.ErrNoIdentity):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// checkVersion rejects calls from clients with an incompatible version
+func checkVersion(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	versions := md.Get(versionHeader)
+	if len(versions) == 0 {
+		return status.Error(codes.FailedPrecondition, "missing client version")
+	}
+	if !compatible(versions[0]) {
+		return status.Errorf(codes.FailedPrecondition, "client version %q is incompatible with agent version %s", versions[0], Version)
+	}
+	return nil
+}
+
+// unaryVersionCheck checks the client version of unary calls
+func unaryVersionCheck(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkVersion(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamVersionCheck checks the client version of streaming calls
+func streamVersionCheck(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkVersion(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// unary describes a unary method of the agent
+func unary[Req any, Resp any](method string, call func(*Server, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(*Server), ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(*Server), ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+// serviceDesc describes the host agent service
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Handshake", (*Server).handshake),
+		unary("CreateVM", (*Server).createVM),
+		unary("DeleteVM", (*Server).deleteVM),
+		unary("GetVM", (*Server).getVM),
+		unary("ListVMs", (*Server).listVMs),
+		unary("Execute", (*Server).execute),
+		unary("Snapshot", (*Server).snapshot),
+		unary("ResizeBalloon", (*Server).resizeBalloon),
+		unary("PauseVM", (*Server).pauseVM),
+		unary("ResumeVM", (*Server).resumeVM),
+		unary("DeleteVolume", (*Server).deleteVolume),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(WatchRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(*Server).watch(req, stream)
+			},
+		},
+	},
+}
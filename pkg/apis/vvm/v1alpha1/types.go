@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -16,6 +17,10 @@ type MicroVM struct {
 	Status MicroVMStatus `json:"status,omitempty"`
 }
 
+// IdleMemoryTargetAnnotation holds the memory target a MicroVM had before the
+// controller shrank it for its idle session, empty if it had none
+const IdleMemoryTargetAnnotation = "vvm.tvm.github.com/idle-memory-target"
+
 // MicroVMSpec is the spec for a MicroVM resource
 type MicroVMSpec struct {
 	// Image is the container image for the VM
@@ -36,8 +41,184 @@ type MicroVMSpec struct {
 	// MCPMode enables MCP mode for the VM
 	MCPMode bool `json:"mcpMode,omitempty"`
 
-	// PersistentStorage enables persistent storage for the VM
+	// PersistentStorage enables persistent storage for the VM.
+	// Deprecated: this field has no effect, use Volumes instead.
 	PersistentStorage bool `json:"persistentStorage,omitempty"`
+
+	// Volumes are additional block devices attached to the VM
+	Volumes []Volume `json:"volumes,omitempty"`
+
+	// Kernel is the kernel the VM boots, the node default if not set
+	Kernel *KernelSpec `json:"kernel,omitempty"`
+
+	// RestartPolicy decides when the VM is recreated, OnFailure if not set
+	RestartPolicy RestartPolicy `json:"restartPolicy,omitempty"`
+
+	// MaxRestarts is the number of restarts before the VM is Failed, 5 if not set
+	MaxRestarts *int32 `json:"maxRestarts,omitempty"`
+
+	// NodeSelector restricts the nodes the VM can be placed on by label
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Affinity constrains and ranks the nodes the VM can be placed on
+	Affinity *Affinity `json:"affinity,omitempty"`
+
+	// RateLimits limits the disk I/O of the VM, capped by lime-ctrl
+	RateLimits *RateLimits `json:"rateLimits,omitempty"`
+
+	// Balloon attaches a memory balloon device, so memory can be given back
+	// to the node while the VM runs
+	Balloon *BalloonSpec `json:"balloon,omitempty"`
+
+	// MemoryTarget is the memory in MB the guest keeps, the balloon reclaims
+	// the rest of Memory. Changes are applied to the running VM. Requires Balloon.
+	MemoryTarget *int32 `json:"memoryTarget,omitempty"`
+
+	// Paused pauses the running VM, and unsetting it resumes the VM
+	Paused bool `json:"paused,omitempty"`
+}
+
+// BalloonSpec configures the memory balloon of a MicroVM
+type BalloonSpec struct {
+	// DeflateOnOOM gives memory back to the guest when it runs out of memory
+	DeflateOnOOM bool `json:"deflateOnOOM,omitempty"`
+
+	// StatsIntervalSeconds is how often the guest reports its memory, 5 if not set
+	StatsIntervalSeconds *int32 `json:"statsIntervalSeconds,omitempty"`
+}
+
+// RateLimits limits the I/O of a MicroVM
+type RateLimits struct {
+	// Disk limits every drive of the VM, including its root drive
+	Disk *RateLimit `json:"disk,omitempty"`
+
+	// Network is not supported yet and rejected. VMs have no network
+	// interfaces, only vsock, so only disk limits are applied.
+	Network *RateLimit `json:"network,omitempty"`
+}
+
+// RateLimit is a token bucket limit of bandwidth and operations per second.
+// Zero fields are unlimited.
+type RateLimit struct {
+	// BandwidthBytesPerSec is the sustained bandwidth in bytes per second
+	BandwidthBytesPerSec int64 `json:"bandwidthBytesPerSec,omitempty"`
+
+	// BandwidthBurstBytes may be transferred once on top of the sustained bandwidth
+	BandwidthBurstBytes int64 `json:"bandwidthBurstBytes,omitempty"`
+
+	// OpsPerSec is the sustained number of operations per second
+	OpsPerSec int64 `json:"opsPerSec,omitempty"`
+
+	// OpsBurst operations may be done once on top of the sustained rate
+	OpsBurst int64 `json:"opsBurst,omitempty"`
+}
+
+// Affinity holds the scheduling constraints of a MicroVM
+type Affinity struct {
+	// NodeAffinity is applied like the node affinity of a pod
+	NodeAffinity *corev1.NodeAffinity `json:"nodeAffinity,omitempty"`
+}
+
+// RestartPolicy decides when a MicroVM is recreated
+type RestartPolicy string
+
+const (
+	// RestartPolicyNever never recreates the VM
+	RestartPolicyNever RestartPolicy = "Never"
+
+	// RestartPolicyOnFailure recreates the VM when it hits an error
+	RestartPolicyOnFailure RestartPolicy = "OnFailure"
+
+	// RestartPolicyAlways also recreates the VM when it shuts down on its own
+	RestartPolicyAlways RestartPolicy = "Always"
+)
+
+// KernelSpec selects the kernel and boot configuration of a MicroVM.
+// Exactly one of Name and Image must be set.
+type KernelSpec struct {
+	// Name is a kernel from the kernel catalog of the node
+	Name string `json:"name,omitempty"`
+
+	// Image is a container image holding the kernel, only supported by Flintlock
+	Image string `json:"image,omitempty"`
+
+	// Filename is the path of the kernel inside Image
+	Filename string `json:"filename,omitempty"`
+
+	// Args are appended to the kernel command line, as key=value or flags
+	Args []string `json:"args,omitempty"`
+
+	// Initrd is an optional initial ramdisk
+	Initrd *InitrdSpec `json:"initrd,omitempty"`
+}
+
+// InitrdSpec selects the initial ramdisk of a MicroVM.
+// Exactly one of Name and Image must be set.
+type InitrdSpec struct {
+	// Name is a kernel catalog entry whose initrd is used
+	Name string `json:"name,omitempty"`
+
+	// Image is a container image holding the initrd, only supported by Flintlock
+	Image string `json:"image,omitempty"`
+
+	// Filename is the path of the initrd inside Image
+	Filename string `json:"filename,omitempty"`
+}
+
+// Volume is a block device attached to a MicroVM in addition to its root filesystem
+type Volume struct {
+	// Name is the name of the volume, unique within the VM
+	Name string `json:"name"`
+
+	// SizeMB is the size of the volume in MB
+	SizeMB int32 `json:"sizeMB"`
+
+	// MountPath is the path the volume is mounted at inside the VM
+	MountPath string `json:"mountPath"`
+
+	// ReadOnly attaches the volume read-only
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Source is where the data of the volume is stored
+	Source VolumeSource `json:"source,omitempty"`
+}
+
+// VolumeSource is the backing store of a Volume. At most one field may be set;
+// a volume without a source is ephemeral.
+type VolumeSource struct {
+	// Ephemeral volumes are created with the VM and deleted with it
+	Ephemeral *EphemeralVolumeSource `json:"ephemeral,omitempty"`
+
+	// HostPath volumes are backed by an image file in the volume directory of
+	// the namespace on the node
+	HostPath *HostPathVolumeSource `json:"hostPath,omitempty"`
+
+	// Workspace is the durable workspace of the MCPSession owning the VM, set
+	// by lime-ctrl on the VMs of sessions
+	Workspace *WorkspaceVolumeSource `json:"workspace,omitempty"`
+
+	// PersistentVolumeClaim volumes would be backed by an image file on a PVC.
+	// They are not supported yet and rejected.
+	PersistentVolumeClaim *PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+}
+
+// EphemeralVolumeSource is a volume that lives as long as the VM
+type EphemeralVolumeSource struct{}
+
+// HostPathVolumeSource is a volume backed by an image file in the volume directory of the node
+type HostPathVolumeSource struct {
+	// Path is the path of the image file, relative to the volume directory of
+	// the namespace on the node
+	Path string `json:"path"`
+}
+
+// WorkspaceVolumeSource is the workspace file of the MCPSession owning a VM
+type WorkspaceVolumeSource struct{}
+
+// PersistentVolumeClaimVolumeSource is a volume backed by an image file on a PVC
+type PersistentVolumeClaimVolumeSource struct {
+	// ClaimName is the name of the PVC in the namespace of the MicroVM
+	ClaimName string `json:"claimName"`
 }
 
 // MicroVMState represents the state of a MicroVM
@@ -50,9 +231,18 @@ const (
 	// MicroVMStateRunning means the VM is running
 	MicroVMStateRunning MicroVMState = "Running"
 
+	// MicroVMStatePaused means the vCPUs of the VM are paused, its memory is kept
+	MicroVMStatePaused MicroVMState = "Paused"
+
 	// MicroVMStateError means the VM is in an error state
 	MicroVMStateError MicroVMState = "Error"
 
+	// MicroVMStateStopped means the VM shut down on its own
+	MicroVMStateStopped MicroVMState = "Stopped"
+
+	// MicroVMStateFailed means the VM failed and will not be restarted
+	MicroVMStateFailed MicroVMState = "Failed"
+
 	// MicroVMStateDeleted means the VM has been deleted
 	MicroVMStateDeleted MicroVMState = "Deleted"
 )
@@ -76,6 +266,64 @@ type MicroVMStatus struct {
 
 	// Error message if the VM is in an error state
 	Error string `json:"error,omitempty"`
+
+	// Restarts is the number of times the VM was recreated
+	Restarts int32 `json:"restarts,omitempty"`
+
+	// LastRestartTime is when the VM was last recreated
+	LastRestartTime *metav1.Time `json:"lastRestartTime,omitempty"`
+
+	// NextRetryTime is when the VM is recreated after backing off
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// Volumes is the status of the volumes attached to the VM
+	Volumes []VolumeStatus `json:"volumes,omitempty"`
+
+	// RootfsDeltaMB is the disk space used by the copy-on-write rootfs of the VM
+	// on top of its shared base image. It is only reported by the host agent,
+	// Flintlock doesn't expose the disk usage of its VMs.
+	RootfsDeltaMB int32 `json:"rootfsDeltaMB,omitempty"`
+
+	// RateLimits are the I/O limits applied to the VM, after defaults and ceilings
+	RateLimits *RateLimits `json:"rateLimits,omitempty"`
+
+	// Balloon is the state of the memory balloon and the guest memory
+	Balloon *BalloonStatus `json:"balloon,omitempty"`
+}
+
+// BalloonStatus is the state of the memory balloon of a MicroVM
+type BalloonStatus struct {
+	// TargetMB is the size in MB the balloon is resized to
+	TargetMB int64 `json:"targetMB"`
+
+	// ActualMB is the current size of the balloon in MB
+	ActualMB int64 `json:"actualMB"`
+
+	// TotalMemoryMB is the memory of the guest in MB
+	TotalMemoryMB int64 `json:"totalMemoryMB,omitempty"`
+
+	// FreeMemoryMB is the unused memory of the guest in MB
+	FreeMemoryMB int64 `json:"freeMemoryMB,omitempty"`
+
+	// AvailableMemoryMB is the memory available to new processes in the guest in MB
+	AvailableMemoryMB int64 `json:"availableMemoryMB,omitempty"`
+
+	// MajorFaults and MinorFaults are the page faults of the guest
+	MajorFaults int64 `json:"majorFaults,omitempty"`
+	MinorFaults int64 `json:"minorFaults,omitempty"`
+}
+
+// VolumeStatus is the status of a volume attached to a MicroVM
+type VolumeStatus struct {
+	// Name is the name of the volume
+	Name string `json:"name"`
+
+	// Path is the path of the backing file, relative to the volume directory
+	// of the node, empty for ephemeral volumes
+	Path string `json:"path,omitempty"`
+
+	// SizeMB is the size of the backing file in MB
+	SizeMB int32 `json:"sizeMB,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -113,6 +361,18 @@ type MCPSessionSpec struct {
 
 	// SessionType is the type of session
 	SessionType string `json:"sessionType,omitempty"`
+
+	// Workspace requests a durable workspace volume that survives VM recreation
+	Workspace *WorkspaceSpec `json:"workspace,omitempty"`
+}
+
+// WorkspaceSpec describes the durable workspace of an MCPSession
+type WorkspaceSpec struct {
+	// SizeMB is the size of the workspace in MB
+	SizeMB int32 `json:"sizeMB"`
+
+	// MountPath is the path the workspace is mounted at inside the VM
+	MountPath string `json:"mountPath,omitempty"`
 }
 
 // MCPSessionState represents the state of an MCPSession
@@ -143,6 +403,10 @@ type MCPSessionStatus struct {
 	// LastActivity is the timestamp of last activity
 	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
 
+	// WorkspaceNode is the node holding the workspace, where the VMs of the
+	// session are placed
+	WorkspaceNode string `json:"workspaceNode,omitempty"`
+
 	// Error message if the session is in an error state
 	Error string `json:"error,omitempty"`
 }
@@ -0,0 +1,133 @@
+// Package audit records who ran which code in which VM as an append-only
+// stream of JSON events
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions recorded in the audit log
+const (
+	// ActionExecute is a code execution in a VM
+	ActionExecute = "execute"
+	// ActionSessionCreate is the creation of an MCP session
+	ActionSessionCreate = "session.create"
+	// ActionSessionRead is a read of an MCP session
+	ActionSessionRead = "session.read"
+	// ActionSessionDelete is the deletion of an MCP session
+	ActionSessionDelete = "session.delete"
+)
+
+// Event is one entry of the audit log
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Source is the component that recorded the event
+	Source    string `json:"source,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+	VMID      string `json:"vmId,omitempty"`
+	// CodeSHA256 and CodeBytes identify the submitted code without storing it
+	CodeSHA256 string `json:"codeSha256,omitempty"`
+	CodeBytes  int    `json:"codeBytes,omitempty"`
+	// ExitCode is only set for executions that completed
+	ExitCode    *int   `json:"exitCode,omitempty"`
+	DurationMS  int64  `json:"durationMs,omitempty"`
+	OutputBytes int    `json:"outputBytes,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Sink receives audit events
+type Sink interface {
+	Write(event *Event) error
+	Close() error
+}
+
+// Options configures the sinks of a Logger
+type Options struct {
+	// Path is the file events are appended to as JSON lines, empty to disable
+	Path string
+	// MaxSizeMB is the size at which the file is rotated
+	MaxSizeMB int
+	// Retention is how long rotated files are kept, 0 keeps them forever
+	Retention time.Duration
+	// WebhookURL receives every event as a JSON POST, empty to disable
+	WebhookURL string
+}
+
+// Logger writes audit events to its sinks. A nil Logger discards events.
+type Logger struct {
+	source string
+	sinks  []Sink
+}
+
+// NewLogger creates a Logger for the events of source with the sinks of opts
+func NewLogger(source string, opts Options) (*Logger, error) {
+	l := &Logger{source: source}
+	if opts.Path != "" {
+		sink, err := NewFileSink(opts.Path, opts.MaxSizeMB, opts.Retention)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, sink)
+	}
+	if opts.WebhookURL != "" {
+		l.sinks = append(l.sinks, NewWebhookSink(opts.WebhookURL))
+	}
+	if len(l.sinks) == 0 {
+		log.Warn("No audit sink configured, executions are not audited")
+	}
+	return l, nil
+}
+
+// Record writes an event to every sink. Failures are logged, they never fail
+// the audited action.
+func (l *Logger) Record(event Event) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	event.Source = l.source
+	for _, sink := range l.sinks {
+		if err := sink.Write(&event); err != nil {
+			log.Errorf("Failed to write audit event %s for VM %s: %v", event.Action, event.VMID, err)
+		}
+	}
+}
+
+// Close flushes and closes the sinks
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	var firstErr error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// HashCode returns the SHA-256 and size of a command and its arguments, which
+// hold the submitted code
+func HashCode(command string, args []string) (string, int) {
+	h := sha256.New()
+	size := len(command)
+	h.Write([]byte(command))
+	for _, arg := range args {
+		// Separate the parts so moving bytes between them changes the hash
+		h.Write([]byte{0})
+		h.Write([]byte(arg))
+		size += len(arg)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size
+}
@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxSizeMB is the size at which audit files are rotated by default
+	DefaultMaxSizeMB = 100
+
+	// rotatedTimeFormat stamps the name of rotated files, it sorts by time
+	rotatedTimeFormat = "20060102T150405.000"
+)
+
+// FileSink appends events as JSON lines to a file. The file is rotated when
+// it reaches its maximum size and rotated files older than the retention are
+// removed.
+type FileSink struct {
+	path      string
+	maxSize   int64
+	retention time.Duration
+	file      *os.File
+	size      int64
+	mutex     sync.Mutex
+}
+
+// NewFileSink opens path for appending, creating it and its directory if needed
+func NewFileSink(path string, maxSizeMB int, retention time.Duration) (*FileSink, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = DefaultMaxSizeMB
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit directory: %v", err)
+	}
+
+	s := &FileSink{
+		path:      path,
+		maxSize:   int64(maxSizeMB) << 20,
+		retention: retention,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.removeExpired()
+	return s, nil
+}
+
+// open opens the current file for appending
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %v", err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write implements Sink. The line is synced to disk before Write returns.
+func (s *FileSink) Write(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %v", err)
+	}
+	data = append(data, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("audit log %s is closed", s.path)
+	}
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return s.file.Sync()
+}
+
+// rotate renames the current file to a timestamped name and starts a new one
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		log.Warnf("Failed to close audit log %s: %v", s.path, err)
+	}
+	s.file = nil
+
+	ext := filepath.Ext(s.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(s.path, ext), time.Now().UTC().Format(rotatedTimeFormat), ext)
+	if err := os.Rename(s.path, rotated); err != nil {
+		// Keep appending to the current file rather than losing events
+		log.Errorf("Failed to rotate audit log %s: %v", s.path, err)
+	} else {
+		log.Infof("Rotated audit log to %s", rotated)
+	}
+
+	if err := s.open(); err != nil {
+		return err
+	}
+	go s.removeExpired()
+	return nil
+}
+
+// removeExpired removes the rotated files older than the retention
+func (s *FileSink) removeExpired() {
+	if s.retention <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(s.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(s.path, ext) + "-*" + ext)
+	if err != nil {
+		log.Errorf("Failed to list rotated audit logs: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-s.retention)
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Errorf("Failed to remove expired audit log %s: %v", path, err)
+			continue
+		}
+		log.Infof("Removed expired audit log %s", path)
+	}
+}
+
+// Close implements Sink
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
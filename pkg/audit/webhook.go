@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookQueueSize is the number of events buffered while the webhook is slow
+	webhookQueueSize = 1024
+	// webhookTimeout bounds each POST to the webhook
+	webhookTimeout = 10 * time.Second
+	// webhookAttempts is the number of times an event is posted before it is dropped
+	webhookAttempts = 3
+	// webhookCloseTimeout bounds how long Close waits for the queue to drain
+	webhookCloseTimeout = 10 * time.Second
+)
+
+// WebhookSink posts every event as JSON to a URL. Events are sent in the
+// background so a slow webhook never delays executions; when its queue is
+// full events are dropped, the file sink remains the record of truth.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	closed bool
+	mutex  sync.Mutex
+}
+
+// NewWebhookSink creates a sink posting to url
+func NewWebhookSink(url string) *WebhookSink {
+	s := &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan []byte, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write implements Sink
+func (s *WebhookSink) Write(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("audit webhook is closed")
+	}
+	select {
+	case s.queue <- data:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue is full, dropping event")
+	}
+}
+
+// run posts the queued events until the queue is closed
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	for data := range s.queue {
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = s.post(data); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Errorf("Failed to send audit event to webhook: %v", err)
+		}
+	}
+}
+
+// post sends one event
+func (s *WebhookSink) post(data []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close implements Sink, waiting for the queued events to be sent
+func (s *WebhookSink) Close() error {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(webhookCloseTimeout):
+		return fmt.Errorf("timed out sending %d queued audit events", len(s.queue))
+	}
+}
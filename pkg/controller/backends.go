@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/yourusername/tvm/pkg/agent"
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// backendPool discovers the host agent of every node and holds a client per
+// agent. Agents are the pods matching a label selector, one per node. VMs not
+// placed on a node use the Flintlock fallback endpoint.
+type backendPool struct {
+	client client.Client
+	// namespace and selector identify the agent pods
+	namespace string
+	selector  labels.Selector
+	// port is the gRPC port of the agents
+	port int
+	// tlsConfig secures the connections to the agents, nil for plaintext
+	tlsConfig *tls.Config
+	// fallback is the endpoint used for VMs not placed on a node
+	fallback string
+	// fallbackOpts configures the connection to the fallback
+	fallbackOpts flintlock.ClientOptions
+
+	clients map[string]flintlock.Backend
+	// cancels stops watching the clients, by endpoint
+	cancels map[string]context.CancelFunc
+	// events receives the state changes of the VMs of all agents
+	events chan flintlock.VMEvent
+	// ctx is set once the pool is started, clients created after start it are watched
+	ctx   context.Context
+	mutex sync.Mutex
+}
+
+// newBackendPool creates a pool of the agents matching selector in namespace
+func newBackendPool(c client.Client, namespace, selector string, port int, tlsConfig *tls.Config, fallback string, fallbackOpts flintlock.ClientOptions) (*backendPool, error) {
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent selector %q: %v", selector, err)
+	}
+
+	return &backendPool{
+		client:       c,
+		namespace:    namespace,
+		selector:     sel,
+		port:         port,
+		tlsConfig:    tlsConfig,
+		fallback:     fallback,
+		fallbackOpts: fallbackOpts,
+		clients:      make(map[string]flintlock.Backend),
+		cancels:      make(map[string]context.CancelFunc),
+		events:       make(chan flintlock.VMEvent, 64),
+	}, nil
+}
+
+// start watches the clients for VM events until ctx is done
+func (p *backendPool) start(ctx context.Context) {
+	p.mutex.Lock()
+	p.ctx = ctx
+	for endpoint, c := range p.clients {
+		p.startWatch(endpoint, c)
+	}
+	p.mutex.Unlock()
+
+	<-ctx.Done()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for endpoint, c := range p.clients {
+		if err := c.Close(); err != nil {
+			log.Error(err, "Failed to close backend client", "endpoint", endpoint)
+		}
+	}
+}
+
+// startWatch watches a client until the pool stops or the client is removed.
+// The caller must hold the mutex.
+func (p *backendPool) startWatch(endpoint string, c flintlock.Backend) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.cancels[endpoint] = cancel
+	go p.watch(ctx, endpoint, c)
+}
+
+// watch forwards the VM events of one client into the pool
+func (p *backendPool) watch(ctx context.Context, endpoint string, c flintlock.Backend) {
+	log.Info("Watching backend for VM events", "endpoint", endpoint)
+	for event := range c.WatchMicroVMs(ctx, flintlock.DefaultWatchInterval) {
+		select {
+		case p.events <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// agents returns the ready agent pods by node name
+func (p *backendPool) agents(ctx context.Context) (map[string]*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	err := p.client.List(ctx, pods, client.InNamespace(p.namespace), client.MatchingLabelsSelector{Selector: p.selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host agents: %v", err)
+	}
+
+	agents := make(map[string]*corev1.Pod)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" || pod.Status.PodIP == "" || !pod.DeletionTimestamp.IsZero() || !podReady(pod) {
+			continue
+		}
+		agents[pod.Spec.NodeName] = pod
+	}
+	p.prune(agents)
+	return agents, nil
+}
+
+// prune closes and removes the clients of agents that are no longer listed,
+// such as agents whose pod was replaced with a new IP
+func (p *backendPool) prune(agents map[string]*corev1.Pod) {
+	listed := make(map[string]bool, len(agents))
+	for _, pod := range agents {
+		listed[net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p.port))] = true
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for endpoint, c := range p.clients {
+		if endpoint == p.fallback || listed[endpoint] {
+			continue
+		}
+		log.Info("Removing client of host agent that is gone", "endpoint", endpoint)
+		if cancel, ok := p.cancels[endpoint]; ok {
+			cancel()
+			delete(p.cancels, endpoint)
+		}
+		if err := c.Close(); err != nil {
+			log.Error(err, "Failed to close backend client", "endpoint", endpoint)
+		}
+		delete(p.clients, endpoint)
+	}
+}
+
+// forMicroVM returns the client of the backend running a MicroVM
+func (p *backendPool) forMicroVM(ctx context.Context, instance *v1alpha1.MicroVM) (flintlock.Backend, error) {
+	if instance.Status.Node == "" {
+		if p.fallback == "" {
+			return nil, fmt.Errorf("MicroVM is not placed on a node")
+		}
+		return p.get(p.fallback, false)
+	}
+
+	agents, err := p.agents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pod, ok := agents[instance.Status.Node]
+	if !ok {
+		return nil, fmt.Errorf("%w: no ready host agent on node %s", flintlock.ErrUnavailable, instance.Status.Node)
+	}
+	return p.get(net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p.port)), true)
+}
+
+// get returns the client of a host agent or Flintlock endpoint, connecting on first use
+func (p *backendPool) get(endpoint string, isAgent bool) (flintlock.Backend, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if c, ok := p.clients[endpoint]; ok {
+		return c, nil
+	}
+
+	var c flintlock.Backend
+	var err error
+	if isAgent {
+		c, err = agent.NewClient(endpoint, p.tlsConfig)
+	} else {
+		c, err = flintlock.NewClient(endpoint, p.fallbackOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.clients[endpoint] = c
+	if p.ctx != nil {
+		p.startWatch(endpoint, c)
+	}
+	return c, nil
+}
+
+// podReady reports whether a pod has the Ready condition
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
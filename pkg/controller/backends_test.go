@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/yourusername/tvm/pkg/flintlock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// closeRecorder is a backend that records whether it was closed
+type closeRecorder struct {
+	flintlock.Backend
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestAgents(t *testing.T) {
+	now := metav1.Now()
+	tests := []struct {
+		name string
+		pod  func(*corev1.Pod)
+		want bool
+	}{
+		{name: "ready", want: true},
+		{name: "not scheduled", pod: func(p *corev1.Pod) { p.Spec.NodeName = "" }},
+		{name: "no IP", pod: func(p *corev1.Pod) { p.Status.PodIP = "" }},
+		{name: "not ready", pod: func(p *corev1.Pod) { p.Status.Conditions[0].Status = corev1.ConditionFalse }},
+		{name: "being deleted", pod: func(p *corev1.Pod) {
+			p.DeletionTimestamp = &now
+			p.Finalizers = []string{"test"}
+		}},
+		{name: "other namespace", pod: func(p *corev1.Pod) { p.Namespace = "default" }},
+		{name: "other labels", pod: func(p *corev1.Pod) { p.Labels = map[string]string{"app": "other"} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := agentPod("agent-1", "node-1", "10.0.0.1")
+			if tt.pod != nil {
+				tt.pod(pod)
+			}
+			p, err := newBackendPool(newFakeClient(t, pod), "tvm", "app=flintlock", 9090, nil, "", flintlock.ClientOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			agents, err := p.agents(context.Background())
+			if err != nil {
+				t.Fatalf("agents() error = %v", err)
+			}
+			if _, got := agents["node-1"]; got != tt.want {
+				t.Errorf("agents() lists the pod = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentsPrunesClients(t *testing.T) {
+	objs := []client.Object{agentPod("agent-1", "node-1", "10.0.0.1")}
+	p, err := newBackendPool(newFakeClient(t, objs...), "tvm", "app=flintlock", 9090, nil, "flintlock:9090", flintlock.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]*closeRecorder{
+		"10.0.0.1:9090":  {},
+		"10.0.0.2:9090":  {},
+		"flintlock:9090": {},
+	}
+	for endpoint, c := range clients {
+		p.clients[endpoint] = c
+	}
+	canceled := false
+	p.cancels["10.0.0.2:9090"] = func() { canceled = true }
+
+	if _, err := p.agents(context.Background()); err != nil {
+		t.Fatalf("agents() error = %v", err)
+	}
+
+	var kept []string
+	for endpoint := range p.clients {
+		kept = append(kept, endpoint)
+	}
+	sort.Strings(kept)
+	if len(kept) != 2 || kept[0] != "10.0.0.1:9090" || kept[1] != "flintlock:9090" {
+		t.Errorf("agents() kept clients %v, want the listed agent and the fallback", kept)
+	}
+	if !clients["10.0.0.2:9090"].closed || !canceled {
+		t.Errorf("agents() didn't close the client of the agent that is gone")
+	}
+	if clients["10.0.0.1:9090"].closed || clients["flintlock:9090"].closed {
+		t.Errorf("agents() closed a client that is still in use")
+	}
+}
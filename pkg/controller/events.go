@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded on MicroVMs
+const (
+	reasonScheduled            = "Scheduled"
+	reasonFailedScheduling     = "FailedScheduling"
+	reasonInvalidKernel        = "InvalidKernel"
+	reasonInvalidRateLimits    = "InvalidRateLimits"
+	reasonInvalidBalloon       = "InvalidBalloon"
+	reasonFailedVolume         = "FailedVolume"
+	reasonCreated              = "Created"
+	reasonFailedCreate         = "FailedCreate"
+	reasonInsufficientCapacity = "InsufficientCapacity"
+	reasonBackendUnavailable   = "BackendUnavailable"
+	reasonFailedStatus         = "FailedStatus"
+	reasonStarted              = "Started"
+	reasonStopped              = "Stopped"
+	reasonVMError              = "VMError"
+	reasonBackOff              = "BackOff"
+	reasonRestarting           = "Restarting"
+	reasonFailed               = "Failed"
+	reasonDeleted              = "Deleted"
+	reasonFailedDelete         = "FailedDelete"
+	reasonUnknownState         = "UnknownState"
+	reasonResizedBalloon       = "ResizedBalloon"
+	reasonFailedResizeBalloon  = "FailedResizeBalloon"
+	reasonPaused               = "Paused"
+	reasonResumed              = "Resumed"
+	reasonFailedPause          = "FailedPause"
+	reasonFailedResume         = "FailedResume"
+)
+
+// Reasons of the events recorded on MCPSessions
+const (
+	reasonCreatedVM      = "CreatedVM"
+	reasonFailedCreateVM = "FailedCreateVM"
+	reasonQuotaExceeded  = "QuotaExceeded"
+	reasonReady          = "Ready"
+	reasonVMLost         = "VMLost"
+	reasonVMNotRunning   = "VMNotRunning"
+	reasonVMFailed       = "VMFailed"
+	reasonIdleTimeout    = "IdleTimeout"
+	reasonIdleShrink     = "IdleShrink"
+	reasonIdlePause      = "IdlePause"
+	reasonRecovering     = "Recovering"
+)
+
+// recordTransition records the state a MicroVM moved to from the backend
+func recordTransition(recorder record.EventRecorder, instance *v1alpha1.MicroVM, from v1alpha1.MicroVMState) {
+	if instance.Status.State == from {
+		return
+	}
+
+	switch instance.Status.State {
+	case v1alpha1.MicroVMStateRunning:
+		recorder.Eventf(instance, corev1.EventTypeNormal, reasonStarted, "VM %s is running on node %s", instance.Status.VMID, instance.Status.Node)
+	case v1alpha1.MicroVMStateStopped:
+		recorder.Eventf(instance, corev1.EventTypeNormal, reasonStopped, "VM %s stopped", instance.Status.VMID)
+	case v1alpha1.MicroVMStateError:
+		recorder.Eventf(instance, corev1.EventTypeWarning, reasonVMError, "VM %s failed: %s", instance.Status.VMID, instance.Status.Error)
+	}
+}
+
+// createFailedReason returns the reason of a failure to create an object,
+// telling rejections by a ResourceQuota apart
+func createFailedReason(err error, reason string) string {
+	if apierrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota") {
+		return reasonQuotaExceeded
+	}
+	return reason
+}
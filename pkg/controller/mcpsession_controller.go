@@ -3,9 +3,13 @@ package controller
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"github.com/yourusername/tvm/pkg/mcp"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -13,6 +17,7 @@ import (
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -22,17 +27,38 @@ import (
 
 var mcpLog = logf.Log.WithName("controller_mcpsession")
 
-// AddMCPSession creates a new MCPSession Controller and adds it to the Manager
-func AddMCPSession(mgr manager.Manager) error {
-	return addMCPSession(mgr, newMCPSessionReconciler(mgr))
+const (
+	// sessionTimeout is how long a session may be idle before it is deleted
+	sessionTimeout = 30 * time.Minute
+	// idlePauseAfter is how long a session may be idle before its VM is paused
+	idlePauseAfter = 5 * time.Minute
+	// idleCheckInterval is how often running sessions are checked for idleness
+	idleCheckInterval = time.Minute
+	// idleMemoryTargetMB is the memory the VM of an idle session keeps, the
+	// balloon takes the rest back before the VM is paused
+	idleMemoryTargetMB = 128
+	// idleShrinkTimeout is how long the balloon may take to shrink an idle VM
+	// before it is paused anyway
+	idleShrinkTimeout = 2 * time.Minute
+
+	// mcpSessionFinalizer keeps a MCPSession until it was unregistered and its MicroVM deleted
+	mcpSessionFinalizer = "vvm.tvm.github.com/mcpsession"
+)
+
+// AddMCPSession creates a new MCPSession Controller and adds it to the Manager.
+// Running sessions are registered with mcpServer, whose requests keep them
+// active. Without an MCP server sessions are never idle.
+func AddMCPSession(mgr manager.Manager, mcpServer *mcp.Server) error {
+	return addMCPSession(mgr, newMCPSessionReconciler(mgr, mcpServer))
 }
 
 // newMCPSessionReconciler returns a new reconcile.Reconciler
-func newMCPSessionReconciler(mgr manager.Manager) reconcile.Reconciler {
+func newMCPSessionReconciler(mgr manager.Manager, mcpServer *mcp.Server) reconcile.Reconciler {
 	return &ReconcileMCPSession{
 		client:   mgr.GetClient(),
 		scheme:   mgr.GetScheme(),
 		recorder: mgr.GetEventRecorderFor("mcpsession-controller"),
+		mcp:      mcpServer,
 	}
 }
 
@@ -65,6 +91,8 @@ type ReconcileMCPSession struct {
 	client   client.Client
 	scheme   *runtime.Scheme
 	recorder record.EventRecorder
+	// mcp serves the requests to the sessions, nil if there is no MCP server
+	mcp *mcp.Server
 }
 
 // Reconcile reads that state of the cluster for a MCPSession object and makes changes based on the state read
@@ -79,6 +107,7 @@ func (r *ReconcileMCPSession) Reconcile(ctx context.Context, request reconcile.R
 		if errors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
 			// Return and don't requeue
+			r.unregisterSession(request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
@@ -90,6 +119,13 @@ func (r *ReconcileMCPSession) Reconcile(ctx context.Context, request reconcile.R
 		return r.handleDelete(ctx, instance)
 	}
 
+	// Keep the MCPSession until it is cleaned up
+	if controllerutil.AddFinalizer(instance, mcpSessionFinalizer) {
+		if err := r.client.Update(ctx, instance); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	// Handle different states
 	switch instance.Status.State {
 	case "":
@@ -176,6 +212,15 @@ func (r *ReconcileMCPSession) handleCreating(ctx context.Context, instance *v1al
 		}
 	}
 
+	// A failed MicroVM is never restarted, so the session can't start
+	if vm.Status.State == v1alpha1.MicroVMStateFailed {
+		instance.Status.State = v1alpha1.MCPSessionStateError
+		instance.Status.Error = fmt.Sprintf("MicroVM %s failed: %s", vm.Name, vm.Status.Error)
+		err = r.client.Status().Update(ctx, instance)
+		r.recorder.Event(instance, corev1.EventTypeWarning, reasonVMFailed, instance.Status.Error)
+		return reconcile.Result{}, err
+	}
+
 	// Check if the MicroVM is running
 	if vm.Status.State != v1alpha1.MicroVMStateRunning {
 		// MicroVM not ready yet, requeue
@@ -189,11 +234,15 @@ func (r *ReconcileMCPSession) handleCreating(ctx context.Context, instance *v1al
 		Token: "session-token", // In a real implementation, generate a secure token
 	}
 	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
+	if instance.Spec.Workspace != nil && instance.Status.WorkspaceNode == "" {
+		instance.Status.WorkspaceNode = vm.Status.Node
+	}
 	err = r.client.Status().Update(ctx, instance)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonReady, "Session is ready on MicroVM %s", vm.Name)
 	return reconcile.Result{}, nil
 }
 
@@ -205,6 +254,7 @@ func (r *ReconcileMCPSession) handleRunning(ctx context.Context, instance *v1alp
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// MicroVM not found, create a new one
+			r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonVMLost, "MicroVM %s no longer exists, replacing it", instance.Spec.VMID)
 			vm, err = r.createMicroVMForSession(ctx, instance)
 			if err != nil {
 				instance.Status.State = v1alpha1.MCPSessionStateError
@@ -234,8 +284,8 @@ func (r *ReconcileMCPSession) handleRunning(ctx context.Context, instance *v1alp
 		}
 	}
 
-	// Check if the MicroVM is running
-	if vm.Status.State != v1alpha1.MicroVMStateRunning {
+	// Check if the MicroVM is running, the VMs of idle sessions are paused
+	if vm.Status.State != v1alpha1.MicroVMStateRunning && vm.Status.State != v1alpha1.MicroVMStatePaused {
 		// MicroVM not running, update session status
 		instance.Status.State = v1alpha1.MCPSessionStateError
 		instance.Status.Error = fmt.Sprintf("MicroVM %s is not running", vm.Name)
@@ -243,37 +293,172 @@ func (r *ReconcileMCPSession) handleRunning(ctx context.Context, instance *v1alp
 		if err != nil {
 			return reconcile.Result{}, err
 		}
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonVMNotRunning, "MicroVM %s is %s", vm.Name, vm.Status.State)
 		return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
 	}
 
 	// Check for session timeout
-	if instance.Status.LastActivity != nil {
-		timeout := 30 * time.Minute // Session timeout
-		if time.Since(instance.Status.LastActivity.Time) > timeout {
-			// Session timed out, delete it
-			err = r.client.Delete(ctx, instance)
+	lastActivity := r.sessionActivity(instance)
+	idle := time.Since(lastActivity)
+	if idle > sessionTimeout {
+		// Session timed out, delete it
+		r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonIdleTimeout, "Session idle for %s, deleting it", idle.Round(time.Second))
+		err = r.client.Delete(ctx, instance)
+		if err != nil {
+			r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedDelete, "Failed to delete idle session: %v", err)
+			return reconcile.Result{}, err
+		}
+		r.unregisterSession(sessionKey(instance))
+		return reconcile.Result{}, nil
+	}
+	if idle > idlePauseAfter && !vm.Spec.Paused {
+		// Shrink the VM of an idle session before pausing it, a paused guest
+		// can't give memory back. The MCP server resumes it on the next request.
+		_, shrunk := vm.Annotations[v1alpha1.IdleMemoryTargetAnnotation]
+		switch {
+		case !shrunk && canShrink(vm):
+			err = r.shrinkVM(ctx, vm)
 			if err != nil {
 				return reconcile.Result{}, err
 			}
-			return reconcile.Result{}, nil
+			r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonIdleShrink, "Session idle for %s, shrinking MicroVM %s to %d MB", idle.Round(time.Second), vm.Name, idleMemoryTargetMB)
+		case shrunk && !balloonApplied(vm) && idle < idlePauseAfter+idleShrinkTimeout:
+			// Wait for the balloon to take the memory back
+		default:
+			patch := client.MergeFrom(vm.DeepCopy())
+			vm.Spec.Paused = true
+			err = r.client.Patch(ctx, vm, patch)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonIdlePause, "Session idle for %s, pausing MicroVM %s", idle.Round(time.Second), vm.Name)
 		}
 	}
 
 	// Update last activity
-	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
+	instance.Status.LastActivity = &metav1.Time{Time: lastActivity}
 	err = r.client.Status().Update(ctx, instance)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	// Requeue periodically to check for timeout
-	return reconcile.Result{RequeueAfter: 5 * time.Minute}, nil
+	// Requeue periodically to check for idleness
+	return reconcile.Result{RequeueAfter: idleCheckInterval}, nil
+}
+
+// canShrink reports whether the running VM of a session has a balloon that can
+// take memory back down to idleMemoryTargetMB
+func canShrink(vm *v1alpha1.MicroVM) bool {
+	if vm.Spec.Balloon == nil || vm.Status.Balloon == nil || vm.Status.State != v1alpha1.MicroVMStateRunning {
+		return false
+	}
+	memory := vm.Spec.Memory
+	if memory == 0 {
+		memory = defaultMemoryMB
+	}
+	target := vm.Spec.MemoryTarget
+	return memory > idleMemoryTargetMB && (target == nil || *target > idleMemoryTargetMB)
+}
+
+// shrinkVM lowers the memory target of a VM to idleMemoryTargetMB, keeping the
+// previous target in an annotation for the MCP server to restore
+func (r *ReconcileMCPSession) shrinkVM(ctx context.Context, vm *v1alpha1.MicroVM) error {
+	patch := client.MergeFrom(vm.DeepCopy())
+	previous := ""
+	if vm.Spec.MemoryTarget != nil {
+		previous = strconv.Itoa(int(*vm.Spec.MemoryTarget))
+	}
+	if vm.Annotations == nil {
+		vm.Annotations = map[string]string{}
+	}
+	vm.Annotations[v1alpha1.IdleMemoryTargetAnnotation] = previous
+	target := int32(idleMemoryTargetMB)
+	vm.Spec.MemoryTarget = &target
+	return r.client.Patch(ctx, vm, patch)
+}
+
+// balloonApplied reports whether the balloon of a VM reached the size of its memory target
+func balloonApplied(vm *v1alpha1.MicroVM) bool {
+	if vm.Status.Balloon == nil {
+		return true
+	}
+	amount := int64(flintlock.BalloonAmount(vm))
+	return vm.Status.Balloon.TargetMB == amount && vm.Status.Balloon.ActualMB >= amount
+}
+
+// sessionActivity registers a running session with the MCP server and
+// returns the time of its last request. Without an MCP server it is now.
+func (r *ReconcileMCPSession) sessionActivity(instance *v1alpha1.MCPSession) time.Time {
+	if r.mcp == nil {
+		return time.Now()
+	}
+
+	// Register sessions the MCP server doesn't know, it forgets them when lime-ctrl restarts
+	if session, err := r.mcp.GetSession(sessionKey(instance)); err != nil || session.VMID != instance.Spec.VMID {
+		r.mcp.CreateSession(instance)
+	}
+	lastActivity, err := r.mcp.SessionActivity(sessionKey(instance))
+	if err != nil {
+		return time.Now()
+	}
+	return lastActivity
+}
+
+// unregisterSession removes a session from the MCP server
+func (r *ReconcileMCPSession) unregisterSession(key types.NamespacedName) {
+	if r.mcp == nil {
+		return
+	}
+	if _, err := r.mcp.GetSession(key); err == nil {
+		r.mcp.DeleteSession(key)
+	}
+}
+
+// sessionKey returns the key of a session in the MCP server
+func sessionKey(instance *v1alpha1.MCPSession) types.NamespacedName {
+	return types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
 }
 
 // handleError handles a MCPSession in error state
 func (r *ReconcileMCPSession) handleError(ctx context.Context, instance *v1alpha1.MCPSession) (reconcile.Result, error) {
 	// For now, just log the error
-	mcpLog.Error(fmt.Errorf(instance.Status.Error), "MCPSession in error state", "namespace", instance.Namespace, "name", instance.Name)
+	mcpLog.Error(fmt.Errorf("%s", instance.Status.Error), "MCPSession in error state", "namespace", instance.Namespace, "name", instance.Name)
+
+	// The replacement MicroVM gets the name of the old one, which has to be
+	// gone first. A failed one is deleted, one that is still restarting or
+	// running is waited for instead.
+	old := &v1alpha1.MicroVM{}
+	err := r.client.Get(ctx, types.NamespacedName{Name: sessionVMName(instance), Namespace: instance.Namespace}, old)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	if err == nil {
+		if !ownedBy(old, instance) {
+			// Another MicroVM has the name, nothing to recover with
+			return reconcile.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+		if old.DeletionTimestamp != nil {
+			return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		if old.Status.State != v1alpha1.MicroVMStateFailed {
+			r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonRecovering, "Recovering from %q with MicroVM %s", instance.Status.Error, old.Name)
+			instance.Spec.VMID = old.Name
+			if err := r.client.Update(ctx, instance); err != nil {
+				return reconcile.Result{}, err
+			}
+			instance.Status.State = v1alpha1.MCPSessionStateCreating
+			instance.Status.Error = ""
+			if err := r.client.Status().Update(ctx, instance); err != nil {
+				return reconcile.Result{}, err
+			}
+			return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonRecovering, "Deleting failed MicroVM %s to replace it", old.Name)
+		if err := r.client.Delete(ctx, old); err != nil && !errors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+	}
 
 	// Try to recover by creating a new MicroVM
 	vm, err := r.createMicroVMForSession(ctx, instance)
@@ -283,11 +468,16 @@ func (r *ReconcileMCPSession) handleError(ctx context.Context, instance *v1alpha
 	}
 
 	// Update session with new MicroVM
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonRecovering, "Recovering from %q with MicroVM %s", instance.Status.Error, vm.Name)
 	instance.Spec.VMID = vm.Name
+	err = r.client.Update(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
 	instance.Status.State = v1alpha1.MCPSessionStateCreating
 	instance.Status.Error = ""
 	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
-	err = r.client.Update(ctx, instance)
+	err = r.client.Status().Update(ctx, instance)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
@@ -298,6 +488,27 @@ func (r *ReconcileMCPSession) handleError(ctx context.Context, instance *v1alpha
 
 // handleDelete handles a MCPSession that is being deleted
 func (r *ReconcileMCPSession) handleDelete(ctx context.Context, instance *v1alpha1.MCPSession) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(instance, mcpSessionFinalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	r.unregisterSession(sessionKey(instance))
+
+	// Delete the MicroVM of the session, its finalizer deletes the VM and the workspace
+	if instance.Spec.VMID != "" {
+		vm := &v1alpha1.MicroVM{}
+		err := r.client.Get(ctx, types.NamespacedName{Name: instance.Spec.VMID, Namespace: instance.Namespace}, vm)
+		if err != nil && !errors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+		if err == nil && ownedBy(vm, instance) {
+			err = r.client.Delete(ctx, vm)
+			if err != nil && !errors.IsNotFound(err) {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+
 	// Update status to Deleted
 	instance.Status.State = v1alpha1.MCPSessionStateDeleted
 	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
@@ -306,15 +517,38 @@ func (r *ReconcileMCPSession) handleDelete(ctx context.Context, instance *v1alph
 		return reconcile.Result{}, err
 	}
 
+	// Let the MCPSession go
+	controllerutil.RemoveFinalizer(instance, mcpSessionFinalizer)
+	err = r.client.Update(ctx, instance)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
 	return reconcile.Result{}, nil
 }
 
+// ownedBy reports whether a MicroVM was created for a session, rather than
+// being an existing one the session uses
+func ownedBy(vm *v1alpha1.MicroVM, session *v1alpha1.MCPSession) bool {
+	for _, owner := range vm.OwnerReferences {
+		if owner.UID == session.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionVMName returns the name of the MicroVM created for a session
+func sessionVMName(session *v1alpha1.MCPSession) string {
+	return fmt.Sprintf("vm-%s", session.Name)
+}
+
 // createMicroVMForSession creates a new MicroVM for a session
 func (r *ReconcileMCPSession) createMicroVMForSession(ctx context.Context, session *v1alpha1.MCPSession) (*v1alpha1.MicroVM, error) {
 	// Create a new MicroVM
 	vm := &v1alpha1.MicroVM{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("vm-%s", session.Name),
+			Name:      sessionVMName(session),
 			Namespace: session.Namespace,
 			OwnerReferences: []metav1.OwnerReference{
 				{
@@ -326,19 +560,30 @@ func (r *ReconcileMCPSession) createMicroVMForSession(ctx context.Context, sessi
 			},
 		},
 		Spec: v1alpha1.MicroVMSpec{
-			Image:             "ubuntu:20.04", // Default image
-			CPU:               1,              // Default CPU
-			Memory:            512,            // Default memory
-			MCPMode:           true,
-			PersistentStorage: false,
+			Image:   "ubuntu:20.04", // Default image
+			CPU:     1,              // Default CPU
+			Memory:  512,            // Default memory
+			MCPMode: true,
+			// Lets the memory of an idle session be given back through memoryTarget
+			Balloon: &v1alpha1.BalloonSpec{DeflateOnOOM: true},
 		},
 	}
 
+	// Attach the durable workspace, it lives on the node of the first VM of the session
+	if session.Spec.Workspace != nil {
+		vm.Spec.Volumes = append(vm.Spec.Volumes, workspaceVolume(session))
+		if session.Status.WorkspaceNode != "" {
+			vm.Spec.NodeSelector = map[string]string{corev1.LabelHostname: session.Status.WorkspaceNode}
+		}
+	}
+
 	// Create the MicroVM
 	err := r.client.Create(ctx, vm)
 	if err != nil {
+		r.recorder.Eventf(session, corev1.EventTypeWarning, createFailedReason(err, reasonFailedCreateVM), "Failed to create MicroVM %s: %v", vm.Name, err)
 		return nil, err
 	}
 
+	r.recorder.Eventf(session, corev1.EventTypeNormal, reasonCreatedVM, "Created MicroVM %s for user %s", vm.Name, session.Spec.UserID)
 	return vm, nil
 }
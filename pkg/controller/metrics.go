@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// vmStatesDesc describes the number of MicroVMs by state
+var vmStatesDesc = prometheus.NewDesc("tvm_vms", "MicroVMs, by state.", []string{"state"}, nil)
+
+// allStates are reported even without MicroVMs, so series don't disappear
+var allStates = []v1alpha1.MicroVMState{
+	v1alpha1.MicroVMStateCreating,
+	v1alpha1.MicroVMStateRunning,
+	v1alpha1.MicroVMStatePaused,
+	v1alpha1.MicroVMStateStopped,
+	v1alpha1.MicroVMStateError,
+	v1alpha1.MicroVMStateFailed,
+	v1alpha1.MicroVMStateDeleted,
+}
+
+// stateCollector counts the MicroVMs by state from the cache on every scrape
+type stateCollector struct {
+	client client.Client
+}
+
+// newStateCollector creates a collector counting the MicroVMs read through c
+func newStateCollector(c client.Client) *stateCollector {
+	return &stateCollector{client: c}
+}
+
+// Describe implements prometheus.Collector
+func (s *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vmStatesDesc
+}
+
+// Collect implements prometheus.Collector
+func (s *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	vms := &v1alpha1.MicroVMList{}
+	if err := s.client.List(ctx, vms); err != nil {
+		log.Error(err, "Failed to list MicroVMs for metrics")
+		return
+	}
+
+	counts := make(map[v1alpha1.MicroVMState]int)
+	for _, state := range allStates {
+		counts[state] = 0
+	}
+	for i := range vms.Items {
+		// New MicroVMs have no state yet
+		state := vms.Items[i].Status.State
+		if state == "" {
+			state = "Pending"
+		}
+		counts[state]++
+	}
+
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(vmStatesDesc, prometheus.GaugeValue, float64(count), string(state))
+	}
+}
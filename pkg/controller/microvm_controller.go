@@ -2,49 +2,115 @@ package controller
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
 	"github.com/yourusername/tvm/pkg/flintlock"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"github.com/yourusername/tvm/pkg/metrics"
+	"github.com/yourusername/tvm/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 var log = logf.Log.WithName("controller_microvm")
 
+const (
+	// vmIDField indexes MicroVMs by the ID of their backend VM
+	vmIDField = "status.vmId"
+
+	// statusResyncInterval is how often a running VM is checked without events
+	statusResyncInterval = 5 * time.Minute
+
+	// backendTimeout bounds each call to a backend
+	backendTimeout = 30 * time.Second
+
+	// backendRetryInterval is how long to wait after a backend was unavailable or out of capacity
+	backendRetryInterval = 30 * time.Second
+
+	// microVMFinalizer keeps a MicroVM until its VM was deleted on its node
+	microVMFinalizer = "vvm.tvm.github.com/microvm"
+)
+
+// Options configures the MicroVM controller
+type Options struct {
+	// FlintlockEndpoint is used for VMs when no node has a host agent
+	FlintlockEndpoint string
+	// FlintlockClient configures the connection to FlintlockEndpoint
+	FlintlockClient flintlock.ClientOptions
+	// AgentNamespace is the namespace of the host agent pods
+	AgentNamespace string
+	// AgentSelector is the label selector of the host agent pods
+	AgentSelector string
+	// AgentPort is the gRPC port of the host agents
+	AgentPort int
+	// AgentTLS secures the connections to the host agents, nil for plaintext
+	AgentTLS *tls.Config
+	// PlacementStrategy is PlacementSpread or PlacementBinPack
+	PlacementStrategy string
+	// RateLimits sets and caps the I/O rate limits of VMs, DefaultRateLimitPolicy if nil
+	RateLimits *RateLimitPolicy
+}
+
 // Add creates a new MicroVM Controller and adds it to the Manager
-func Add(mgr manager.Manager, flintlockEndpoint string) error {
-	return add(mgr, newReconciler(mgr, flintlockEndpoint))
+func Add(mgr manager.Manager, opts Options) error {
+	r, err := newReconciler(mgr, opts)
+	if err != nil {
+		return err
+	}
+	return add(mgr, r)
 }
 
-// newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager, flintlockEndpoint string) reconcile.Reconciler {
-	flintlockClient, err := flintlock.NewClient(flintlockEndpoint)
+// newReconciler returns a new ReconcileMicroVM
+func newReconciler(mgr manager.Manager, opts Options) (*ReconcileMicroVM, error) {
+	switch opts.PlacementStrategy {
+	case "":
+		opts.PlacementStrategy = PlacementSpread
+	case PlacementSpread, PlacementBinPack:
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q", opts.PlacementStrategy)
+	}
+
+	backends, err := newBackendPool(mgr.GetClient(), opts.AgentNamespace, opts.AgentSelector, opts.AgentPort, opts.AgentTLS, opts.FlintlockEndpoint, opts.FlintlockClient)
 	if err != nil {
-		log.Error(err, "Failed to create Flintlock client")
-		return nil
+		return nil, err
 	}
 
-	return &ReconcileMicroVM{
-		client:          mgr.GetClient(),
-		scheme:          mgr.GetScheme(),
-		recorder:        mgr.GetEventRecorderFor("microvm-controller"),
-		flintlockClient: flintlockClient,
+	rateLimits := opts.RateLimits
+	if rateLimits == nil {
+		rateLimits = DefaultRateLimitPolicy()
 	}
+
+	return &ReconcileMicroVM{
+		client:            mgr.GetClient(),
+		scheme:            mgr.GetScheme(),
+		recorder:          mgr.GetEventRecorderFor("microvm-controller"),
+		backends:          backends,
+		placementStrategy: opts.PlacementStrategy,
+		rateLimits:        rateLimits,
+		balloonRetries:    newRetryTracker(),
+		pauseUnsupported:  newReportTracker(),
+	}, nil
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r *ReconcileMicroVM) error {
 	// Create a new controller
 	c, err := controller.New("microvm-controller", mgr, controller.Options{Reconciler: r})
 	if err != nil {
@@ -64,15 +130,98 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
-	return nil
+	// Index MicroVMs by VM ID so backend events can be mapped to them
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.MicroVM{}, vmIDField, func(obj client.Object) []string {
+		vm := obj.(*v1alpha1.MicroVM)
+		if vm.Status.VMID == "" {
+			return nil
+		}
+		return []string{vm.Status.VMID}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Export the number of MicroVMs by state
+	err = ctrlmetrics.Registry.Register(newStateCollector(mgr.GetClient()))
+	if err != nil {
+		return err
+	}
+
+	// Watch for state changes of the backend VMs
+	events := make(chan event.TypedGenericEvent[*v1alpha1.MicroVM])
+	err = c.Watch(
+		source.Channel(
+			events,
+			&handler.TypedEnqueueRequestForObject[*v1alpha1.MicroVM]{},
+		),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		r.backends.start(ctx)
+		return nil
+	}))
+	if err != nil {
+		return err
+	}
+
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		r.forwardEvents(ctx, events)
+		return nil
+	}))
+}
+
+// forwardEvents enqueues the MicroVMs whose backend VM changed state until ctx is done
+func (r *ReconcileMicroVM) forwardEvents(ctx context.Context, events chan<- event.TypedGenericEvent[*v1alpha1.MicroVM]) {
+	for {
+		var vmEvent flintlock.VMEvent
+		select {
+		case vmEvent = <-r.backends.events:
+		case <-ctx.Done():
+			return
+		}
+
+		list := &v1alpha1.MicroVMList{}
+		err := r.client.List(ctx, list, client.MatchingFields{vmIDField: vmEvent.VMID})
+		if err != nil {
+			log.Error(err, "Failed to look up MicroVM of VM event", "vmID", vmEvent.VMID)
+			continue
+		}
+
+		for i := range list.Items {
+			vm := &list.Items[i]
+			if vm.Status.State == vmEvent.State {
+				continue
+			}
+
+			log.Info("MicroVM changed state", "namespace", vm.Namespace, "name", vm.Name, "state", vmEvent.State)
+			select {
+			case events <- event.TypedGenericEvent[*v1alpha1.MicroVM]{Object: vm}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
 }
 
 // ReconcileMicroVM reconciles a MicroVM object
 type ReconcileMicroVM struct {
-	client          client.Client
-	scheme          *runtime.Scheme
-	recorder        record.EventRecorder
-	flintlockClient *flintlock.Client
+	client   client.Client
+	scheme   *runtime.Scheme
+	recorder record.EventRecorder
+	// backends holds a client per node backend
+	backends *backendPool
+	// placementStrategy ranks the nodes a VM fits on
+	placementStrategy string
+	// rateLimits sets and caps the I/O rate limits of VMs
+	rateLimits *RateLimitPolicy
+	// balloonRetries backs off failed balloon resizes
+	balloonRetries *retryTracker
+	// pauseUnsupported holds the VMs whose backend can't pause them
+	pauseUnsupported *reportTracker
 }
 
 // Reconcile reads that state of the cluster for a MicroVM object and makes changes based on the state read
@@ -80,11 +229,14 @@ func (r *ReconcileMicroVM) Reconcile(ctx context.Context, request reconcile.Requ
 	reqLogger := log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
 	reqLogger.Info("Reconciling MicroVM")
 
+	ctx, span := tracing.Start(ctx, "Reconcile MicroVM", attribute.String("tvm.microvm", request.NamespacedName.String()))
+	defer span.End()
+
 	// Fetch the MicroVM instance
 	instance := &v1alpha1.MicroVM{}
 	err := r.client.Get(ctx, request.NamespacedName, instance)
 	if err != nil {
-		if errors.IsNotFound(err) {
+		if apierrors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
 			// Return and don't requeue
 			return reconcile.Result{}, nil
@@ -98,6 +250,13 @@ func (r *ReconcileMicroVM) Reconcile(ctx context.Context, request reconcile.Requ
 		return r.handleDelete(ctx, instance)
 	}
 
+	// Keep the MicroVM until its VM is deleted
+	if controllerutil.AddFinalizer(instance, microVMFinalizer) {
+		if err := r.client.Update(ctx, instance); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	// Handle different states
 	switch instance.Status.State {
 	case "":
@@ -106,20 +265,24 @@ func (r *ReconcileMicroVM) Reconcile(ctx context.Context, request reconcile.Requ
 	case v1alpha1.MicroVMStateCreating:
 		// MicroVM is being created, check its status
 		return r.handleCreating(ctx, instance)
-	case v1alpha1.MicroVMStateRunning:
-		// MicroVM is running, update its status
+	case v1alpha1.MicroVMStateRunning, v1alpha1.MicroVMStatePaused:
+		// MicroVM is running or paused, update its status
 		return r.handleRunning(ctx, instance)
-	case v1alpha1.MicroVMStateError:
-		// MicroVM is in error state, try to recover
-		return r.handleError(ctx, instance)
+	case v1alpha1.MicroVMStateError, v1alpha1.MicroVMStateStopped:
+		// MicroVM failed or shut down, restart it according to its policy
+		return r.handleRestart(ctx, instance)
+	case v1alpha1.MicroVMStateFailed:
+		// MicroVM will not be restarted
+		return reconcile.Result{}, nil
 	case v1alpha1.MicroVMStateDeleted:
 		// MicroVM is deleted, clean up
 		return reconcile.Result{}, nil
 	default:
 		// Unknown state
-		instance.Status.State = v1alpha1.MicroVMStateError
 		instance.Status.Error = fmt.Sprintf("Unknown state: %s", instance.Status.State)
+		instance.Status.State = v1alpha1.MicroVMStateError
 		err = r.client.Status().Update(ctx, instance)
+		r.recorder.Event(instance, corev1.EventTypeWarning, reasonUnknownState, instance.Status.Error)
 		return reconcile.Result{}, err
 	}
 }
@@ -134,14 +297,64 @@ func (r *ReconcileMicroVM) handleNew(ctx context.Context, instance *v1alpha1.Mic
 		return reconcile.Result{}, err
 	}
 
-	// Create the MicroVM using Flintlock
-	err = r.flintlockClient.CreateMicroVM(ctx, instance)
+	// Check the spec before anything is allocated for the VM. A spec that
+	// can't run fails the VM for good, restarting it wouldn't help. The kernel
+	// catalog is on the node and checked by its backend.
+	err = flintlock.ValidateKernel(instance.Spec.Kernel)
 	if err != nil {
+		return r.rejectSpec(ctx, instance, reasonInvalidKernel, err)
+	}
+
+	// Reject rate limits that can't be applied rather than ignoring them
+	err = validateRateLimits(instance.Spec.RateLimits)
+	if err != nil {
+		return r.rejectSpec(ctx, instance, reasonInvalidRateLimits, err)
+	}
+
+	// A memory target the balloon can't reach would be clamped silently
+	err = flintlock.ValidateBalloon(instance)
+	if err != nil {
+		return r.rejectSpec(ctx, instance, reasonInvalidBalloon, err)
+	}
+
+	// Resolve the backing files of the volumes
+	err = r.ensureVolumes(ctx, instance)
+	if err != nil {
+		return r.rejectSpec(ctx, instance, reasonFailedVolume, err)
+	}
+
+	// Pick the node running the VM, waiting for capacity without counting a restart
+	err = r.placeMicroVM(ctx, instance)
+	if err != nil {
+		return r.retryCreate(ctx, instance, reasonFailedScheduling, err)
+	}
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonScheduled, "Placed VM on node %s", instance.Status.Node)
+
+	// Resolve the I/O rate limits, the backend applies them from the status
+	instance.Status.RateLimits = r.rateLimits.resolve(instance)
+
+	// Create the MicroVM on the backend of its node
+	err = r.createBackendVM(ctx, instance)
+	if errors.Is(err, flintlock.ErrResourceExhausted) {
+		return r.retryCreate(ctx, instance, reasonInsufficientCapacity, err)
+	}
+	if flintlock.IsTransient(err) {
+		return r.retryCreate(ctx, instance, reasonBackendUnavailable, err)
+	}
+	if err != nil {
+		// The restart policy recreates the VM with its own backoff
 		instance.Status.State = v1alpha1.MicroVMStateError
 		instance.Status.Error = err.Error()
-		r.client.Status().Update(ctx, instance)
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedCreate, "Failed to create VM on node %s: %v", instance.Status.Node, err)
+		return reconcile.Result{}, r.client.Status().Update(ctx, instance)
+	}
+
+	// Record the VM ID, node, volumes and rate limits
+	err = r.client.Status().Update(ctx, instance)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonCreated, "Created VM %s on node %s", instance.Status.VMID, instance.Status.Node)
 
 	// Requeue to check status
 	return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
@@ -149,13 +362,17 @@ func (r *ReconcileMicroVM) handleNew(ctx context.Context, instance *v1alpha1.Mic
 
 // handleCreating handles a MicroVM that is being created
 func (r *ReconcileMicroVM) handleCreating(ctx context.Context, instance *v1alpha1.MicroVM) (reconcile.Result, error) {
-	// Update status from Flintlock
-	err := r.flintlockClient.UpdateMicroVMStatus(instance)
+	// Update status from the backend
+	from := instance.Status.State
+	err := r.updateBackendStatus(ctx, instance)
+	if flintlock.IsTransient(err) {
+		return r.retryStatus(instance, err)
+	}
 	if err != nil {
 		instance.Status.State = v1alpha1.MicroVMStateError
 		instance.Status.Error = err.Error()
-		r.client.Status().Update(ctx, instance)
-		return reconcile.Result{}, err
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedStatus, "Failed to get VM status: %v", err)
+		return reconcile.Result{}, r.client.Status().Update(ctx, instance)
 	}
 
 	// Update the instance
@@ -164,6 +381,7 @@ func (r *ReconcileMicroVM) handleCreating(ctx context.Context, instance *v1alpha
 	if err != nil {
 		return reconcile.Result{}, err
 	}
+	recordTransition(r.recorder, instance, from)
 
 	// If still creating, requeue
 	if instance.Status.State == v1alpha1.MicroVMStateCreating {
@@ -175,53 +393,257 @@ func (r *ReconcileMicroVM) handleCreating(ctx context.Context, instance *v1alpha
 
 // handleRunning handles a running MicroVM
 func (r *ReconcileMicroVM) handleRunning(ctx context.Context, instance *v1alpha1.MicroVM) (reconcile.Result, error) {
-	// Update status from Flintlock
-	err := r.flintlockClient.UpdateMicroVMStatus(instance)
+	// Update status from the backend
+	from := instance.Status.State
+	err := r.updateBackendStatus(ctx, instance)
+	if flintlock.IsTransient(err) {
+		return r.retryStatus(instance, err)
+	}
 	if err != nil {
 		instance.Status.State = v1alpha1.MicroVMStateError
 		instance.Status.Error = err.Error()
-		r.client.Status().Update(ctx, instance)
-		return reconcile.Result{}, err
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedStatus, "Failed to get VM status: %v", err)
+		return reconcile.Result{}, r.client.Status().Update(ctx, instance)
 	}
 
 	// Update the instance
 	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
+	resetRestarts(instance)
 	err = r.client.Status().Update(ctx, instance)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
+	recordTransition(r.recorder, instance, from)
+
+	// Pause or resume the VM when spec.paused changed
+	switch {
+	case instance.Spec.Paused && instance.Status.State == v1alpha1.MicroVMStateRunning:
+		return r.setPaused(ctx, instance, true)
+	case !instance.Spec.Paused && instance.Status.State == v1alpha1.MicroVMStatePaused:
+		return r.setPaused(ctx, instance, false)
+	}
+
+	// Apply a changed memory target to the running VM, a paused guest can't
+	// give memory back
+	if instance.Status.State == v1alpha1.MicroVMStateRunning {
+		if retry := r.reconcileBalloon(ctx, instance); retry > 0 {
+			return reconcile.Result{RequeueAfter: retry}, nil
+		}
+	}
 
-	// Requeue periodically to update status
-	return reconcile.Result{RequeueAfter: 30 * time.Second}, nil
+	// State changes are watched, requeue only to resync
+	return reconcile.Result{RequeueAfter: statusResyncInterval}, nil
 }
 
-// handleError handles a MicroVM in error state
-func (r *ReconcileMicroVM) handleError(ctx context.Context, instance *v1alpha1.MicroVM) (reconcile.Result, error) {
-	// For now, just log the error
-	log.Error(fmt.Errorf(instance.Status.Error), "MicroVM in error state", "namespace", instance.Namespace, "name", instance.Name)
+// setPaused pauses or resumes the VM of a MicroVM on its backend. Backends
+// that can't pause VMs leave them running, which is recorded once.
+func (r *ReconcileMicroVM) setPaused(ctx context.Context, instance *v1alpha1.MicroVM, paused bool) (reconcile.Result, error) {
+	backend, err := r.backends.forMicroVM(ctx, instance)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+		if paused {
+			err = backend.PauseMicroVM(ctx, instance.Status.VMID)
+		} else {
+			err = backend.ResumeMicroVM(ctx, instance.Status.VMID)
+		}
+		cancel()
+	}
+
+	state, reason, failedReason := v1alpha1.MicroVMStateRunning, reasonResumed, reasonFailedResume
+	if paused {
+		state, reason, failedReason = v1alpha1.MicroVMStatePaused, reasonPaused, reasonFailedPause
+	}
+	if errors.Is(err, flintlock.ErrNotSupported) {
+		if r.pauseUnsupported.first(instance.UID) {
+			r.recorder.Eventf(instance, corev1.EventTypeWarning, failedReason, "VM %s keeps running: %v", instance.Status.VMID, err)
+		}
+		return reconcile.Result{RequeueAfter: statusResyncInterval}, nil
+	}
+	if err != nil {
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, failedReason, "Failed to move VM %s to %s: %v", instance.Status.VMID, state, err)
+		if flintlock.IsTransient(err) {
+			return reconcile.Result{RequeueAfter: backendRetryInterval}, nil
+		}
+		return reconcile.Result{RequeueAfter: statusResyncInterval}, nil
+	}
 
-	// Requeue to check if it recovers
-	return reconcile.Result{RequeueAfter: 30 * time.Second}, nil
+	instance.Status.State = state
+	if err := r.client.Status().Update(ctx, instance); err != nil {
+		return reconcile.Result{}, err
+	}
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reason, "VM %s is %s", instance.Status.VMID, state)
+	return reconcile.Result{RequeueAfter: statusResyncInterval}, nil
+}
+
+// reconcileBalloon resizes the memory balloon of a running MicroVM when its
+// memory target changed. Failed resizes are retried with a backoff rather than
+// on every reconcile, it returns the delay before the next attempt.
+func (r *ReconcileMicroVM) reconcileBalloon(ctx context.Context, instance *v1alpha1.MicroVM) time.Duration {
+	amount := flintlock.BalloonAmount(instance)
+	var target int64
+	if instance.Status.Balloon != nil {
+		target = instance.Status.Balloon.TargetMB
+	}
+	if target == int64(amount) {
+		r.balloonRetries.forget(instance.UID)
+		return 0
+	}
+	if !r.balloonRetries.due(instance.UID, amount) {
+		return 0
+	}
+
+	// The memory target may have changed since the VM was created, and VMs
+	// created without a balloon or on Flintlock have none to resize
+	err := flintlock.ValidateBalloon(instance)
+	if err == nil && instance.Status.Balloon == nil {
+		err = fmt.Errorf("VM %s has no balloon", instance.Status.VMID)
+	}
+	if err == nil {
+		var backend flintlock.Backend
+		backend, err = r.backends.forMicroVM(ctx, instance)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+			err = backend.ResizeBalloon(ctx, instance.Status.VMID, amount)
+			cancel()
+		}
+	}
+	if err != nil {
+		backoff := r.balloonRetries.failed(instance.UID, amount)
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedResizeBalloon, "Failed to resize balloon to %d MB, retrying in %s: %v", amount, backoff, err)
+		return backoff
+	}
+	r.balloonRetries.forget(instance.UID)
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonResizedBalloon, "Resized balloon of VM %s to %d MB", instance.Status.VMID, amount)
+	return 0
 }
 
 // handleDelete handles a MicroVM that is being deleted
 func (r *ReconcileMicroVM) handleDelete(ctx context.Context, instance *v1alpha1.MicroVM) (reconcile.Result, error) {
-	// Delete the MicroVM using Flintlock
+	r.balloonRetries.forget(instance.UID)
+	r.pauseUnsupported.forget(instance.UID)
+	if !controllerutil.ContainsFinalizer(instance, microVMFinalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	// Delete the MicroVM on its backend, retrying until it is gone. The VM of
+	// a node that was removed from the cluster is gone with it.
 	if instance.Status.VMID != "" {
-		err := r.flintlockClient.DeleteMicroVM(ctx, instance.Status.VMID)
-		if err != nil {
+		err := r.deleteBackendVM(ctx, instance)
+		if err != nil && !r.nodeRemoved(ctx, instance.Status.Node) {
 			log.Error(err, "Failed to delete MicroVM", "namespace", instance.Namespace, "name", instance.Name)
-			// Continue with deletion even if Flintlock fails
+			r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedDelete, "Failed to delete VM %s on node %s, retrying in %s: %v", instance.Status.VMID, instance.Status.Node, backendRetryInterval, err)
+			return reconcile.Result{RequeueAfter: backendRetryInterval}, nil
 		}
+		r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonDeleted, "Deleted VM %s", instance.Status.VMID)
+	}
+
+	// Delete the workspace of a deleted session with its last VM
+	if err := r.deleteWorkspace(ctx, instance); err != nil {
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedVolume, "Failed to delete workspace, it may be left on node %s: %v", instance.Status.Node, err)
 	}
 
 	// Update status to Deleted
 	instance.Status.State = v1alpha1.MicroVMStateDeleted
 	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
 	err := r.client.Status().Update(ctx, instance)
-	if err != nil && !errors.IsNotFound(err) {
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	// Let the MicroVM go
+	controllerutil.RemoveFinalizer(instance, microVMFinalizer)
+	err = r.client.Update(ctx, instance)
+	if err != nil && !apierrors.IsNotFound(err) {
 		return reconcile.Result{}, err
 	}
 
 	return reconcile.Result{}, nil
 }
+
+// nodeRemoved reports whether a node no longer exists in the cluster
+func (r *ReconcileMicroVM) nodeRemoved(ctx context.Context, name string) bool {
+	if name == "" {
+		return false
+	}
+	err := r.client.Get(ctx, client.ObjectKey{Name: name}, &corev1.Node{})
+	return apierrors.IsNotFound(err)
+}
+
+// retryCreate returns a MicroVM whose VM couldn't be created for a transient
+// reason to the new state, so it is placed and created again later
+func (r *ReconcileMicroVM) retryCreate(ctx context.Context, instance *v1alpha1.MicroVM, reason string, cause error) (reconcile.Result, error) {
+	instance.Status.State = ""
+	instance.Status.Node = ""
+	instance.Status.HostPod = ""
+	instance.Status.Error = cause.Error()
+	err := r.client.Status().Update(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	r.recorder.Eventf(instance, corev1.EventTypeWarning, reason, "Retrying VM creation in %s: %v", backendRetryInterval, cause)
+	return reconcile.Result{RequeueAfter: backendRetryInterval}, nil
+}
+
+// rejectSpec fails a MicroVM whose spec can't be run. It goes straight to
+// Failed rather than using up its restarts, and isn't requeued.
+func (r *ReconcileMicroVM) rejectSpec(ctx context.Context, instance *v1alpha1.MicroVM, reason string, cause error) (reconcile.Result, error) {
+	r.recorder.Event(instance, corev1.EventTypeWarning, reason, cause.Error())
+	return r.markFailed(ctx, instance, cause.Error())
+}
+
+// retryStatus checks a MicroVM again later when its backend is unavailable,
+// rather than failing it
+func (r *ReconcileMicroVM) retryStatus(instance *v1alpha1.MicroVM, cause error) (reconcile.Result, error) {
+	r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonBackendUnavailable, "Failed to get VM status, retrying in %s: %v", backendRetryInterval, cause)
+	return reconcile.Result{RequeueAfter: backendRetryInterval}, nil
+}
+
+// createBackendVM creates the VM of a MicroVM on its backend
+func (r *ReconcileMicroVM) createBackendVM(ctx context.Context, instance *v1alpha1.MicroVM) error {
+	backend, err := r.backends.forMicroVM(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "CreateMicroVM", attribute.String("tvm.image", instance.Spec.Image))
+	start := time.Now()
+	err = backend.CreateMicroVM(ctx, instance)
+	if err == nil {
+		metrics.VMCreateDuration.WithLabelValues(instance.Spec.Image).Observe(time.Since(start).Seconds())
+	}
+	tracing.End(span, err)
+	return err
+}
+
+// updateBackendStatus updates the status of a MicroVM from its backend
+func (r *ReconcileMicroVM) updateBackendStatus(ctx context.Context, instance *v1alpha1.MicroVM) error {
+	backend, err := r.backends.forMicroVM(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	return backend.UpdateMicroVMStatus(ctx, instance)
+}
+
+// deleteBackendVM deletes the VM of a MicroVM on its backend. A VM the backend
+// doesn't know is already deleted.
+func (r *ReconcileMicroVM) deleteBackendVM(ctx context.Context, instance *v1alpha1.MicroVM) error {
+	backend, err := r.backends.forMicroVM(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	err = backend.DeleteMicroVM(ctx, instance.Status.VMID)
+	if errors.Is(err, flintlock.ErrVMNotFound) {
+		return nil
+	}
+	return err
+}
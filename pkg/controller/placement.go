@@ -0,0 +1,312 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/deviceplugin"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	// PlacementSpread places VMs on the node with the most free capacity
+	PlacementSpread = "spread"
+
+	// PlacementBinPack places VMs on the node with the least free capacity that fits them
+	PlacementBinPack = "binpack"
+
+	// AllocatableVCPUAnnotation overrides the vCPUs of a node available to VMs
+	AllocatableVCPUAnnotation = deviceplugin.AllocatableVCPUAnnotation
+
+	// AllocatableMemoryAnnotation overrides the memory in MB of a node available to VMs
+	AllocatableMemoryAnnotation = deviceplugin.AllocatableMemoryAnnotation
+
+	// defaultVCPU and defaultMemoryMB are assumed for VMs that don't set them
+	defaultVCPU     = 1
+	defaultMemoryMB = 512
+)
+
+// nodeCapacity is the capacity of a node for VMs
+type nodeCapacity struct {
+	node  *corev1.Node
+	agent *corev1.Pod
+	// vcpu and memoryMB are allocatable to VMs
+	vcpu     int64
+	memoryMB int64
+	// usedVCPU and usedMemoryMB are requested by the VMs on the node
+	usedVCPU     int64
+	usedMemoryMB int64
+}
+
+// placeMicroVM picks a node for a MicroVM and records it in the status. Nodes
+// are filtered by host agent, KVM device, capacity, node selector and required
+// affinity, then ranked by preferred affinity and the placement strategy.
+// Without any host agent, VMs are left unplaced for the fallback backend.
+func (r *ReconcileMicroVM) placeMicroVM(ctx context.Context, instance *v1alpha1.MicroVM) error {
+	agents, err := r.backends.agents(ctx)
+	if err != nil {
+		return err
+	}
+	if len(agents) == 0 {
+		if r.backends.fallback != "" {
+			return nil
+		}
+		return fmt.Errorf("no node has a ready host agent")
+	}
+
+	capacities, err := r.nodeCapacities(ctx, agents, instance)
+	if err != nil {
+		return err
+	}
+
+	vcpu, memoryMB := vmRequests(instance)
+	var candidates []*nodeCapacity
+	var reasons []string
+	for _, capacity := range capacities {
+		if reason := fits(capacity, instance, vcpu, memoryMB); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", capacity.node.Name, reason))
+			continue
+		}
+		candidates = append(candidates, capacity)
+	}
+	if len(candidates) == 0 {
+		sort.Strings(reasons)
+		return fmt.Errorf("no node fits the VM: %v", reasons)
+	}
+
+	// Rank by preferred affinity first, then by the strategy
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if sa, sb := preferredScore(a.node, instance), preferredScore(b.node, instance); sa != sb {
+			return sa > sb
+		}
+		fa, fb := freeFraction(a, vcpu, memoryMB), freeFraction(b, vcpu, memoryMB)
+		if fa != fb {
+			if r.placementStrategy == PlacementBinPack {
+				return fa < fb
+			}
+			return fa > fb
+		}
+		return a.node.Name < b.node.Name
+	})
+
+	chosen := candidates[0]
+	instance.Status.Node = chosen.node.Name
+	instance.Status.HostPod = chosen.agent.Name
+	log.Info("Placed MicroVM", "namespace", instance.Namespace, "name", instance.Name, "node", chosen.node.Name)
+	return nil
+}
+
+// nodeCapacities returns the capacity of the nodes with an agent, accounting
+// the VMs already placed on them except instance
+func (r *ReconcileMicroVM) nodeCapacities(ctx context.Context, agents map[string]*corev1.Pod, instance *v1alpha1.MicroVM) ([]*nodeCapacity, error) {
+	nodes := &corev1.NodeList{}
+	if err := r.client.List(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	byName := make(map[string]*nodeCapacity)
+	var capacities []*nodeCapacity
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		agent, ok := agents[node.Name]
+		if !ok {
+			continue
+		}
+		vcpu, memoryMB := allocatable(node)
+		capacity := &nodeCapacity{node: node, agent: agent, vcpu: vcpu, memoryMB: memoryMB}
+		byName[node.Name] = capacity
+		capacities = append(capacities, capacity)
+	}
+
+	vms := &v1alpha1.MicroVMList{}
+	if err := r.client.List(ctx, vms); err != nil {
+		return nil, fmt.Errorf("failed to list MicroVMs: %v", err)
+	}
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		if vm.UID == instance.UID || !holdsCapacity(vm) {
+			continue
+		}
+		if capacity, ok := byName[vm.Status.Node]; ok {
+			vcpu, memoryMB := vmRequests(vm)
+			capacity.usedVCPU += vcpu
+			capacity.usedMemoryMB += memoryMB
+		}
+	}
+
+	return capacities, nil
+}
+
+// allocatable returns the vCPUs and memory in MB of a node available to VMs,
+// from the annotations reported by kvm-device-plugin or the node allocatable
+func allocatable(node *corev1.Node) (int64, int64) {
+	vcpu := node.Status.Allocatable.Cpu().Value()
+	memoryMB := node.Status.Allocatable.Memory().Value() >> 20
+
+	if v, err := strconv.ParseInt(node.Annotations[AllocatableVCPUAnnotation], 10, 64); err == nil {
+		vcpu = v
+	}
+	if v, err := strconv.ParseInt(node.Annotations[AllocatableMemoryAnnotation], 10, 64); err == nil {
+		memoryMB = v
+	}
+	return vcpu, memoryMB
+}
+
+// holdsCapacity reports whether a VM uses the capacity of its node
+func holdsCapacity(vm *v1alpha1.MicroVM) bool {
+	if vm.Status.Node == "" || !vm.DeletionTimestamp.IsZero() {
+		return false
+	}
+	switch vm.Status.State {
+	case v1alpha1.MicroVMStateDeleted, v1alpha1.MicroVMStateFailed, v1alpha1.MicroVMStateStopped:
+		return false
+	}
+	return true
+}
+
+// vmRequests returns the vCPUs and memory in MB requested by a VM
+func vmRequests(vm *v1alpha1.MicroVM) (int64, int64) {
+	vcpu, memoryMB := int64(vm.Spec.CPU), int64(vm.Spec.Memory)
+	if vcpu <= 0 {
+		vcpu = defaultVCPU
+	}
+	if memoryMB <= 0 {
+		memoryMB = defaultMemoryMB
+	}
+	return vcpu, memoryMB
+}
+
+// fits returns why a VM can't be placed on a node, or "" if it can
+func fits(capacity *nodeCapacity, instance *v1alpha1.MicroVM, vcpu, memoryMB int64) string {
+	node := capacity.node
+	if node.Spec.Unschedulable {
+		return "node is unschedulable"
+	}
+	if !nodeReady(node) {
+		return "node is not ready"
+	}
+	if kvm, ok := node.Status.Allocatable[deviceplugin.ResourceName]; !ok || kvm.IsZero() {
+		return "no KVM device"
+	}
+	if !labels.SelectorFromSet(instance.Spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return "node selector does not match"
+	}
+	if !requiredAffinityMatches(node, instance) {
+		return "node affinity does not match"
+	}
+	if capacity.vcpu-capacity.usedVCPU < vcpu {
+		return fmt.Sprintf("%d of %d vCPUs free", capacity.vcpu-capacity.usedVCPU, capacity.vcpu)
+	}
+	if capacity.memoryMB-capacity.usedMemoryMB < memoryMB {
+		return fmt.Sprintf("%dMB of %dMB memory free", capacity.memoryMB-capacity.usedMemoryMB, capacity.memoryMB)
+	}
+	return ""
+}
+
+// freeFraction returns the share of the capacity of a node left after placing a VM
+func freeFraction(capacity *nodeCapacity, vcpu, memoryMB int64) float64 {
+	if capacity.vcpu == 0 || capacity.memoryMB == 0 {
+		return 0
+	}
+	freeVCPU := float64(capacity.vcpu-capacity.usedVCPU-vcpu) / float64(capacity.vcpu)
+	freeMemory := float64(capacity.memoryMB-capacity.usedMemoryMB-memoryMB) / float64(capacity.memoryMB)
+	return (freeVCPU + freeMemory) / 2
+}
+
+// nodeReady reports whether a node has the Ready condition
+func nodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// requiredAffinityMatches reports whether a node satisfies the required node
+// affinity of a VM. As for pods, any one of the terms must match.
+func requiredAffinityMatches(node *corev1.Node, instance *v1alpha1.MicroVM) bool {
+	if instance.Spec.Affinity == nil || instance.Spec.Affinity.NodeAffinity == nil {
+		return true
+	}
+	required := instance.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil {
+		return true
+	}
+
+	for i := range required.NodeSelectorTerms {
+		if termMatches(node, &required.NodeSelectorTerms[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredScore sums the weights of the preferred node affinity terms a node matches
+func preferredScore(node *corev1.Node, instance *v1alpha1.MicroVM) int32 {
+	if instance.Spec.Affinity == nil || instance.Spec.Affinity.NodeAffinity == nil {
+		return 0
+	}
+
+	var score int32
+	for i := range instance.Spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		term := &instance.Spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution[i]
+		if termMatches(node, &term.Preference) {
+			score += term.Weight
+		}
+	}
+	return score
+}
+
+// termMatches reports whether a node matches all requirements of a node selector term
+func termMatches(node *corev1.Node, term *corev1.NodeSelectorTerm) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+
+	for _, req := range term.MatchExpressions {
+		if !requirementMatches(req, labels.Set(node.Labels)) {
+			return false
+		}
+	}
+	// metadata.name is the only field nodes can be selected by
+	for _, req := range term.MatchFields {
+		if req.Key != "metadata.name" || !requirementMatches(req, labels.Set{"metadata.name": node.Name}) {
+			return false
+		}
+	}
+	return true
+}
+
+// requirementMatches evaluates a node selector requirement against a label set
+func requirementMatches(req corev1.NodeSelectorRequirement, set labels.Set) bool {
+	var op selection.Operator
+	switch req.Operator {
+	case corev1.NodeSelectorOpIn:
+		op = selection.In
+	case corev1.NodeSelectorOpNotIn:
+		op = selection.NotIn
+	case corev1.NodeSelectorOpExists:
+		op = selection.Exists
+	case corev1.NodeSelectorOpDoesNotExist:
+		op = selection.DoesNotExist
+	case corev1.NodeSelectorOpGt:
+		op = selection.GreaterThan
+	case corev1.NodeSelectorOpLt:
+		op = selection.LessThan
+	default:
+		return false
+	}
+
+	requirement, err := labels.NewRequirement(req.Key, op, req.Values)
+	if err != nil {
+		return false
+	}
+	return requirement.Matches(set)
+}
@@ -0,0 +1,455 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/deviceplugin"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRequirementMatches(t *testing.T) {
+	set := labels.Set{"zone": "a", "cores": "16"}
+	tests := []struct {
+		name string
+		req  corev1.NodeSelectorRequirement
+		want bool
+	}{
+		{name: "In matches", req: requirement("zone", corev1.NodeSelectorOpIn, "a", "b"), want: true},
+		{name: "In misses", req: requirement("zone", corev1.NodeSelectorOpIn, "b"), want: false},
+		{name: "In missing label", req: requirement("gpu", corev1.NodeSelectorOpIn, "a"), want: false},
+		{name: "NotIn matches", req: requirement("zone", corev1.NodeSelectorOpNotIn, "b"), want: true},
+		{name: "NotIn misses", req: requirement("zone", corev1.NodeSelectorOpNotIn, "a"), want: false},
+		{name: "NotIn missing label", req: requirement("gpu", corev1.NodeSelectorOpNotIn, "a"), want: true},
+		{name: "Exists", req: requirement("zone", corev1.NodeSelectorOpExists), want: true},
+		{name: "Exists missing label", req: requirement("gpu", corev1.NodeSelectorOpExists), want: false},
+		{name: "DoesNotExist", req: requirement("gpu", corev1.NodeSelectorOpDoesNotExist), want: true},
+		{name: "DoesNotExist with label", req: requirement("zone", corev1.NodeSelectorOpDoesNotExist), want: false},
+		{name: "Gt matches", req: requirement("cores", corev1.NodeSelectorOpGt, "8"), want: true},
+		{name: "Gt misses", req: requirement("cores", corev1.NodeSelectorOpGt, "16"), want: false},
+		{name: "Lt matches", req: requirement("cores", corev1.NodeSelectorOpLt, "32"), want: true},
+		{name: "Lt misses", req: requirement("cores", corev1.NodeSelectorOpLt, "16"), want: false},
+		{name: "Gt of a non-number label", req: requirement("zone", corev1.NodeSelectorOpGt, "1"), want: false},
+		{name: "Gt with invalid value", req: requirement("cores", corev1.NodeSelectorOpGt, "many"), want: false},
+		{name: "unknown operator", req: requirement("zone", "Like", "a"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requirementMatches(tt.req, set); got != tt.want {
+				t.Errorf("requirementMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTermMatches(t *testing.T) {
+	node := testNode("node-1", map[string]string{"zone": "a", "disk": "ssd"})
+	tests := []struct {
+		name string
+		term corev1.NodeSelectorTerm
+		want bool
+	}{
+		{name: "empty term", term: corev1.NodeSelectorTerm{}, want: false},
+		{
+			name: "all expressions match",
+			term: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+				requirement("zone", corev1.NodeSelectorOpIn, "a"),
+				requirement("disk", corev1.NodeSelectorOpIn, "ssd"),
+			}},
+			want: true,
+		},
+		{
+			name: "one expression misses",
+			term: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+				requirement("zone", corev1.NodeSelectorOpIn, "a"),
+				requirement("disk", corev1.NodeSelectorOpIn, "hdd"),
+			}},
+			want: false,
+		},
+		{
+			name: "node name field",
+			term: corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{
+				requirement("metadata.name", corev1.NodeSelectorOpIn, "node-1"),
+			}},
+			want: true,
+		},
+		{
+			name: "other node name",
+			term: corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{
+				requirement("metadata.name", corev1.NodeSelectorOpIn, "node-2"),
+			}},
+			want: false,
+		},
+		{
+			name: "unsupported field",
+			term: corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{
+				requirement("spec.podCIDR", corev1.NodeSelectorOpExists),
+			}},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := termMatches(node, &tt.term); got != tt.want {
+				t.Errorf("termMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiredAffinityMatches(t *testing.T) {
+	node := testNode("node-1", map[string]string{"zone": "a"})
+	tests := []struct {
+		name  string
+		terms []corev1.NodeSelectorTerm
+		want  bool
+	}{
+		{name: "no terms", want: false},
+		{
+			name: "any term matches",
+			terms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("zone", corev1.NodeSelectorOpIn, "b")}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("zone", corev1.NodeSelectorOpIn, "a")}},
+			},
+			want: true,
+		},
+		{
+			name: "no term matches",
+			terms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("zone", corev1.NodeSelectorOpIn, "b")}},
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &v1alpha1.MicroVM{Spec: v1alpha1.MicroVMSpec{Affinity: requiredAffinity(tt.terms...)}}
+			if got := requiredAffinityMatches(node, instance); got != tt.want {
+				t.Errorf("requiredAffinityMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if !requiredAffinityMatches(node, &v1alpha1.MicroVM{}) {
+		t.Errorf("requiredAffinityMatches() = false for a VM without affinity")
+	}
+}
+
+func TestPreferredScore(t *testing.T) {
+	node := testNode("node-1", map[string]string{"zone": "a", "disk": "ssd"})
+	instance := &v1alpha1.MicroVM{Spec: v1alpha1.MicroVMSpec{Affinity: &v1alpha1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+			{Weight: 10, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("zone", corev1.NodeSelectorOpIn, "a")}}},
+			{Weight: 5, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("disk", corev1.NodeSelectorOpIn, "ssd")}}},
+			{Weight: 20, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("gpu", corev1.NodeSelectorOpExists)}}},
+		},
+	}}}}
+
+	if got := preferredScore(node, instance); got != 15 {
+		t.Errorf("preferredScore() = %d, want 15", got)
+	}
+	if got := preferredScore(node, &v1alpha1.MicroVM{}); got != 0 {
+		t.Errorf("preferredScore() = %d for a VM without affinity, want 0", got)
+	}
+}
+
+func TestFits(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     func(*corev1.Node)
+		instance v1alpha1.MicroVMSpec
+		usedVCPU int64
+		usedMB   int64
+		// want is a substring of the reason, empty if the VM fits
+		want string
+	}{
+		{name: "fits"},
+		{name: "unschedulable", node: func(n *corev1.Node) { n.Spec.Unschedulable = true }, want: "unschedulable"},
+		{name: "not ready", node: func(n *corev1.Node) { n.Status.Conditions = nil }, want: "not ready"},
+		{name: "no KVM device", node: func(n *corev1.Node) { delete(n.Status.Allocatable, deviceplugin.ResourceName) }, want: "no KVM device"},
+		{name: "node selector matches", instance: v1alpha1.MicroVMSpec{NodeSelector: map[string]string{"zone": "a"}}},
+		{name: "node selector misses", instance: v1alpha1.MicroVMSpec{NodeSelector: map[string]string{"zone": "b"}}, want: "node selector"},
+		{
+			name: "affinity misses",
+			instance: v1alpha1.MicroVMSpec{Affinity: requiredAffinity(corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{requirement("zone", corev1.NodeSelectorOpNotIn, "a")},
+			})},
+			want: "node affinity",
+		},
+		{name: "vCPUs used up", usedVCPU: 3, want: "1 of 4 vCPUs free"},
+		{name: "memory used up", usedMB: 7680, want: "512MB of 8192MB memory free"},
+		{name: "exactly fits", usedVCPU: 2, usedMB: 7168},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := testNode("node-1", map[string]string{"zone": "a"})
+			if tt.node != nil {
+				tt.node(node)
+			}
+			capacity := &nodeCapacity{node: node, vcpu: 4, memoryMB: 8192, usedVCPU: tt.usedVCPU, usedMemoryMB: tt.usedMB}
+			got := fits(capacity, &v1alpha1.MicroVM{Spec: tt.instance}, 2, 1024)
+			if tt.want == "" {
+				if got != "" {
+					t.Fatalf("fits() = %q, want the VM to fit", got)
+				}
+			} else if !strings.Contains(got, tt.want) {
+				t.Fatalf("fits() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreeFraction(t *testing.T) {
+	capacity := &nodeCapacity{vcpu: 4, memoryMB: 8192, usedVCPU: 1, usedMemoryMB: 2048}
+	if got := freeFraction(capacity, 1, 2048); got != 0.5 {
+		t.Errorf("freeFraction() = %v, want 0.5", got)
+	}
+	if got := freeFraction(&nodeCapacity{}, 1, 512); got != 0 {
+		t.Errorf("freeFraction() = %v for a node without capacity, want 0", got)
+	}
+}
+
+func TestHoldsCapacity(t *testing.T) {
+	now := metav1.Now()
+	tests := []struct {
+		name string
+		vm   v1alpha1.MicroVM
+		want bool
+	}{
+		{name: "running", vm: placedVM("vm", "node-1", 1, 512), want: true},
+		{name: "not placed", vm: v1alpha1.MicroVM{Status: v1alpha1.MicroVMStatus{State: v1alpha1.MicroVMStateCreating}}, want: false},
+		{name: "being deleted", vm: func() v1alpha1.MicroVM {
+			vm := placedVM("vm", "node-1", 1, 512)
+			vm.DeletionTimestamp = &now
+			return vm
+		}(), want: false},
+		{name: "failed", vm: withState(placedVM("vm", "node-1", 1, 512), v1alpha1.MicroVMStateFailed), want: false},
+		{name: "stopped", vm: withState(placedVM("vm", "node-1", 1, 512), v1alpha1.MicroVMStateStopped), want: false},
+		{name: "restarting after an error", vm: withState(placedVM("vm", "node-1", 1, 512), v1alpha1.MicroVMStateError), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := holdsCapacity(&tt.vm); got != tt.want {
+				t.Errorf("holdsCapacity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceMicroVM(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		// vms are already placed
+		vms      []v1alpha1.MicroVM
+		instance v1alpha1.MicroVMSpec
+		want     string
+		// wantErr is a substring of the error
+		wantErr string
+	}{
+		{
+			name:     "spread picks the emptiest node",
+			strategy: PlacementSpread,
+			vms:      []v1alpha1.MicroVM{placedVM("a", "node-1", 1, 1024)},
+			want:     "node-2",
+		},
+		{
+			name:     "binpack picks the fullest node",
+			strategy: PlacementBinPack,
+			vms:      []v1alpha1.MicroVM{placedVM("a", "node-1", 1, 1024)},
+			want:     "node-1",
+		},
+		{
+			name:     "binpack skips a full node",
+			strategy: PlacementBinPack,
+			vms:      []v1alpha1.MicroVM{placedVM("a", "node-1", 4, 1024)},
+			want:     "node-2",
+		},
+		{
+			name:     "VMs that don't hold capacity are not counted",
+			strategy: PlacementBinPack,
+			vms:      []v1alpha1.MicroVM{withState(placedVM("a", "node-1", 4, 1024), v1alpha1.MicroVMStateFailed), placedVM("b", "node-2", 1, 512)},
+			want:     "node-2",
+		},
+		{
+			name:     "ties go to the first node by name",
+			strategy: PlacementSpread,
+			want:     "node-1",
+		},
+		{
+			name:     "node selector",
+			strategy: PlacementSpread,
+			instance: v1alpha1.MicroVMSpec{NodeSelector: map[string]string{"zone": "b"}},
+			want:     "node-2",
+		},
+		{
+			name:     "preferred affinity beats the strategy",
+			strategy: PlacementSpread,
+			vms:      []v1alpha1.MicroVM{placedVM("a", "node-1", 2, 4096)},
+			instance: v1alpha1.MicroVMSpec{Affinity: &v1alpha1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{
+					Weight:     1,
+					Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("zone", corev1.NodeSelectorOpIn, "a")}},
+				}},
+			}}},
+			want: "node-1",
+		},
+		{
+			name:     "no node has room",
+			strategy: PlacementSpread,
+			vms:      []v1alpha1.MicroVM{placedVM("a", "node-1", 4, 1024), placedVM("b", "node-2", 1, 8192)},
+			wantErr:  "no node fits the VM: [node-1: 0 of 4 vCPUs free node-2: 0MB of 8192MB memory free]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := []client.Object{
+				testNode("node-1", map[string]string{"zone": "a"}),
+				testNode("node-2", map[string]string{"zone": "b"}),
+				agentPod("agent-1", "node-1", "10.0.0.1"),
+				agentPod("agent-2", "node-2", "10.0.0.2"),
+			}
+			for i := range tt.vms {
+				objs = append(objs, &tt.vms[i])
+			}
+			c := newFakeClient(t, objs...)
+			backends, err := newBackendPool(c, "tvm", "app=flintlock", 9090, nil, "", flintlock.ClientOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &ReconcileMicroVM{client: c, backends: backends, placementStrategy: tt.strategy}
+
+			instance := &v1alpha1.MicroVM{
+				ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default", UID: "new"},
+				Spec:       tt.instance,
+			}
+			instance.Spec.CPU, instance.Spec.Memory = 1, 1024
+			err = r.placeMicroVM(context.Background(), instance)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("placeMicroVM() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("placeMicroVM() error = %v", err)
+			}
+			if instance.Status.Node != tt.want {
+				t.Errorf("placeMicroVM() placed the VM on %s, want %s", instance.Status.Node, tt.want)
+			}
+			if want := "agent" + strings.TrimPrefix(tt.want, "node"); instance.Status.HostPod != want {
+				t.Errorf("placeMicroVM() recorded host pod %s, want %s", instance.Status.HostPod, want)
+			}
+		})
+	}
+}
+
+func TestPlaceMicroVMWithoutAgents(t *testing.T) {
+	c := newFakeClient(t, testNode("node-1", nil))
+	for _, tt := range []struct {
+		fallback string
+		wantErr  bool
+	}{
+		{fallback: "", wantErr: true},
+		{fallback: "flintlock:9090", wantErr: false},
+	} {
+		backends, err := newBackendPool(c, "tvm", "app=flintlock", 9090, nil, tt.fallback, flintlock.ClientOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &ReconcileMicroVM{client: c, backends: backends}
+		instance := &v1alpha1.MicroVM{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default"}}
+		err = r.placeMicroVM(context.Background(), instance)
+		if (err != nil) != tt.wantErr || instance.Status.Node != "" {
+			t.Errorf("placeMicroVM() with fallback %q = %v on node %q, want error %v and no node", tt.fallback, err, instance.Status.Node, tt.wantErr)
+		}
+	}
+}
+
+// newFakeClient returns a fake client holding objs, with the MicroVM status as a subresource
+func newFakeClient(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&v1alpha1.MicroVM{}, &v1alpha1.MCPSession{}).
+		Build()
+}
+
+// testNode returns a ready KVM node with 4 vCPUs and 8 GB of memory
+func testNode(name string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:        resource.MustParse("4"),
+				corev1.ResourceMemory:     resource.MustParse("8Gi"),
+				deviceplugin.ResourceName: resource.MustParse("10"),
+			},
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// agentPod returns a ready host agent pod on a node
+func agentPod(name, node, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tvm", Labels: map[string]string{"app": "flintlock"}},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{
+			PodIP:      ip,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// placedVM returns a running MicroVM placed on a node
+func placedVM(name, node string, cpu, memoryMB int32) v1alpha1.MicroVM {
+	return v1alpha1.MicroVM{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)},
+		Spec:       v1alpha1.MicroVMSpec{CPU: cpu, Memory: memoryMB},
+		Status:     v1alpha1.MicroVMStatus{State: v1alpha1.MicroVMStateRunning, Node: node},
+	}
+}
+
+// withState returns vm in state
+func withState(vm v1alpha1.MicroVM, state v1alpha1.MicroVMState) v1alpha1.MicroVM {
+	vm.Status.State = state
+	return vm
+}
+
+// requirement returns a node selector requirement
+func requirement(key string, op corev1.NodeSelectorOperator, values ...string) corev1.NodeSelectorRequirement {
+	return corev1.NodeSelectorRequirement{Key: key, Operator: op, Values: values}
+}
+
+// requiredAffinity returns an affinity requiring any of terms
+func requiredAffinity(terms ...corev1.NodeSelectorTerm) *v1alpha1.Affinity {
+	return &v1alpha1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+	}}
+}
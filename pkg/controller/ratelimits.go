@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultMaxDiskBandwidth is the built-in disk bandwidth ceiling, 200 MiB/s
+	defaultMaxDiskBandwidth = 200 << 20
+	// defaultMaxDiskOps is the built-in disk operations ceiling
+	defaultMaxDiskOps = 8000
+)
+
+// RateLimitPolicy sets the I/O rate limits of MicroVMs that don't set them
+// and caps those that do
+type RateLimitPolicy struct {
+	// Defaults apply to the limits a VM doesn't set
+	Defaults v1alpha1.RateLimits `json:"defaults,omitempty"`
+	// Templates are the defaults of the VMs of an image, over Defaults
+	Templates map[string]v1alpha1.RateLimits `json:"templates,omitempty"`
+	// Max is the ceiling of every limit. A VM without a limit gets the
+	// ceiling, so no VM runs unlimited where it is set.
+	Max v1alpha1.RateLimits `json:"max,omitempty"`
+}
+
+// DefaultRateLimitPolicy returns the policy used without a rate limit
+// config, capping every VM at the built-in disk ceiling
+func DefaultRateLimitPolicy() *RateLimitPolicy {
+	return &RateLimitPolicy{
+		Max: v1alpha1.RateLimits{
+			Disk: &v1alpha1.RateLimit{
+				BandwidthBytesPerSec: defaultMaxDiskBandwidth,
+				OpsPerSec:            defaultMaxDiskOps,
+			},
+		},
+	}
+}
+
+// LoadRateLimitPolicy reads a rate limit policy from a YAML file
+func LoadRateLimitPolicy(path string) (*RateLimitPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate limit policy: %v", err)
+	}
+	policy := &RateLimitPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("invalid rate limit policy %s: %v", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limit policy %s: %v", path, err)
+	}
+	return policy, nil
+}
+
+// validate checks the policy has a ceiling of the disk bandwidth and
+// operations, and no network limits, which can't be applied
+func (p *RateLimitPolicy) validate() error {
+	if max := p.Max.Disk; max == nil || max.BandwidthBytesPerSec <= 0 || max.OpsPerSec <= 0 {
+		return fmt.Errorf("max must limit the disk bandwidth and operations")
+	}
+	if err := validateRateLimits(&p.Defaults); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	for image, template := range p.Templates {
+		if err := validateRateLimits(&template); err != nil {
+			return fmt.Errorf("template %s: %v", image, err)
+		}
+	}
+	return validateRateLimits(&p.Max)
+}
+
+// validateRateLimits rejects the limits that can't be applied to a VM. VMs
+// have no network interfaces, only vsock, so there is no network to limit.
+func validateRateLimits(limits *v1alpha1.RateLimits) error {
+	if limits != nil && limits.Network != nil {
+		return fmt.Errorf("network rate limits are not supported yet, VMs have no network interfaces; set only disk limits")
+	}
+	return nil
+}
+
+// resolve returns the limits applied to a VM: those of its spec, else of its
+// template, else the defaults, capped by the ceiling
+func (p *RateLimitPolicy) resolve(vm *v1alpha1.MicroVM) *v1alpha1.RateLimits {
+	spec := vm.Spec.RateLimits
+	if spec == nil {
+		spec = &v1alpha1.RateLimits{}
+	}
+
+	template := p.Templates[vm.Spec.Image]
+	return &v1alpha1.RateLimits{
+		Disk: resolveRateLimit(p.Max.Disk, spec.Disk, template.Disk, p.Defaults.Disk),
+	}
+}
+
+// resolveRateLimit takes every field from the first of limits setting it and
+// caps it at max. Nil means unlimited.
+func resolveRateLimit(max *v1alpha1.RateLimit, limits ...*v1alpha1.RateLimit) *v1alpha1.RateLimit {
+	pick := func(field func(*v1alpha1.RateLimit) int64) int64 {
+		var value int64
+		for _, l := range limits {
+			if l != nil && field(l) > 0 {
+				value = field(l)
+				break
+			}
+		}
+		if max != nil && field(max) > 0 && (value == 0 || value > field(max)) {
+			value = field(max)
+		}
+		return value
+	}
+
+	resolved := &v1alpha1.RateLimit{
+		BandwidthBytesPerSec: pick(func(l *v1alpha1.RateLimit) int64 { return l.BandwidthBytesPerSec }),
+		BandwidthBurstBytes:  pick(func(l *v1alpha1.RateLimit) int64 { return l.BandwidthBurstBytes }),
+		OpsPerSec:            pick(func(l *v1alpha1.RateLimit) int64 { return l.OpsPerSec }),
+		OpsBurst:             pick(func(l *v1alpha1.RateLimit) int64 { return l.OpsBurst }),
+	}
+	if *resolved == (v1alpha1.RateLimit{}) {
+		return nil
+	}
+	return resolved
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// restartBackoffBase is the delay before the first restart, doubled for each further one
+	restartBackoffBase = 10 * time.Second
+
+	// restartBackoffMax caps the delay between restarts
+	restartBackoffMax = 5 * time.Minute
+
+	// defaultMaxRestarts is the number of restarts before a VM is Failed
+	defaultMaxRestarts = 5
+
+	// restartResetInterval is how long a VM must run before its restarts are forgotten
+	restartResetInterval = 10 * time.Minute
+)
+
+// handleRestart handles a MicroVM that hit an error or stopped. Depending on
+// its restart policy the backend VM is recreated after an exponential backoff,
+// or the MicroVM is marked Failed.
+func (r *ReconcileMicroVM) handleRestart(ctx context.Context, instance *v1alpha1.MicroVM) (reconcile.Result, error) {
+	if !shouldRestart(instance) {
+		// A VM that shut down on its own stays stopped
+		if instance.Status.State == v1alpha1.MicroVMStateStopped {
+			return reconcile.Result{}, nil
+		}
+		return r.markFailed(ctx, instance, instance.Status.Error)
+	}
+
+	limit := maxRestarts(instance)
+	if instance.Status.Restarts >= limit {
+		return r.markFailed(ctx, instance, fmt.Sprintf("restart limit of %d reached: %s", limit, restartReason(instance)))
+	}
+
+	// Schedule the restart
+	now := time.Now()
+	if instance.Status.NextRetryTime == nil {
+		backoff := restartBackoff(instance.Status.Restarts)
+		instance.Status.NextRetryTime = &metav1.Time{Time: now.Add(backoff)}
+		err := r.client.Status().Update(ctx, instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonBackOff, "Restarting VM in %s: %s", backoff, restartReason(instance))
+		return reconcile.Result{RequeueAfter: backoff}, nil
+	}
+	if wait := instance.Status.NextRetryTime.Sub(now); wait > 0 {
+		return reconcile.Result{RequeueAfter: wait}, nil
+	}
+
+	// The old VM may already be gone, so a failed delete doesn't stop the restart
+	if instance.Status.VMID != "" {
+		err := r.deleteBackendVM(ctx, instance)
+		if err != nil {
+			log.Error(err, "Failed to delete MicroVM before restart", "namespace", instance.Namespace, "name", instance.Name)
+			r.recorder.Eventf(instance, corev1.EventTypeWarning, reasonFailedDelete, "Failed to delete VM %s before restart: %v", instance.Status.VMID, err)
+		}
+	}
+
+	// Reset the state so the VM is recreated and placed like a new one
+	instance.Status.Restarts++
+	instance.Status.LastRestartTime = &metav1.Time{Time: now}
+	instance.Status.NextRetryTime = nil
+	instance.Status.VMID = ""
+	instance.Status.Node = ""
+	instance.Status.HostPod = ""
+	instance.Status.State = ""
+	instance.Status.Error = ""
+	err := r.client.Status().Update(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	r.recorder.Eventf(instance, corev1.EventTypeNormal, reasonRestarting, "Restarting VM (restart %d of %d)", instance.Status.Restarts, limit)
+	return reconcile.Result{Requeue: true}, nil
+}
+
+// markFailed moves a MicroVM to the terminal Failed state
+func (r *ReconcileMicroVM) markFailed(ctx context.Context, instance *v1alpha1.MicroVM, reason string) (reconcile.Result, error) {
+	instance.Status.State = v1alpha1.MicroVMStateFailed
+	instance.Status.Error = reason
+	instance.Status.NextRetryTime = nil
+	instance.Status.LastActivity = &metav1.Time{Time: time.Now()}
+	err := r.client.Status().Update(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	r.recorder.Event(instance, corev1.EventTypeWarning, reasonFailed, reason)
+	return reconcile.Result{}, nil
+}
+
+// resetRestarts forgets the restarts of a VM that has been running long enough
+func resetRestarts(instance *v1alpha1.MicroVM) {
+	if instance.Status.Restarts == 0 || instance.Status.LastRestartTime == nil {
+		return
+	}
+	if time.Since(instance.Status.LastRestartTime.Time) >= restartResetInterval {
+		instance.Status.Restarts = 0
+	}
+}
+
+// shouldRestart reports whether the restart policy recreates a VM in its current state
+func shouldRestart(instance *v1alpha1.MicroVM) bool {
+	policy := instance.Spec.RestartPolicy
+	if policy == "" {
+		policy = v1alpha1.RestartPolicyOnFailure
+	}
+
+	switch instance.Status.State {
+	case v1alpha1.MicroVMStateError:
+		return policy != v1alpha1.RestartPolicyNever
+	case v1alpha1.MicroVMStateStopped:
+		return policy == v1alpha1.RestartPolicyAlways
+	}
+	return false
+}
+
+// maxRestarts returns the number of restarts allowed for a VM
+func maxRestarts(instance *v1alpha1.MicroVM) int32 {
+	if instance.Spec.MaxRestarts == nil {
+		return defaultMaxRestarts
+	}
+	return *instance.Spec.MaxRestarts
+}
+
+// restartBackoff returns the delay before a VM that was restarted the given number of times is restarted again
+func restartBackoff(restarts int32) time.Duration {
+	backoff := restartBackoffBase
+	for i := int32(0); i < restarts && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > restartBackoffMax {
+		backoff = restartBackoffMax
+	}
+	return backoff
+}
+
+// restartReason describes why a VM is restarted
+func restartReason(instance *v1alpha1.MicroVM) string {
+	if instance.Status.State == v1alpha1.MicroVMStateStopped {
+		return "VM stopped"
+	}
+	if instance.Status.Error == "" {
+		return "VM failed"
+	}
+	return instance.Status.Error
+}
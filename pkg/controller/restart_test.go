@@ -0,0 +1,238 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tests := []struct {
+		restarts int32
+		want     time.Duration
+	}{
+		{restarts: 0, want: 10 * time.Second},
+		{restarts: 1, want: 20 * time.Second},
+		{restarts: 2, want: 40 * time.Second},
+		{restarts: 3, want: 80 * time.Second},
+		{restarts: 4, want: 160 * time.Second},
+		{restarts: 5, want: 5 * time.Minute},
+		{restarts: 100, want: 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := restartBackoff(tt.restarts); got != tt.want {
+			t.Errorf("restartBackoff(%d) = %s, want %s", tt.restarts, got, tt.want)
+		}
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	tests := []struct {
+		policy v1alpha1.RestartPolicy
+		state  v1alpha1.MicroVMState
+		want   bool
+	}{
+		{policy: "", state: v1alpha1.MicroVMStateError, want: true},
+		{policy: "", state: v1alpha1.MicroVMStateStopped, want: false},
+		{policy: v1alpha1.RestartPolicyOnFailure, state: v1alpha1.MicroVMStateError, want: true},
+		{policy: v1alpha1.RestartPolicyOnFailure, state: v1alpha1.MicroVMStateStopped, want: false},
+		{policy: v1alpha1.RestartPolicyAlways, state: v1alpha1.MicroVMStateError, want: true},
+		{policy: v1alpha1.RestartPolicyAlways, state: v1alpha1.MicroVMStateStopped, want: true},
+		{policy: v1alpha1.RestartPolicyNever, state: v1alpha1.MicroVMStateError, want: false},
+		{policy: v1alpha1.RestartPolicyNever, state: v1alpha1.MicroVMStateStopped, want: false},
+		{policy: v1alpha1.RestartPolicyAlways, state: v1alpha1.MicroVMStateRunning, want: false},
+		{policy: v1alpha1.RestartPolicyAlways, state: v1alpha1.MicroVMStateFailed, want: false},
+	}
+
+	for _, tt := range tests {
+		instance := &v1alpha1.MicroVM{
+			Spec:   v1alpha1.MicroVMSpec{RestartPolicy: tt.policy},
+			Status: v1alpha1.MicroVMStatus{State: tt.state},
+		}
+		if got := shouldRestart(instance); got != tt.want {
+			t.Errorf("shouldRestart(%q, %s) = %v, want %v", tt.policy, tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestResetRestarts(t *testing.T) {
+	tests := []struct {
+		name        string
+		restarts    int32
+		lastRestart *time.Duration
+		want        int32
+	}{
+		{name: "no restarts", restarts: 0, want: 0},
+		{name: "never restarted", restarts: 2, want: 2},
+		{name: "restarted recently", restarts: 2, lastRestart: duration(time.Minute), want: 2},
+		{name: "running long enough", restarts: 2, lastRestart: duration(restartResetInterval), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &v1alpha1.MicroVM{Status: v1alpha1.MicroVMStatus{Restarts: tt.restarts}}
+			if tt.lastRestart != nil {
+				instance.Status.LastRestartTime = &metav1.Time{Time: time.Now().Add(-*tt.lastRestart)}
+			}
+			resetRestarts(instance)
+			if instance.Status.Restarts != tt.want {
+				t.Errorf("resetRestarts() left %d restarts, want %d", instance.Status.Restarts, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRestart(t *testing.T) {
+	limit := int32(2)
+	tests := []struct {
+		name        string
+		policy      v1alpha1.RestartPolicy
+		state       v1alpha1.MicroVMState
+		maxRestarts *int32
+		restarts    int32
+		// want is the state of the MicroVM after handling it
+		want v1alpha1.MicroVMState
+		// wantBackoff is the requeue delay of a scheduled restart
+		wantBackoff time.Duration
+	}{
+		{
+			name:        "first restart is scheduled",
+			state:       v1alpha1.MicroVMStateError,
+			want:        v1alpha1.MicroVMStateError,
+			wantBackoff: 10 * time.Second,
+		},
+		{
+			name:        "backoff doubles with restarts",
+			state:       v1alpha1.MicroVMStateError,
+			restarts:    2,
+			want:        v1alpha1.MicroVMStateError,
+			wantBackoff: 40 * time.Second,
+		},
+		{
+			name:     "default restart limit used up",
+			state:    v1alpha1.MicroVMStateError,
+			restarts: defaultMaxRestarts,
+			want:     v1alpha1.MicroVMStateFailed,
+		},
+		{
+			name:        "restart limit of the spec used up",
+			state:       v1alpha1.MicroVMStateError,
+			maxRestarts: &limit,
+			restarts:    limit,
+			want:        v1alpha1.MicroVMStateFailed,
+		},
+		{
+			name:   "never restarted",
+			policy: v1alpha1.RestartPolicyNever,
+			state:  v1alpha1.MicroVMStateError,
+			want:   v1alpha1.MicroVMStateFailed,
+		},
+		{
+			name:  "stopped stays stopped",
+			state: v1alpha1.MicroVMStateStopped,
+			want:  v1alpha1.MicroVMStateStopped,
+		},
+		{
+			name:        "stopped restarted always",
+			policy:      v1alpha1.RestartPolicyAlways,
+			state:       v1alpha1.MicroVMStateStopped,
+			want:        v1alpha1.MicroVMStateStopped,
+			wantBackoff: 10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &v1alpha1.MicroVM{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default"},
+				Spec: v1alpha1.MicroVMSpec{
+					RestartPolicy: tt.policy,
+					MaxRestarts:   tt.maxRestarts,
+				},
+				Status: v1alpha1.MicroVMStatus{
+					State:    tt.state,
+					Restarts: tt.restarts,
+					Error:    "VM crashed",
+				},
+			}
+			r := newTestReconciler(t, instance)
+
+			result, err := r.handleRestart(context.Background(), instance)
+			if err != nil {
+				t.Fatalf("handleRestart() error = %v", err)
+			}
+			if result.RequeueAfter != tt.wantBackoff {
+				t.Errorf("handleRestart() requeues after %s, want %s", result.RequeueAfter, tt.wantBackoff)
+			}
+
+			got := &v1alpha1.MicroVM{}
+			if err := r.client.Get(context.Background(), types.NamespacedName{Name: "vm", Namespace: "default"}, got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status.State != tt.want {
+				t.Errorf("handleRestart() moved the VM to %s, want %s", got.Status.State, tt.want)
+			}
+			if tt.want == v1alpha1.MicroVMStateFailed && !strings.Contains(got.Status.Error, "VM crashed") {
+				t.Errorf("handleRestart() set error %q, want the cause kept", got.Status.Error)
+			}
+			if tt.wantBackoff > 0 && got.Status.NextRetryTime == nil {
+				t.Errorf("handleRestart() didn't record the next retry time")
+			}
+		})
+	}
+}
+
+func TestHandleRestartRecreates(t *testing.T) {
+	instance := &v1alpha1.MicroVM{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default"},
+		Status: v1alpha1.MicroVMStatus{
+			State:         v1alpha1.MicroVMStateError,
+			Restarts:      1,
+			Node:          "node-1",
+			NextRetryTime: &metav1.Time{Time: time.Now().Add(-time.Second)},
+		},
+	}
+	r := newTestReconciler(t, instance)
+
+	if _, err := r.handleRestart(context.Background(), instance); err != nil {
+		t.Fatalf("handleRestart() error = %v", err)
+	}
+
+	got := &v1alpha1.MicroVM{}
+	if err := r.client.Get(context.Background(), types.NamespacedName{Name: "vm", Namespace: "default"}, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.State != "" || got.Status.Node != "" {
+		t.Errorf("handleRestart() left state %q on node %q, want the VM reset to be placed again", got.Status.State, got.Status.Node)
+	}
+	if got.Status.Restarts != 2 || got.Status.LastRestartTime == nil || got.Status.NextRetryTime != nil {
+		t.Errorf("handleRestart() recorded %d restarts at %v, next at %v, want 2 restarts now", got.Status.Restarts, got.Status.LastRestartTime, got.Status.NextRetryTime)
+	}
+}
+
+// newTestReconciler returns a MicroVM reconciler backed by a fake client holding objects
+func newTestReconciler(t *testing.T, instance *v1alpha1.MicroVM) *ReconcileMicroVM {
+	t.Helper()
+	c := newFakeClient(t, instance)
+	if err := c.Get(context.Background(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, instance); err != nil {
+		t.Fatal(err)
+	}
+	return &ReconcileMicroVM{
+		client:         c,
+		scheme:         c.Scheme(),
+		recorder:       record.NewFakeRecorder(100),
+		balloonRetries: newRetryTracker(),
+	}
+}
+
+// duration returns a pointer to d
+func duration(d time.Duration) *time.Duration {
+	return &d
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// retryTracker backs off an action that keeps failing for an object, such as
+// resizing the balloon of a MicroVM. An attempt is keyed by its object and the
+// value it applies, a new value is tried right away.
+type retryTracker struct {
+	mu      sync.Mutex
+	retries map[types.UID]*retry
+}
+
+// retry is the backoff of the failed attempts to apply a value
+type retry struct {
+	value    int
+	failures int32
+	next     time.Time
+}
+
+// newRetryTracker creates an empty retry tracker
+func newRetryTracker() *retryTracker {
+	return &retryTracker{retries: map[types.UID]*retry{}}
+}
+
+// due reports whether value can be applied to the object now
+func (t *retryTracker) due(uid types.UID, value int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.retries[uid]
+	return !ok || r.value != value || !time.Now().Before(r.next)
+}
+
+// failed records a failed attempt and returns the delay before the next one
+func (t *retryTracker) failed(uid types.UID, value int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.retries[uid]
+	if !ok || r.value != value {
+		r = &retry{value: value}
+		t.retries[uid] = r
+	}
+	backoff := restartBackoff(r.failures)
+	r.failures++
+	r.next = time.Now().Add(backoff)
+	return backoff
+}
+
+// forget drops the failed attempts of the object
+func (t *retryTracker) forget(uid types.UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.retries, uid)
+}
+
+// reportTracker remembers the objects a lasting problem was reported for, so
+// it is recorded once instead of on every reconcile
+type reportTracker struct {
+	mu       sync.Mutex
+	reported map[types.UID]bool
+}
+
+// newReportTracker creates an empty report tracker
+func newReportTracker() *reportTracker {
+	return &reportTracker{reported: map[types.UID]bool{}}
+}
+
+// first reports whether the problem wasn't reported for the object yet, and
+// remembers that it is now
+func (t *reportTracker) first(uid types.UID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reported[uid] {
+		return false
+	}
+	t.reported[uid] = true
+	return true
+}
+
+// forget drops the reports of the object
+func (t *reportTracker) forget(uid types.UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.reported, uid)
+}
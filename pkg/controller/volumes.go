@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/flintlock"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// defaultWorkspaceMountPath is where the session workspace is mounted in the VM
+	defaultWorkspaceMountPath = "/workspace"
+
+	// workspaceVolumeName is the name of the session workspace volume
+	workspaceVolumeName = "workspace"
+)
+
+// ensureVolumes records the backing files of the file backed volumes of a
+// MicroVM in its status. The host agent of the node the VM is placed on
+// creates or grows them within its volume directory, and reuses existing
+// ones, so their data survives the VM being recreated. Paths are derived from
+// the namespace of the VM, and the workspace from the session owning it.
+func (r *ReconcileMicroVM) ensureVolumes(ctx context.Context, instance *v1alpha1.MicroVM) error {
+	if err := flintlock.ValidateVolumes(instance.Spec.Volumes); err != nil {
+		return err
+	}
+
+	statuses := make([]v1alpha1.VolumeStatus, 0, len(instance.Spec.Volumes))
+	for i := range instance.Spec.Volumes {
+		vol := &instance.Spec.Volumes[i]
+		path := flintlock.VolumePath(vol, instance.Namespace)
+		if vol.Source.Workspace != nil {
+			session := sessionOwner(instance)
+			if session == "" {
+				return fmt.Errorf("volume %s: only the VMs of MCP sessions have a workspace", vol.Name)
+			}
+			path = flintlock.WorkspacePath(instance.Namespace, session)
+		}
+		statuses = append(statuses, v1alpha1.VolumeStatus{
+			Name:   vol.Name,
+			Path:   path,
+			SizeMB: vol.SizeMB,
+		})
+	}
+
+	instance.Status.Volumes = statuses
+	return nil
+}
+
+// deleteWorkspace deletes the workspace file of the session owning a MicroVM
+// once the session is gone. The VMs of a session reuse its workspace, so it is
+// kept as long as the session exists.
+func (r *ReconcileMicroVM) deleteWorkspace(ctx context.Context, instance *v1alpha1.MicroVM) error {
+	path := ""
+	for _, vol := range instance.Status.Volumes {
+		if vol.Name == workspaceVolumeName {
+			path = vol.Path
+		}
+	}
+	if path == "" {
+		return nil
+	}
+
+	for _, owner := range instance.OwnerReferences {
+		if owner.Kind != "MCPSession" {
+			continue
+		}
+		session := &v1alpha1.MCPSession{}
+		err := r.client.Get(ctx, types.NamespacedName{Name: owner.Name, Namespace: instance.Namespace}, session)
+		if err == nil && session.UID == owner.UID && session.DeletionTimestamp == nil {
+			return nil
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		backend, err := r.backends.forMicroVM(ctx, instance)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+		defer cancel()
+		return backend.DeleteVolume(ctx, instance.Namespace, path)
+	}
+	return nil
+}
+
+// sessionOwner returns the name of the MCPSession owning a MicroVM, empty if
+// it has none. Owners are in the namespace of the VM.
+func sessionOwner(instance *v1alpha1.MicroVM) string {
+	for _, owner := range instance.OwnerReferences {
+		if owner.Kind == "MCPSession" {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
+// workspaceVolume returns the MicroVM volume for the workspace of a session
+func workspaceVolume(session *v1alpha1.MCPSession) v1alpha1.Volume {
+	mountPath := session.Spec.Workspace.MountPath
+	if mountPath == "" {
+		mountPath = defaultWorkspaceMountPath
+	}
+
+	return v1alpha1.Volume{
+		Name:      workspaceVolumeName,
+		SizeMB:    session.Spec.Workspace.SizeMB,
+		MountPath: mountPath,
+		Source: v1alpha1.VolumeSource{
+			Workspace: &v1alpha1.WorkspaceVolumeSource{},
+		},
+	}
+}
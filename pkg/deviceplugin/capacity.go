@@ -0,0 +1,227 @@
+package deviceplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// AllocatableVCPUAnnotation is the number of vCPUs of a node available to VMs
+	AllocatableVCPUAnnotation = "vvm.tvm.github.com/allocatable-vcpu"
+	// AllocatableMemoryAnnotation is the memory in MB of a node available to VMs
+	AllocatableMemoryAnnotation = "vvm.tvm.github.com/allocatable-memory-mb"
+	// CPUModelAnnotation is the CPU model of a node
+	CPUModelAnnotation = "vvm.tvm.github.com/cpu-model"
+	// KVMCapabilitiesAnnotation lists the KVM capabilities of a node Firecracker needs and it supports
+	KVMCapabilitiesAnnotation = "vvm.tvm.github.com/kvm-capabilities"
+	// HugepagesFreeAnnotation is the free hugepage memory of a node in MB
+	HugepagesFreeAnnotation = "vvm.tvm.github.com/hugepages-free-mb"
+	// HugepagesTotalAnnotation is the hugepage memory of a node in MB
+	HugepagesTotalAnnotation = "vvm.tvm.github.com/hugepages-total-mb"
+	// RunningVMsAnnotation is the number of VMs running on a node
+	RunningVMsAnnotation = "vvm.tvm.github.com/running-vms"
+	// CapacityUpdatedAnnotation is when the capacity of a node was last reported
+	CapacityUpdatedAnnotation = "vvm.tvm.github.com/capacity-updated"
+
+	// DefaultVMDir is the directory flintlock keeps a directory per VM in
+	DefaultVMDir = "/var/lib/flintlock/vms"
+)
+
+// NodeCapacity is the VM capacity of a node
+type NodeCapacity struct {
+	CPUModel         string
+	KVMCapabilities  []string
+	HugepagesFreeMB  int64
+	HugepagesTotalMB int64
+	// AllocatableVCPU and AllocatableMemoryMB are available to VMs
+	AllocatableVCPU     int64
+	AllocatableMemoryMB int64
+	RunningVMs          int
+}
+
+// Annotations returns the node annotations reporting the capacity
+func (c *NodeCapacity) Annotations() map[string]string {
+	return map[string]string{
+		AllocatableVCPUAnnotation:   strconv.FormatInt(c.AllocatableVCPU, 10),
+		AllocatableMemoryAnnotation: strconv.FormatInt(c.AllocatableMemoryMB, 10),
+		CPUModelAnnotation:          c.CPUModel,
+		KVMCapabilitiesAnnotation:   strings.Join(c.KVMCapabilities, ","),
+		HugepagesFreeAnnotation:     strconv.FormatInt(c.HugepagesFreeMB, 10),
+		HugepagesTotalAnnotation:    strconv.FormatInt(c.HugepagesTotalMB, 10),
+		RunningVMsAnnotation:        strconv.Itoa(c.RunningVMs),
+		CapacityUpdatedAnnotation:   time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// CapacityReporter periodically publishes the VM capacity of its node as
+// annotations of the Node, where lime-ctrl picks it up for placement
+type CapacityReporter struct {
+	client   kubernetes.Interface
+	nodeName string
+	// VMDir holds a directory per VM with the API socket of its Firecracker process
+	VMDir string
+	// ReservedVCPU and ReservedMemoryMB are kept for the host rather than VMs
+	ReservedVCPU     int64
+	ReservedMemoryMB int64
+}
+
+// NewCapacityReporter creates a reporter annotating the node nodeName
+func NewCapacityReporter(client kubernetes.Interface, nodeName string) *CapacityReporter {
+	return &CapacityReporter{
+		client:   client,
+		nodeName: nodeName,
+		VMDir:    DefaultVMDir,
+	}
+}
+
+// Run reports the capacity every interval until stop is closed
+func (r *CapacityReporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Report(context.Background()); err != nil {
+			klog.Errorf("Failed to report node capacity: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Report measures the capacity and annotates the node with it
+func (r *CapacityReporter) Report(ctx context.Context) error {
+	capacity, err := r.Measure()
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": capacity.Annotations(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode patch: %v", err)
+	}
+	if _, err := r.client.CoreV1().Nodes().Patch(ctx, r.nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to annotate node %s: %v", r.nodeName, err)
+	}
+	return nil
+}
+
+// Measure returns the current capacity of the node
+func (r *CapacityReporter) Measure() (*NodeCapacity, error) {
+	info, err := meminfo()
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := &NodeCapacity{
+		CPUModel:            cpuModel(),
+		AllocatableVCPU:     int64(runtime.NumCPU()) - r.ReservedVCPU,
+		AllocatableMemoryMB: info["MemTotal"]/1024 - r.ReservedMemoryMB,
+		HugepagesFreeMB:     info["HugePages_Free"] * info["Hugepagesize"] / 1024,
+		HugepagesTotalMB:    info["HugePages_Total"] * info["Hugepagesize"] / 1024,
+		RunningVMs:          runningVMs(r.VMDir),
+	}
+	if capacity.AllocatableVCPU < 0 {
+		capacity.AllocatableVCPU = 0
+	}
+	if capacity.AllocatableMemoryMB < 0 {
+		capacity.AllocatableMemoryMB = 0
+	}
+
+	// An unusable KVM device supports none of the capabilities
+	if caps, err := SupportedCapabilities(NewHostDevice(KVMDevicePath), RequiredCapabilities()); err == nil {
+		capacity.KVMCapabilities = caps
+	} else {
+		klog.Warningf("Failed to check KVM capabilities: %v", err)
+	}
+
+	return capacity, nil
+}
+
+// meminfo returns the fields of /proc/meminfo, sizes in kB
+func meminfo() (map[string]int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read memory size: %v", err)
+	}
+	defer file.Close()
+
+	info := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			info[strings.TrimSuffix(fields[0], ":")] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read memory size: %v", err)
+	}
+	return info, nil
+}
+
+// cpuModel returns the CPU model of the node, the architecture if it isn't known
+func cpuModel() string {
+	data, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "model name") {
+				if i := strings.Index(line, ":"); i >= 0 {
+					return strings.TrimSpace(line[i+1:])
+				}
+			}
+		}
+	}
+	return runtime.GOARCH
+}
+
+// runningVMs counts the VMs in vmDir whose Firecracker process accepts
+// connections on its API socket
+func runningVMs(vmDir string) int {
+	entries, err := ioutil.ReadDir(vmDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Failed to list VMs in %s: %v", vmDir, err)
+		}
+		return 0
+	}
+
+	running := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		conn, err := net.DialTimeout("unix", filepath.Join(vmDir, entry.Name(), "firecracker.sock"), time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		running++
+	}
+	return running
+}
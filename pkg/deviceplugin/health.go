@@ -0,0 +1,200 @@
+package deviceplugin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// kvmAPIVersion is the stable KVM API version, the only one ever released
+	kvmAPIVersion = 12
+
+	// ioctls of the KVM device, _IO(KVMIO, nr) with KVMIO 0xAE
+	kvmGetAPIVersion  = 0xAE00
+	kvmCheckExtension = 0xAE03
+)
+
+// Capability is a KVM extension checked with KVM_CHECK_EXTENSION
+type Capability struct {
+	Name string
+	ID   uintptr
+}
+
+// RequiredCapabilities returns the KVM capabilities Firecracker needs on this architecture
+func RequiredCapabilities() []Capability {
+	common := []Capability{
+		{"KVM_CAP_USER_MEMORY", 3},
+		{"KVM_CAP_MP_STATE", 14},
+		{"KVM_CAP_IRQFD", 32},
+		{"KVM_CAP_IOEVENTFD", 36},
+	}
+	switch runtime.GOARCH {
+	case "arm64":
+		return append(common,
+			Capability{"KVM_CAP_ONE_REG", 70},
+			Capability{"KVM_CAP_DEVICE_CTRL", 89},
+			Capability{"KVM_CAP_ARM_PSCI_0_2", 102},
+		)
+	default:
+		return append(common,
+			Capability{"KVM_CAP_IRQCHIP", 0},
+			Capability{"KVM_CAP_SET_TSS_ADDR", 4},
+			Capability{"KVM_CAP_EXT_CPUID", 7},
+			Capability{"KVM_CAP_PIT2", 33},
+			Capability{"KVM_CAP_PIT_STATE2", 35},
+			Capability{"KVM_CAP_ADJUST_CLOCK", 39},
+			Capability{"KVM_CAP_VCPU_EVENTS", 41},
+			Capability{"KVM_CAP_DEBUGREGS", 50},
+			Capability{"KVM_CAP_XSAVE", 55},
+			Capability{"KVM_CAP_XCRS", 56},
+		)
+	}
+}
+
+// KVMDevice is the KVM device of a node, abstracted so the health check can
+// run against a fake device
+type KVMDevice interface {
+	// Open opens the device for ioctls
+	Open() (KVMHandle, error)
+}
+
+// KVMHandle is an open KVM device
+type KVMHandle interface {
+	// Ioctl issues an ioctl and returns its result
+	Ioctl(request, arg uintptr) (int, error)
+	Close() error
+}
+
+// NewHostDevice returns the KVM device at path
+func NewHostDevice(path string) KVMDevice {
+	return hostDevice(path)
+}
+
+// hostDevice is a KVM device node
+type hostDevice string
+
+// Open implements KVMDevice
+func (d hostDevice) Open() (KVMHandle, error) {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("KVM is only available on Linux")
+	}
+
+	fd, err := unix.Open(string(d), unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return hostHandle(fd), nil
+}
+
+// hostHandle is the file descriptor of an open KVM device
+type hostHandle int
+
+// Ioctl implements KVMHandle
+func (h hostHandle) Ioctl(request, arg uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(h), request, arg)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// Close implements KVMHandle
+func (h hostHandle) Close() error {
+	return unix.Close(int(h))
+}
+
+// CheckHealth opens the device and checks it speaks the stable KVM API and
+// supports caps. The error explains why the device can't run VMs.
+func CheckHealth(device KVMDevice, caps []Capability) error {
+	handle, err := device.Open()
+	if err != nil {
+		return openError("KVM device", "is virtualization enabled and the kvm module loaded?", err)
+	}
+	defer handle.Close()
+
+	version, err := handle.Ioctl(kvmGetAPIVersion, 0)
+	if err != nil {
+		return fmt.Errorf("KVM_GET_API_VERSION failed: %v", err)
+	}
+	if version != kvmAPIVersion {
+		return fmt.Errorf("unsupported KVM API version %d, expected %d", version, kvmAPIVersion)
+	}
+
+	var missing []string
+	for _, c := range caps {
+		supported, err := handle.Ioctl(kvmCheckExtension, c.ID)
+		if err != nil {
+			return fmt.Errorf("KVM_CHECK_EXTENSION %s failed: %v", c.Name, err)
+		}
+		if supported <= 0 {
+			missing = append(missing, c.Name)
+		}
+	}
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("KVM lacks capabilities Firecracker needs: %s", strings.Join(missing, ", "))
+		if nestedGuest() {
+			msg += " (the node is a virtual machine, nested virtualization may not expose them)"
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// SupportedCapabilities returns the names of caps the device supports
+func SupportedCapabilities(device KVMDevice, caps []Capability) ([]string, error) {
+	handle, err := device.Open()
+	if err != nil {
+		return nil, openError("KVM device", "is virtualization enabled and the kvm module loaded?", err)
+	}
+	defer handle.Close()
+
+	var supported []string
+	for _, c := range caps {
+		if n, err := handle.Ioctl(kvmCheckExtension, c.ID); err == nil && n > 0 {
+			supported = append(supported, c.Name)
+		}
+	}
+	return supported, nil
+}
+
+// CheckOpen checks the device node at path can be opened for reading and
+// writing. A missing node hints at module, which provides it.
+func CheckOpen(path, module string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return openError(path, fmt.Sprintf("is the %s module loaded?", module), err)
+	}
+	return file.Close()
+}
+
+// openError explains a failure to open a device
+func openError(device, missingHint string, err error) error {
+	switch {
+	case errors.Is(err, unix.ENOENT):
+		return fmt.Errorf("%s not found, %s %v", device, missingHint, err)
+	case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM):
+		return fmt.Errorf("permission denied opening %s, check its group and the device cgroup: %v", device, err)
+	}
+	return fmt.Errorf("failed to open %s: %v", device, err)
+}
+
+// nestedGuest reports whether the node itself runs under a hypervisor
+func nestedGuest() bool {
+	data, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "flags") {
+			return strings.Contains(line, " hypervisor")
+		}
+	}
+	return false
+}
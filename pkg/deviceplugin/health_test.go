@@ -0,0 +1,186 @@
+package deviceplugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeDevice is a KVM device answering ioctls from its fields
+type fakeDevice struct {
+	openErr error
+	version int
+	// caps are the supported capabilities by ID
+	caps map[uintptr]bool
+	// ioctlErr fails the ioctl with that request
+	ioctlErr map[uintptr]error
+
+	opened bool
+	closed bool
+}
+
+func (d *fakeDevice) Open() (KVMHandle, error) {
+	if d.openErr != nil {
+		return nil, d.openErr
+	}
+	d.opened = true
+	return d, nil
+}
+
+func (d *fakeDevice) Ioctl(request, arg uintptr) (int, error) {
+	if err := d.ioctlErr[request]; err != nil {
+		return -1, err
+	}
+	switch request {
+	case kvmGetAPIVersion:
+		return d.version, nil
+	case kvmCheckExtension:
+		if d.caps[arg] {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return -1, unix.EINVAL
+}
+
+func (d *fakeDevice) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestCheckHealth(t *testing.T) {
+	caps := []Capability{
+		{"KVM_CAP_USER_MEMORY", 3},
+		{"KVM_CAP_IRQFD", 32},
+	}
+	all := map[uintptr]bool{3: true, 32: true}
+
+	tests := []struct {
+		name   string
+		device *fakeDevice
+		// want is a substring of the error, empty for a healthy device
+		want string
+	}{
+		{
+			name:   "healthy",
+			device: &fakeDevice{version: kvmAPIVersion, caps: all},
+		},
+		{
+			name:   "wrong API version",
+			device: &fakeDevice{version: 11, caps: all},
+			want:   "unsupported KVM API version 11, expected 12",
+		},
+		{
+			name:   "missing capability",
+			device: &fakeDevice{version: kvmAPIVersion, caps: map[uintptr]bool{3: true}},
+			want:   "KVM lacks capabilities Firecracker needs: KVM_CAP_IRQFD",
+		},
+		{
+			name:   "missing capabilities",
+			device: &fakeDevice{version: kvmAPIVersion},
+			want:   "KVM lacks capabilities Firecracker needs: KVM_CAP_USER_MEMORY, KVM_CAP_IRQFD",
+		},
+		{
+			name:   "device not found",
+			device: &fakeDevice{openErr: unix.ENOENT},
+			want:   "KVM device not found, is virtualization enabled and the kvm module loaded?",
+		},
+		{
+			name:   "permission denied",
+			device: &fakeDevice{openErr: unix.EACCES},
+			want:   "permission denied opening KVM device",
+		},
+		{
+			name:   "operation not permitted",
+			device: &fakeDevice{openErr: unix.EPERM},
+			want:   "permission denied opening KVM device",
+		},
+		{
+			name:   "other open error",
+			device: &fakeDevice{openErr: errors.New("device busy")},
+			want:   "failed to open KVM device: device busy",
+		},
+		{
+			name:   "API version ioctl fails",
+			device: &fakeDevice{ioctlErr: map[uintptr]error{kvmGetAPIVersion: unix.ENOTTY}},
+			want:   "KVM_GET_API_VERSION failed",
+		},
+		{
+			name:   "extension ioctl fails",
+			device: &fakeDevice{version: kvmAPIVersion, ioctlErr: map[uintptr]error{kvmCheckExtension: unix.ENOTTY}},
+			want:   "KVM_CHECK_EXTENSION KVM_CAP_USER_MEMORY failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckHealth(tt.device, caps)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("CheckHealth() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("CheckHealth() = %v, want error containing %q", err, tt.want)
+			}
+			if tt.device.opened && !tt.device.closed {
+				t.Errorf("CheckHealth() left the device open")
+			}
+		})
+	}
+}
+
+func TestSupportedCapabilities(t *testing.T) {
+	caps := []Capability{
+		{"KVM_CAP_USER_MEMORY", 3},
+		{"KVM_CAP_IRQFD", 32},
+		{"KVM_CAP_PIT2", 33},
+	}
+
+	tests := []struct {
+		name   string
+		device *fakeDevice
+		want   []string
+		// wantErr is a substring of the error, empty if none is expected
+		wantErr string
+	}{
+		{
+			name:   "some supported",
+			device: &fakeDevice{version: kvmAPIVersion, caps: map[uintptr]bool{3: true, 33: true}},
+			want:   []string{"KVM_CAP_USER_MEMORY", "KVM_CAP_PIT2"},
+		},
+		{
+			name:   "none supported",
+			device: &fakeDevice{version: kvmAPIVersion},
+		},
+		{
+			name:    "device not found",
+			device:  &fakeDevice{openErr: unix.ENOENT},
+			wantErr: "KVM device not found",
+		},
+		{
+			name:    "permission denied",
+			device:  &fakeDevice{openErr: unix.EACCES},
+			wantErr: "permission denied opening KVM device",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SupportedCapabilities(tt.device, caps)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SupportedCapabilities() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SupportedCapabilities() error = %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("SupportedCapabilities() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
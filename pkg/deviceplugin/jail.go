@@ -0,0 +1,175 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// DefaultJailerRoot is where the jailer chroots of the slots are created on the host
+	DefaultJailerRoot = "/var/lib/tvm/jailer"
+	// DefaultCgroupRoot is the cgroup v2 slice the cgroups of the slots are created in
+	DefaultCgroupRoot = "/sys/fs/cgroup/tvm.slice"
+	// DefaultBaseUID is the UID of the first slot, every slot runs under its own
+	DefaultBaseUID = 100000
+	// UIDsPerSlot is the size of the UID range of a slot. The slot owns its
+	// jail with the first UID and its VMs run under the others.
+	UIDsPerSlot = 1000
+
+	// JailerContainerRoot is where the jailer chroot of a slot is mounted in the container
+	JailerContainerRoot = "/srv/jailer"
+
+	// Environment variables telling the container about its slot
+	EnvJailerRoot     = "TVM_JAILER_ROOT"
+	EnvJailerUID      = "TVM_JAILER_UID"
+	EnvJailerGID      = "TVM_JAILER_GID"
+	EnvJailerUIDCount = "TVM_JAILER_UID_COUNT"
+	EnvCgroupParent   = "TVM_CGROUP_PARENT"
+	EnvNUMANode       = "TVM_NUMA_NODE"
+
+	// cgroupMountPath is where the cgroup v2 hierarchy is mounted
+	cgroupMountPath = "/sys/fs/cgroup"
+)
+
+// Jail prepares a jailer chroot and a cgroup per slot, owned by the UID of
+// the slot, so the VMs of different pods are isolated from each other
+type Jail struct {
+	// Root holds a chroot directory per slot
+	Root string
+	// CgroupRoot holds a cgroup per slot, empty to not create cgroups
+	CgroupRoot string
+	// BaseUID is the UID and GID of the first slot, each slot gets UIDsPerSlot UIDs
+	BaseUID int
+}
+
+// NewJail creates a jail with the default paths
+func NewJail() *Jail {
+	return &Jail{
+		Root:       DefaultJailerRoot,
+		CgroupRoot: DefaultCgroupRoot,
+		BaseUID:    DefaultBaseUID,
+	}
+}
+
+// uid returns the UID of a slot, the first of its range
+func (j *Jail) uid(slot int) int {
+	return j.BaseUID + slot*UIDsPerSlot
+}
+
+// chroot returns the host directory of the jailer chroot of a device
+func (j *Jail) chroot(id string) string {
+	return filepath.Join(j.Root, id)
+}
+
+// cgroup returns the host directory of the cgroup of a device
+func (j *Jail) cgroup(id string) string {
+	return filepath.Join(j.CgroupRoot, "tvm-"+id+".slice")
+}
+
+// Prepare creates the chroot and cgroup of a device, owned by its UID and
+// confined to its NUMA node
+func (j *Jail) Prepare(id string, node *numaNode) error {
+	slot := slotIndex(id)
+	if slot < 0 {
+		return fmt.Errorf("invalid device ID %q", id)
+	}
+	uid := j.uid(slot)
+
+	root := j.chroot(id)
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return fmt.Errorf("failed to create jailer root: %v", err)
+	}
+	if err := os.Chown(root, uid, uid); err != nil {
+		return fmt.Errorf("failed to chown jailer root: %v", err)
+	}
+
+	if j.CgroupRoot == "" {
+		return nil
+	}
+	return j.prepareCgroup(id, uid, node)
+}
+
+// prepareCgroup creates the cgroup of a device and delegates it to uid
+func (j *Jail) prepareCgroup(id string, uid int, node *numaNode) error {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(cgroupMountPath, "cgroup.controllers")); err != nil {
+		klog.Warningf("No cgroup v2 hierarchy at %s, not creating the cgroup of %s", cgroupMountPath, id)
+		return nil
+	}
+
+	if err := os.MkdirAll(j.CgroupRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %v", j.CgroupRoot, err)
+	}
+	// Let the cgroups of the slots limit CPUs and memory
+	if err := writeCgroup(j.CgroupRoot, "cgroup.subtree_control", "+cpuset +cpu +memory"); err != nil {
+		klog.Warningf("Failed to enable cgroup controllers in %s: %v", j.CgroupRoot, err)
+	}
+
+	cgroup := j.cgroup(id)
+	if err := os.MkdirAll(cgroup, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %v", cgroup, err)
+	}
+	if node != nil {
+		if err := writeCgroup(cgroup, "cpuset.mems", strconv.Itoa(node.ID)); err != nil {
+			klog.Warningf("Failed to confine %s to NUMA node %d: %v", id, node.ID, err)
+		}
+		if err := writeCgroup(cgroup, "cpuset.cpus", node.CPUs); err != nil {
+			klog.Warningf("Failed to confine %s to the CPUs of NUMA node %d: %v", id, node.ID, err)
+		}
+	}
+
+	// Delegate the cgroup, as described in cgroup-v2.rst
+	for _, name := range []string{"", "cgroup.procs", "cgroup.threads", "cgroup.subtree_control"} {
+		if err := os.Chown(filepath.Join(cgroup, name), uid, uid); err != nil {
+			return fmt.Errorf("failed to delegate cgroup %s: %v", cgroup, err)
+		}
+	}
+	return nil
+}
+
+// writeCgroup writes an interface file of a cgroup
+func writeCgroup(cgroup, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroup, name), []byte(value), 0644)
+}
+
+// Allocation returns the mount and environment of a container allocated
+// device id, telling it where its jailer chroot and cgroup are
+func (j *Jail) Allocation(id string, node *numaNode) ([]*pluginapi.Mount, map[string]string, error) {
+	// The chroot is mounted before PreStartContainer prepares it
+	if err := os.MkdirAll(j.chroot(id), 0750); err != nil {
+		return nil, nil, fmt.Errorf("failed to create jailer root: %v", err)
+	}
+
+	uid := strconv.Itoa(j.uid(slotIndex(id)))
+	mounts := []*pluginapi.Mount{
+		{
+			HostPath:      j.chroot(id),
+			ContainerPath: JailerContainerRoot,
+		},
+	}
+	envs := map[string]string{
+		EnvJailerRoot:     JailerContainerRoot,
+		EnvJailerUID:      uid,
+		EnvJailerGID:      uid,
+		EnvJailerUIDCount: strconv.Itoa(UIDsPerSlot - 1),
+	}
+	if j.CgroupRoot != "" {
+		if parent, err := filepath.Rel(cgroupMountPath, j.cgroup(id)); err == nil {
+			envs[EnvCgroupParent] = parent
+		}
+	}
+	if node != nil {
+		envs[EnvNUMANode] = strconv.Itoa(node.ID)
+	}
+	return mounts, envs, nil
+}
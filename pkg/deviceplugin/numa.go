@@ -0,0 +1,120 @@
+package deviceplugin
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nodeSysfsPath lists the NUMA nodes of the host
+const nodeSysfsPath = "/sys/devices/system/node"
+
+// numaNode is a NUMA node of the host
+type numaNode struct {
+	ID int
+	// CPUs is the cpulist of the node, as in cpuset.cpus
+	CPUs string
+}
+
+// hostNUMANodes returns the NUMA nodes of the host, none if it doesn't expose them
+func hostNUMANodes() []numaNode {
+	paths, err := filepath.Glob(filepath.Join(nodeSysfsPath, "node[0-9]*"))
+	if err != nil {
+		return nil
+	}
+
+	var nodes []numaNode
+	for _, path := range paths {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "node"))
+		if err != nil {
+			continue
+		}
+		cpus, err := ioutil.ReadFile(filepath.Join(path, "cpulist"))
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, numaNode{ID: id, CPUs: strings.TrimSpace(string(cpus))})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// slotNUMANode returns the NUMA node slots are spread over round robin, nil
+// without NUMA information
+func slotNUMANode(nodes []numaNode, slot int) *numaNode {
+	if len(nodes) == 0 || slot < 0 {
+		return nil
+	}
+	return &nodes[slot%len(nodes)]
+}
+
+// topology returns the topology of a slot reported to kubelet
+func topology(node *numaNode) *pluginapi.TopologyInfo {
+	if node == nil {
+		return nil
+	}
+	return &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(node.ID)}}}
+}
+
+// preferAllocation picks size devices of available, including mustInclude,
+// preferring devices on the same NUMA node as those already picked or else
+// the NUMA node with the most devices available
+func preferAllocation(nodes []numaNode, available, mustInclude []string, size int) []string {
+	picked := make(map[string]bool)
+	var result []string
+	for _, id := range mustInclude {
+		if !picked[id] {
+			picked[id] = true
+			result = append(result, id)
+		}
+	}
+
+	// Group the remaining devices by NUMA node
+	byNode := make(map[int][]string)
+	for _, id := range available {
+		if picked[id] {
+			continue
+		}
+		node := -1
+		if n := slotNUMANode(nodes, slotIndex(id)); n != nil {
+			node = n.ID
+		}
+		byNode[node] = append(byNode[node], id)
+	}
+
+	// Rank the NUMA nodes, the one of the devices already picked first
+	preferred := -1
+	if len(result) > 0 {
+		if n := slotNUMANode(nodes, slotIndex(result[0])); n != nil {
+			preferred = n.ID
+		}
+	}
+	var order []int
+	for node := range byNode {
+		order = append(order, node)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if (a == preferred) != (b == preferred) {
+			return a == preferred
+		}
+		if len(byNode[a]) != len(byNode[b]) {
+			return len(byNode[a]) > len(byNode[b])
+		}
+		return a < b
+	})
+
+	for _, node := range order {
+		for _, id := range byNode[node] {
+			if len(result) >= size {
+				return result
+			}
+			result = append(result, id)
+		}
+	}
+	return result
+}
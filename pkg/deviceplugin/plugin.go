@@ -0,0 +1,328 @@
+package deviceplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// healthResyncInterval is how often the health is checked without device events
+const healthResyncInterval = 5 * time.Minute
+
+// DevicePlugin implements the Kubernetes device plugin API for one resource.
+// It advertises a number of virtual devices that all map to the device node
+// of the resource, so several pods can share the device of a node.
+type DevicePlugin struct {
+	resource Resource
+	// slots is the number of devices advertised
+	slots int
+	// numa are the NUMA nodes the slots are spread over
+	numa   []numaNode
+	server *grpc.Server
+	stop   chan struct{}
+
+	// Jail prepares a jailer chroot and cgroup per slot, nil to hand out
+	// only the device
+	Jail *Jail
+}
+
+// NewDevicePlugin creates a device plugin advertising slots devices of resource
+func NewDevicePlugin(resource Resource, slots int) *DevicePlugin {
+	if slots < 1 {
+		slots = 1
+	}
+	return &DevicePlugin{
+		resource: resource,
+		slots:    slots,
+		numa:     hostNUMANodes(),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start starts the device plugin. A missing or unusable device doesn't stop
+// it, its devices are advertised as unhealthy until the device can be used.
+func (p *DevicePlugin) Start() error {
+	if err := p.resource.Check(); err != nil {
+		klog.Warningf("Device %s of %s is unusable: %v", p.resource.DevicePath, p.resource.Name, err)
+	}
+	socket := p.resource.Socket
+
+	// Remove the socket if it already exists
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove socket: %v", err)
+	}
+
+	// Create the socket
+	sock, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on socket: %v", err)
+	}
+
+	// Create the gRPC server
+	p.server = grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(p.server, p)
+
+	// Start the gRPC server
+	go func() {
+		if err := p.server.Serve(sock); err != nil {
+			klog.Errorf("Failed to serve: %v", err)
+		}
+	}()
+
+	// Wait for the server to start
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithTimeout(5*time.Second),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to socket: %v", err)
+	}
+	conn.Close()
+
+	// Register with kubelet
+	err = p.register()
+	if err != nil {
+		return fmt.Errorf("failed to register with kubelet: %v", err)
+	}
+
+	return nil
+}
+
+// Stop stops the device plugin and removes its socket, which deregisters it
+// from kubelet. A stopped plugin can't be started again.
+func (p *DevicePlugin) Stop() {
+	close(p.stop)
+	if p.server != nil {
+		p.server.Stop()
+	}
+	if err := os.Remove(p.resource.Socket); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove socket %s: %v", p.resource.Socket, err)
+	}
+}
+
+// register registers the device plugin with kubelet
+func (p *DevicePlugin) register() error {
+	conn, err := grpc.Dial(pluginapi.KubeletSocket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithTimeout(5*time.Second),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to kubelet: %v", err)
+	}
+	defer conn.Close()
+
+	client := pluginapi.NewRegistrationClient(conn)
+	req := &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     path.Base(p.resource.Socket),
+		ResourceName: p.resource.Name,
+	}
+
+	_, err = client.Register(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("failed to register with kubelet: %v", err)
+	}
+
+	return nil
+}
+
+// GetDevicePluginOptions returns the device plugin options
+func (p *DevicePlugin) GetDevicePluginOptions(ctx context.Context, empty *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                p.Jail != nil,
+		GetPreferredAllocationAvailable: true,
+	}, nil
+}
+
+// ListAndWatch lists devices and sends their health whenever it changes.
+// Changes of the device node are picked up through fsnotify, the health is also
+// checked periodically for changes without device events.
+func (p *DevicePlugin) ListAndWatch(empty *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %v", err)
+	}
+	defer watcher.Close()
+	// A missing device directory, like /dev/net before the tun module is
+	// loaded, leaves the devices unhealthy rather than failing the stream
+	dir := p.watch(watcher, "")
+
+	// Create the devices, the IDs and NUMA nodes only depend on the slot count
+	var devices []*pluginapi.Device
+	for i, id := range slotIDs(p.slots) {
+		devices = append(devices, &pluginapi.Device{ID: id, Topology: topology(slotNUMANode(p.numa, i))})
+	}
+
+	ticker := time.NewTicker(healthResyncInterval)
+	defer ticker.Stop()
+
+	health := ""
+	for {
+		// Send the devices when their health changed, all slots share it
+		current := p.health()
+		if current != health {
+			health = current
+			for _, device := range devices {
+				device.Health = health
+			}
+			if err := stream.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return fmt.Errorf("failed to send devices: %v", err)
+			}
+		}
+
+		select {
+		case <-p.stop:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Name != p.resource.DevicePath {
+				if !onPath(event.Name, path.Dir(p.resource.DevicePath)) {
+					continue
+				}
+				// A directory of the device was created or removed
+				dir = p.watch(watcher, dir)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			klog.Errorf("Device watcher error: %v", err)
+		case <-ticker.C:
+			dir = p.watch(watcher, dir)
+		}
+	}
+}
+
+// watch moves the watch from dir to the directory the device is in or, while
+// that doesn't exist, to the closest directory above it that does. It returns
+// the watched directory, empty if none is.
+func (p *DevicePlugin) watch(watcher *fsnotify.Watcher, dir string) string {
+	next := watchDir(p.resource.DevicePath)
+	if next == dir {
+		return dir
+	}
+	if err := watcher.Add(next); err != nil {
+		klog.Errorf("Failed to watch %s, checking %s every %s: %v", next, p.resource.DevicePath, healthResyncInterval, err)
+		return dir
+	}
+	if dir != "" {
+		// The watch of a removed directory is already gone
+		watcher.Remove(dir)
+	}
+	if next != path.Dir(p.resource.DevicePath) {
+		klog.Warningf("Directory of %s doesn't exist, watching %s until it does", p.resource.DevicePath, next)
+	}
+	return next
+}
+
+// watchDir returns the closest existing directory above a device
+func watchDir(device string) string {
+	dir := path.Dir(device)
+	for dir != "/" && dir != "." {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	return dir
+}
+
+// onPath returns whether name is dir or one of the directories above it
+func onPath(name, dir string) bool {
+	return name == dir || strings.HasPrefix(dir, name+"/")
+}
+
+// health checks the device and returns the health of the slots
+func (p *DevicePlugin) health() string {
+	if err := p.resource.Check(); err != nil {
+		klog.Warningf("Device %s of %s is unhealthy: %v", p.resource.DevicePath, p.resource.Name, err)
+		return pluginapi.Unhealthy
+	}
+	return pluginapi.Healthy
+}
+
+// Allocate allocates devices. Every slot maps to the device node of the
+// resource, so a container gets the device once however many slots it requested.
+func (p *DevicePlugin) Allocate(ctx context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	response := &pluginapi.AllocateResponse{
+		ContainerResponses: make([]*pluginapi.ContainerAllocateResponse, len(req.ContainerRequests)),
+	}
+
+	// Refuse to hand out an unusable device
+	if err := p.resource.Check(); err != nil {
+		return nil, err
+	}
+
+	for i, containerReq := range req.ContainerRequests {
+		// Create a container response
+		containerResp := &pluginapi.ContainerAllocateResponse{
+			Devices: []*pluginapi.DeviceSpec{
+				{
+					HostPath:      p.resource.DevicePath,
+					ContainerPath: p.resource.DevicePath,
+					Permissions:   "rw",
+				},
+			},
+		}
+
+		// The container runs its VMs in the jail of its first slot
+		if p.Jail != nil && len(containerReq.DevicesIDs) > 0 {
+			ids := append([]string(nil), containerReq.DevicesIDs...)
+			sort.Strings(ids)
+			mounts, envs, err := p.Jail.Allocation(ids[0], slotNUMANode(p.numa, slotIndex(ids[0])))
+			if err != nil {
+				return nil, err
+			}
+			containerResp.Mounts = mounts
+			containerResp.Envs = envs
+		}
+
+		response.ContainerResponses[i] = containerResp
+	}
+
+	return response, nil
+}
+
+// PreStartContainer prepares the jails of the devices of a container before it starts
+func (p *DevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if p.Jail == nil {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	for _, id := range req.DevicesIDs {
+		if err := p.Jail.Prepare(id, slotNUMANode(p.numa, slotIndex(id))); err != nil {
+			return nil, fmt.Errorf("failed to prepare jail of %s: %v", id, err)
+		}
+	}
+
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// GetPreferredAllocation prefers devices on a single NUMA node, so the VMs of
+// a container share their memory and CPUs with its devices
+func (p *DevicePlugin) GetPreferredAllocation(ctx context.Context, req *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	response := &pluginapi.PreferredAllocationResponse{}
+	for _, containerReq := range req.ContainerRequests {
+		ids := preferAllocation(p.numa, containerReq.AvailableDeviceIDs, containerReq.MustIncludeDeviceIDs, int(containerReq.AllocationSize))
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: ids})
+	}
+	return response, nil
+}
@@ -0,0 +1,147 @@
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeStream is a ListAndWatch stream passing the health of the sent devices on
+type fakeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan []string
+}
+
+func (s *fakeStream) Send(resp *pluginapi.ListAndWatchResponse) error {
+	var health []string
+	for _, device := range resp.Devices {
+		health = append(health, device.Health)
+	}
+	s.sent <- health
+	return nil
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestWatchDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dev", "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dev", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		want   string
+	}{
+		{name: "directory exists", device: "dev/net/tun", want: "dev/net"},
+		{name: "directory missing", device: "dev/vhost/vsock", want: "dev"},
+		{name: "directories missing", device: "dev/a/b/c", want: "dev"},
+		{name: "file in the way", device: "dev/file/tun", want: "dev"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := watchDir(filepath.Join(root, tt.device))
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("watchDir() = %s, want %s", got, want)
+			}
+		})
+	}
+
+	if got := watchDir("/nonexistent/net/tun"); got != "/" {
+		t.Errorf("watchDir() = %s, want /", got)
+	}
+}
+
+func TestOnPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "/dev/net", want: true},
+		{name: "/dev", want: true},
+		{name: "/dev/ne", want: false},
+		{name: "/dev/net/tun", want: false},
+		{name: "/dev/kvm", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := onPath(tt.name, "/dev/net"); got != tt.want {
+				t.Errorf("onPath(%s) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListAndWatchMissingDirectory(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "net", "tun")
+	p := NewDevicePlugin(Resource{
+		Name:       "test/tun",
+		DevicePath: device,
+		Check: func() error {
+			_, err := os.Stat(device)
+			return err
+		},
+	}, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeStream{ctx: ctx, sent: make(chan []string, 10)}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+
+	expect := func(health string) {
+		t.Helper()
+		select {
+		case devices := <-stream.sent:
+			if len(devices) != 2 {
+				t.Fatalf("sent %d devices, want 2", len(devices))
+			}
+			for i, got := range devices {
+				if got != health {
+					t.Fatalf("device %d is %s, want %s", i, got, health)
+				}
+			}
+		case err := <-done:
+			t.Fatalf("ListAndWatch() returned %v, want the stream kept open", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no devices sent, want them %s", health)
+		}
+	}
+
+	// The device comes up with its directory
+	expect(pluginapi.Unhealthy)
+	if err := os.MkdirAll(filepath.Dir(device), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect(pluginapi.Healthy)
+
+	// And goes down with it
+	if err := os.RemoveAll(filepath.Dir(device)); err != nil {
+		t.Fatal(err)
+	}
+	expect(pluginapi.Unhealthy)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListAndWatch() = %v", err)
+	}
+}
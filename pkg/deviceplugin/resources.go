@@ -0,0 +1,83 @@
+package deviceplugin
+
+import (
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// KVMDevicePath is the path to the KVM device
+	KVMDevicePath = "/dev/kvm"
+	// VhostVsockDevicePath is the path to the vhost-vsock device
+	VhostVsockDevicePath = "/dev/vhost-vsock"
+	// TunDevicePath is the path to the TUN/TAP device
+	TunDevicePath = "/dev/net/tun"
+
+	// SocketPath is the path to the device plugin socket of KVM
+	SocketPath = pluginapi.DevicePluginPath + "kvm.sock"
+	// VhostVsockSocketPath is the path to the device plugin socket of vhost-vsock
+	VhostVsockSocketPath = pluginapi.DevicePluginPath + "kvm-vhost-vsock.sock"
+	// TunSocketPath is the path to the device plugin socket of TUN/TAP
+	TunSocketPath = pluginapi.DevicePluginPath + "kvm-tun.sock"
+
+	// ResourceName is the name of the KVM resource
+	ResourceName = "kvm.tvm.github.com/kvm"
+	// VhostVsockResourceName is the name of the vhost-vsock resource
+	VhostVsockResourceName = "kvm.tvm.github.com/vhost-vsock"
+	// TunResourceName is the name of the TUN/TAP resource
+	TunResourceName = "kvm.tvm.github.com/tun"
+)
+
+// Resource is a host device advertised under its own resource name
+type Resource struct {
+	// Name is the extended resource name pods request
+	Name string
+	// Socket is the path of the plugin socket in the kubelet plugin directory
+	Socket string
+	// DevicePath is the device node mounted into containers at the same path
+	DevicePath string
+	// Check returns why the device can't be used, nil when it is healthy
+	Check func() error
+}
+
+// KVMResource returns the KVM device, healthy when it supports what Firecracker needs
+func KVMResource() Resource {
+	device := NewHostDevice(KVMDevicePath)
+	caps := RequiredCapabilities()
+	return Resource{
+		Name:       ResourceName,
+		Socket:     SocketPath,
+		DevicePath: KVMDevicePath,
+		Check: func() error {
+			return CheckHealth(device, caps)
+		},
+	}
+}
+
+// VhostVsockResource returns the vhost-vsock device used for vsock
+func VhostVsockResource() Resource {
+	return Resource{
+		Name:       VhostVsockResourceName,
+		Socket:     VhostVsockSocketPath,
+		DevicePath: VhostVsockDevicePath,
+		Check: func() error {
+			return CheckOpen(VhostVsockDevicePath, "vhost_vsock")
+		},
+	}
+}
+
+// TunResource returns the TUN/TAP device used for VM networking
+func TunResource() Resource {
+	return Resource{
+		Name:       TunResourceName,
+		Socket:     TunSocketPath,
+		DevicePath: TunDevicePath,
+		Check: func() error {
+			return CheckOpen(TunDevicePath, "tun")
+		},
+	}
+}
+
+// Resources returns all devices a pod hosting VMs needs
+func Resources() []Resource {
+	return []Resource{KVMResource(), VhostVsockResource(), TunResource()}
+}
@@ -0,0 +1,113 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultSlotStatePath is where the derived slot count is kept between restarts
+	DefaultSlotStatePath = "/var/lib/tvm/kvm-device-plugin/slots"
+
+	// DefaultSlotMemoryMB is the memory of a VM assumed when deriving the slot count
+	DefaultSlotMemoryMB = 512
+
+	// slotIDPrefix prefixes the IDs of the advertised slots
+	slotIDPrefix = "kvm-"
+)
+
+// ResolveSlots returns the number of KVM slots to advertise. A positive
+// requested count is used as is. Otherwise the count is derived from the CPUs
+// and memory of the node once and kept in statePath, so the same devices are
+// advertised after restarts of the plugin or kubelet.
+func ResolveSlots(requested int, statePath string, vmMemoryMB int) (int, error) {
+	if requested > 0 {
+		return requested, nil
+	}
+
+	if data, err := ioutil.ReadFile(statePath); err == nil {
+		slots, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && slots > 0 {
+			return slots, nil
+		}
+		klog.Warningf("Ignoring invalid slot count in %s: %q", statePath, string(data))
+	} else if !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read slot count: %v", err)
+	}
+
+	slots, err := hostSlots(vmMemoryMB)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create slot state directory: %v", err)
+	}
+	if err := ioutil.WriteFile(statePath, []byte(strconv.Itoa(slots)+"\n"), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write slot count: %v", err)
+	}
+	klog.Infof("Derived %d KVM slots from the node resources", slots)
+	return slots, nil
+}
+
+// hostSlots returns how many VMs of vmMemoryMB fit the CPUs and memory of the node
+func hostSlots(vmMemoryMB int) (int, error) {
+	if vmMemoryMB <= 0 {
+		vmMemoryMB = DefaultSlotMemoryMB
+	}
+
+	memoryMB, err := hostMemoryMB()
+	if err != nil {
+		return 0, err
+	}
+
+	slots := runtime.NumCPU()
+	if byMemory := int(memoryMB / int64(vmMemoryMB)); byMemory < slots {
+		slots = byMemory
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	return slots, nil
+}
+
+// hostMemoryMB returns the total memory of the node
+func hostMemoryMB() (int64, error) {
+	info, err := meminfo()
+	if err != nil {
+		return 0, err
+	}
+	kb, ok := info["MemTotal"]
+	if !ok {
+		return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+	}
+	return kb / 1024, nil
+}
+
+// slotIDs returns the IDs of slots slots, the same for the same count
+func slotIDs(slots int) []string {
+	ids := make([]string, slots)
+	for i := range ids {
+		ids[i] = slotIDPrefix + strconv.Itoa(i)
+	}
+	return ids
+}
+
+// slotIndex returns the index of the slot id, -1 if it isn't a slot ID
+func slotIndex(id string) int {
+	if !strings.HasPrefix(id, slotIDPrefix) {
+		return -1
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(id, slotIDPrefix))
+	if err != nil || index < 0 {
+		return -1
+	}
+	return index
+}
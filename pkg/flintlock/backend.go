@@ -0,0 +1,35 @@
+package flintlock
+
+import (
+	"context"
+	"time"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+)
+
+// Backend runs the VMs of MicroVMs on a node. It is implemented by the
+// Flintlock client and the host agent client.
+type Backend interface {
+	// CreateMicroVM creates the VM of a MicroVM and records its ID in the status
+	CreateMicroVM(ctx context.Context, vm *v1alpha1.MicroVM) error
+	// DeleteMicroVM deletes a VM
+	DeleteMicroVM(ctx context.Context, vmID string) error
+	// UpdateMicroVMStatus updates the status of a MicroVM from its VM
+	UpdateMicroVMStatus(ctx context.Context, vm *v1alpha1.MicroVM) error
+	// WatchMicroVMs publishes the state changes of all VMs until ctx is done
+	WatchMicroVMs(ctx context.Context, interval time.Duration) <-chan VMEvent
+	// PauseMicroVM pauses a running VM
+	PauseMicroVM(ctx context.Context, vmID string) error
+	// ResumeMicroVM resumes a paused VM
+	ResumeMicroVM(ctx context.Context, vmID string) error
+	// ResizeBalloon inflates or deflates the memory balloon of a VM to amountMB
+	ResizeBalloon(ctx context.Context, vmID string, amountMB int) error
+	// DeleteVolume deletes the backing file of a volume of namespace, relative to the volume directory
+	DeleteVolume(ctx context.Context, namespace, path string) error
+	// ExecuteCode executes code in a VM
+	ExecuteCode(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error)
+	// Close closes the connection to the backend
+	Close() error
+}
+
+var _ Backend = &Client{}
@@ -0,0 +1,44 @@
+package flintlock
+
+import (
+	"fmt"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+)
+
+// BalloonAmount returns the size in MB of the memory balloon of a MicroVM,
+// the memory above its memory target. It is 0 without a target.
+func BalloonAmount(vm *v1alpha1.MicroVM) int {
+	if vm.Spec.MemoryTarget == nil {
+		return 0
+	}
+	amount := memoryMB(vm) - int(*vm.Spec.MemoryTarget)
+	if amount < 0 {
+		return 0
+	}
+	return amount
+}
+
+// ValidateBalloon checks that the memory target of a MicroVM has a balloon
+// to reclaim memory with and fits in the memory of the VM
+func ValidateBalloon(vm *v1alpha1.MicroVM) error {
+	if vm.Spec.MemoryTarget == nil {
+		return nil
+	}
+	if vm.Spec.Balloon == nil {
+		return fmt.Errorf("memoryTarget requires a balloon")
+	}
+	target, memory := int(*vm.Spec.MemoryTarget), memoryMB(vm)
+	if target < 1 || target > memory {
+		return fmt.Errorf("memoryTarget of %d MB must be between 1 MB and the %d MB of memory of the VM", target, memory)
+	}
+	return nil
+}
+
+// memoryMB returns the memory of a MicroVM in MB, 512 if not set
+func memoryMB(vm *v1alpha1.MicroVM) int {
+	if vm.Spec.Memory == 0 {
+		return 512
+	}
+	return int(vm.Spec.Memory)
+}
@@ -7,11 +7,18 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/audit"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/anypb"
 
 	flintlockv1 "github.com/liquidmetal-dev/flintlock/api/services/microvm/v1alpha1"
@@ -24,34 +31,80 @@ type Client struct {
 	endpoint string
 	client   flintlockv1.MicroVMClient
 	conn     *grpc.ClientConn
+	// caller retries calls and breaks the circuit to the endpoint
+	caller *Caller
+	// creds reloads the TLS certificates and token, nil without TLS
+	creds *credentialFiles
+	// healthy is the result of the last health check
+	healthy atomic.Bool
+	stopCh  chan struct{}
+	// audit records the executions, nil to not record them
+	audit *audit.Logger
 	// For non-Linux platforms
 	mockVMs map[string]*v1alpha1.MicroVM
 }
 
 // NewClient creates a new Flintlock client
-func NewClient(endpoint string) (*Client, error) {
+func NewClient(endpoint string, opts ClientOptions) (*Client, error) {
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		log.Warn("Flintlock is only fully supported on Linux. Using mock implementation.")
 		return &Client{
 			endpoint: endpoint,
+			stopCh:   make(chan struct{}),
+			audit:    opts.Audit,
 			mockVMs:  make(map[string]*v1alpha1.MicroVM),
 		}, nil
 	}
 
-	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid flintlock client options: %v", err)
+	}
+
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	var creds *credentialFiles
+	if opts.TLS {
+		var err error
+		creds, err = newCredentialFiles(opts)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(creds.tlsConfig()))}
+		if opts.TokenFile != "" {
+			dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(creds.tokenCredentials()))
+		}
+	} else {
+		log.Warnf("Connecting to flintlock at %s without TLS", endpoint)
+	}
+
+	// Propagate the trace context and trace every call
+	dialOpts = append(dialOpts, grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+
+	conn, err := grpc.NewClient(endpoint, dialOpts...)
 	if err != nil {
+		if creds != nil {
+			creds.Close()
+		}
 		return nil, fmt.Errorf("failed to connect to flintlock: %v", err)
 	}
 
 	client := flintlockv1.NewMicroVMClient(conn)
 
-	return &Client{
+	c := &Client{
 		endpoint: endpoint,
 		client:   client,
 		conn:     conn,
+		caller:   NewCaller(endpoint),
+		creds:    creds,
+		stopCh:   make(chan struct{}),
+		audit:    opts.Audit,
 		mockVMs:  make(map[string]*v1alpha1.MicroVM),
-	}, nil
+	}
+	c.healthy.Store(true)
+	if opts.HealthCheckInterval > 0 {
+		go c.monitorHealth(opts.HealthCheckInterval)
+	}
+	return c, nil
 }
 
 // Close closes the client connection
@@ -60,12 +113,67 @@ func (c *Client) Close() error {
 		return nil
 	}
 
+	close(c.stopCh)
+	if c.creds != nil {
+		c.creds.Close()
+	}
 	if c.conn != nil {
 		return c.conn.Close()
 	}
 	return nil
 }
 
+// Check checks the health of Flintlock. A Flintlock without the gRPC health
+// service counts as healthy once it answers.
+func (c *Client) Check(ctx context.Context) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	resp, err := healthpb.NewHealthClient(c.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("flintlock health check failed: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("flintlock is %s", resp.Status)
+	}
+	return nil
+}
+
+// Healthy reports the result of the last health check
+func (c *Client) Healthy() bool {
+	return c.healthy.Load()
+}
+
+// monitorHealth checks the health of Flintlock every interval until the client is closed
+func (c *Client) monitorHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := c.Check(ctx)
+			cancel()
+
+			healthy := err == nil
+			if c.healthy.Swap(healthy) != healthy {
+				if healthy {
+					log.Infof("Flintlock at %s is healthy again", c.endpoint)
+				} else {
+					log.Warnf("Flintlock at %s is unhealthy: %v", c.endpoint, err)
+				}
+			}
+		}
+	}
+}
+
 // CreateMicroVM creates a new microVM
 func (c *Client) CreateMicroVM(ctx context.Context, vm *v1alpha1.MicroVM) error {
 	// Check if we're on Linux
@@ -99,9 +207,14 @@ func (c *Client) CreateMicroVM(ctx context.Context, vm *v1alpha1.MicroVM) error
 	}
 
 	// Call the Flintlock API
-	resp, err := c.client.CreateMicroVM(ctx, req)
+	var resp *flintlockv1.CreateMicroVMResponse
+	err = c.caller.Call(ctx, "create microVM", false, func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.CreateMicroVM(ctx, req)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create microVM: %v", err)
+		return err
 	}
 
 	// Update our MicroVM with the response
@@ -127,9 +240,12 @@ func (c *Client) DeleteMicroVM(ctx context.Context, vmID string) error {
 	}
 
 	// Call the Flintlock API
-	_, err := c.client.DeleteMicroVM(ctx, req)
+	err := c.caller.Call(ctx, "delete microVM", true, func(ctx context.Context) error {
+		_, err := c.client.DeleteMicroVM(ctx, req)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete microVM: %v", err)
+		return err
 	}
 
 	return nil
@@ -142,7 +258,7 @@ func (c *Client) GetMicroVM(ctx context.Context, vmID string) (*flintlockv1.GetM
 		// On non-Linux platforms, check if the VM exists in memory
 		vm, ok := c.mockVMs[vmID]
 		if !ok {
-			return nil, fmt.Errorf("microVM not found: %s", vmID)
+			return nil, fmt.Errorf("%w: %s", ErrVMNotFound, vmID)
 		}
 
 		// Create a mock response
@@ -163,9 +279,14 @@ func (c *Client) GetMicroVM(ctx context.Context, vmID string) (*flintlockv1.GetM
 	}
 
 	// Call the Flintlock API
-	resp, err := c.client.GetMicroVM(ctx, req)
+	var resp *flintlockv1.GetMicroVMResponse
+	err := c.caller.Call(ctx, "get microVM", true, func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.GetMicroVM(ctx, req)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get microVM: %v", err)
+		return nil, err
 	}
 
 	return resp, nil
@@ -192,9 +313,14 @@ func (c *Client) ListMicroVMs(ctx context.Context) ([]*flintlocktypes.MicroVM, e
 	req := &flintlockv1.ListMicroVMsRequest{}
 
 	// Call the Flintlock API
-	resp, err := c.client.ListMicroVMs(ctx, req)
+	var resp *flintlockv1.ListMicroVMsResponse
+	err := c.caller.Call(ctx, "list microVMs", true, func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.ListMicroVMs(ctx, req)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list microVMs: %v", err)
+		return nil, err
 	}
 
 	return resp.GetMicrovm(), nil
@@ -221,17 +347,77 @@ func convertToFlintlockSpec(vm *v1alpha1.MicroVM) (*flintlocktypes.MicroVMSpec,
 		},
 	}
 
+	// Flintlock has no rate limiters, it can't enforce the ceiling of lime-ctrl
+	if vm.Status.RateLimits != nil {
+		return nil, fmt.Errorf("I/O rate limits are not supported by Flintlock, use the host agent")
+	}
+
+	// Flintlock fetches kernels from images, named kernels are only in the node catalog
+	if k := vm.Spec.Kernel; k != nil {
+		if err := ValidateKernel(k); err != nil {
+			return nil, err
+		}
+		if k.Name != "" {
+			return nil, fmt.Errorf("kernel %s from the node catalog is not supported by Flintlock, use a kernel image", k.Name)
+		}
+		filename := k.Filename
+		if filename == "" {
+			filename = defaultKernelFilename
+		}
+		spec.Kernel = &flintlocktypes.Kernel{
+			Image:            k.Image,
+			Filename:         &filename,
+			Cmdline:          kernelCmdline(k.Args),
+			AddNetworkConfig: true,
+		}
+
+		if initrd := k.Initrd; initrd != nil {
+			if initrd.Name != "" {
+				return nil, fmt.Errorf("initrd %s from the node catalog is not supported by Flintlock, use an initrd image", initrd.Name)
+			}
+			spec.Initrd = &flintlocktypes.Initrd{Image: initrd.Image}
+			if initrd.Filename != "" {
+				filename := initrd.Filename
+				spec.Initrd.Filename = &filename
+			}
+		}
+	}
+
+	// Add the additional volumes. Flintlock only allocates ephemeral volumes,
+	// it has no source for image files, which are only supported by the host agent.
+	if err := ValidateVolumes(vm.Spec.Volumes); err != nil {
+		return nil, err
+	}
+	for _, vol := range vm.Spec.Volumes {
+		if vol.Source.HostPath != nil || vol.Source.Workspace != nil {
+			return nil, fmt.Errorf("volume %s: file backed volumes are not supported by Flintlock, use the host agent", vol.Name)
+		}
+		sizeInMb := vol.SizeMB
+		volume := &flintlocktypes.Volume{
+			Id:         vol.Name,
+			IsReadOnly: vol.ReadOnly,
+			SizeInMb:   &sizeInMb,
+		}
+		spec.AdditionalVolumes = append(spec.AdditionalVolumes, volume)
+
+		// The guest agent reads mount paths from the metadata service
+		if spec.Metadata == nil {
+			spec.Metadata = make(map[string]string)
+		}
+		spec.Metadata["tvm-mount-"+vol.Name] = vol.MountPath
+	}
+
 	return spec, nil
 }
 
 // UpdateMicroVMStatus updates the status of a MicroVM based on Flintlock's response
-func (c *Client) UpdateMicroVMStatus(vm *v1alpha1.MicroVM) error {
+func (c *Client) UpdateMicroVMStatus(ctx context.Context, vm *v1alpha1.MicroVM) error {
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		// On non-Linux platforms, check if the VM exists in memory
 		mockVM, ok := c.mockVMs[vm.Status.VMID]
 		if !ok {
-			return fmt.Errorf("microVM not found: %s", vm.Status.VMID)
+			return fmt.Errorf("%w: %s", ErrVMNotFound, vm.Status.VMID)
 		}
 
 		// Update the status from the mock VM
@@ -239,9 +425,6 @@ func (c *Client) UpdateMicroVMStatus(vm *v1alpha1.MicroVM) error {
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
 	resp, err := c.GetMicroVM(ctx, vm.Status.VMID)
 	if err != nil {
 		return err
@@ -251,22 +434,79 @@ func (c *Client) UpdateMicroVMStatus(vm *v1alpha1.MicroVM) error {
 	vm.Status.VMID = resp.Microvm.Spec.Id
 
 	// Map Flintlock state to our state
-	switch resp.Microvm.Status.State {
-	case flintlocktypes.MicroVMStatus_PENDING:
-		vm.Status.State = v1alpha1.MicroVMStateCreating
-	case flintlocktypes.MicroVMStatus_CREATED:
-		vm.Status.State = v1alpha1.MicroVMStateRunning
-	case flintlocktypes.MicroVMStatus_FAILED:
-		vm.Status.State = v1alpha1.MicroVMStateError
-	case flintlocktypes.MicroVMStatus_DELETING:
-		vm.Status.State = v1alpha1.MicroVMStateDeleted
+	if state := convertState(resp.Microvm.Status.State); state != "" {
+		vm.Status.State = state
 	}
 
 	return nil
 }
 
+// PauseMicroVM pauses a microVM
+func (c *Client) PauseMicroVM(ctx context.Context, vmID string) error {
+	return c.setPaused(vmID, v1alpha1.MicroVMStatePaused)
+}
+
+// ResumeMicroVM resumes a paused microVM
+func (c *Client) ResumeMicroVM(ctx context.Context, vmID string) error {
+	return c.setPaused(vmID, v1alpha1.MicroVMStateRunning)
+}
+
+// setPaused moves a microVM to the paused or running state
+func (c *Client) setPaused(vmID string, state v1alpha1.MicroVMState) error {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, just record the state of the mock VM
+		mockVM, ok := c.mockVMs[vmID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrVMNotFound, vmID)
+		}
+		mockVM.Status.State = state
+		return nil
+	}
+
+	return fmt.Errorf("%w: Flintlock can't pause and resume VMs", ErrNotSupported)
+}
+
+// ResizeBalloon resizes the memory balloon of a microVM
+func (c *Client) ResizeBalloon(ctx context.Context, vmID string, amountMB int) error {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, mock VMs have no balloon to resize
+		return nil
+	}
+
+	return fmt.Errorf("%w: Flintlock VMs have no memory balloon", ErrNotSupported)
+}
+
+// DeleteVolume deletes the backing file of a volume
+func (c *Client) DeleteVolume(ctx context.Context, namespace, path string) error {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, mock VMs have no volume files
+		return nil
+	}
+
+	return fmt.Errorf("file backed volumes are not supported by Flintlock")
+}
+
 // ExecuteCode executes code in a microVM
 func (c *Client) ExecuteCode(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error) {
+	start := time.Now()
+
+	// Anonymous executions are rejected, and recorded as such
+	if req.UserID == "" || req.SessionID == "" {
+		err := fmt.Errorf("%w: rejected execution in VM %s", ErrNoIdentity, vmID)
+		auditExecution(c.audit, vmID, req, start, nil, err)
+		return nil, err
+	}
+
+	resp, err := c.executeCode(ctx, vmID, req)
+	auditExecution(c.audit, vmID, req, start, resp, err)
+	return resp, err
+}
+
+// executeCode executes code in a VM
+func (c *Client) executeCode(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error) {
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		// On non-Linux platforms, just return a mock response
@@ -0,0 +1,246 @@
+package flintlock
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/audit"
+	"google.golang.org/grpc/credentials"
+)
+
+// ClientOptions configures the connection of a Client to Flintlock
+type ClientOptions struct {
+	// TLS enables TLS, verifying Flintlock with CAFile or the system roots
+	TLS bool
+	// CAFile is the CA bundle Flintlock's certificate is verified with
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name Flintlock's certificate is verified against
+	ServerName string
+	// TokenFile holds the token for Flintlock's basic auth
+	TokenFile string
+	// HealthCheckInterval is how often the connection is health checked, 0 disables it
+	HealthCheckInterval time.Duration
+	// Audit records the executions run through the client, if set
+	Audit *audit.Logger
+}
+
+// Validate checks the options for consistency
+func (o ClientOptions) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("a client certificate requires both a certificate and a key")
+	}
+	if !o.TLS && (o.CAFile != "" || o.CertFile != "" || o.ServerName != "") {
+		return fmt.Errorf("TLS settings require TLS to be enabled")
+	}
+	if !o.TLS && o.TokenFile != "" {
+		return fmt.Errorf("a token would be sent in plaintext, enable TLS")
+	}
+	return nil
+}
+
+// credentialFiles holds the certificates and token of a Client, reloading them
+// when their files change so rotated Secrets are picked up without a restart
+type credentialFiles struct {
+	opts    ClientOptions
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	token   string
+	watcher *fsnotify.Watcher
+	mutex   sync.RWMutex
+}
+
+// newCredentialFiles loads the credentials of opts and watches their files
+func newCredentialFiles(opts ClientOptions) (*credentialFiles, error) {
+	c := &credentialFiles{opts: opts}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %v", err)
+	}
+	// Secrets are updated by swapping a symlink, so the directories are watched
+	dirs := make(map[string]bool)
+	for _, file := range []string{opts.CAFile, opts.CertFile, opts.KeyFile, opts.TokenFile} {
+		if file != "" {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+	}
+	c.watcher = watcher
+	go c.watch()
+
+	return c, nil
+}
+
+// load reads all credential files
+func (c *credentialFiles) load() error {
+	var cert *tls.Certificate
+	if c.opts.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(c.opts.CertFile, c.opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cert = &pair
+	}
+
+	var roots *x509.CertPool
+	if c.opts.CAFile != "" {
+		data, err := ioutil.ReadFile(c.opts.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", c.opts.CAFile)
+		}
+	}
+
+	var token string
+	if c.opts.TokenFile != "" {
+		data, err := ioutil.ReadFile(c.opts.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("token file %s is empty", c.opts.TokenFile)
+		}
+	}
+
+	c.mutex.Lock()
+	c.cert, c.roots, c.token = cert, roots, token
+	c.mutex.Unlock()
+	return nil
+}
+
+// watch reloads the credentials on changes until the watcher is closed. A
+// failed reload keeps the previous credentials.
+func (c *credentialFiles) watch() {
+	for {
+		select {
+		case _, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			// A Secret update is a burst of events, reload once it settled
+			time.Sleep(time.Second)
+			drain(c.watcher.Events)
+			if err := c.load(); err != nil {
+				log.Errorf("Failed to reload Flintlock credentials, keeping the previous ones: %v", err)
+				continue
+			}
+			log.Info("Reloaded Flintlock credentials")
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Credential watcher error: %v", err)
+		}
+	}
+}
+
+// drain discards the pending events of ch
+func drain(ch <-chan fsnotify.Event) {
+	for {
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
+
+// Close stops watching the credential files
+func (c *credentialFiles) Close() error {
+	return c.watcher.Close()
+}
+
+// tlsConfig returns a TLS config that uses the current credentials on every handshake
+func (c *credentialFiles) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		ServerName: c.opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.opts.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			return c.cert, nil
+		}
+	}
+	if c.opts.CAFile != "" {
+		// The roots can change, so verification is done against the current pool
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = c.verifyConnection
+	}
+	return config
+}
+
+// verifyConnection verifies the server certificate chain and name against the current CA
+func (c *credentialFiles) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("flintlock presented no certificate")
+	}
+
+	c.mutex.RLock()
+	roots := c.roots
+	c.mutex.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       state.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// tokenCredentials returns per-call credentials sending the current token
+func (c *credentialFiles) tokenCredentials() credentials.PerRPCCredentials {
+	return basicAuth{files: c}
+}
+
+// basicAuth authenticates calls with Flintlock's basic auth, which expects the
+// token base64 encoded in a Basic authorization header
+type basicAuth struct {
+	files *credentialFiles
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials
+func (b basicAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	b.files.mutex.RLock()
+	token := b.files.token
+	b.files.mutex.RUnlock()
+
+	return map[string]string{
+		"authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(token)),
+	}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials
+func (b basicAuth) RequireTransportSecurity() bool {
+	return true
+}
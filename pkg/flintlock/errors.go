@@ -0,0 +1,55 @@
+package flintlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrVMNotFound is returned for VMs the backend doesn't know
+	ErrVMNotFound = errors.New("VM not found")
+	// ErrAlreadyExists is returned when a VM with the same ID exists
+	ErrAlreadyExists = errors.New("VM already exists")
+	// ErrResourceExhausted is returned when the backend has no capacity left
+	ErrResourceExhausted = errors.New("backend resources exhausted")
+	// ErrUnavailable is returned when the backend can't be reached, including
+	// while its circuit breaker is open
+	ErrUnavailable = errors.New("backend unavailable")
+	// ErrNoIdentity is returned for executions without the user and session
+	// that requested them, which can't be audited
+	ErrNoIdentity = errors.New("execution has no user and session identity")
+	// ErrNotSupported is returned for operations the backend can't perform,
+	// retrying them doesn't help
+	ErrNotSupported = errors.New("not supported by the backend")
+)
+
+// WrapError wraps the error of a gRPC call made to op, adding the typed error
+// matching its status code. The status stays available to status.Code.
+func WrapError(op string, err error) error {
+	var typed error
+	switch status.Code(err) {
+	case codes.NotFound:
+		typed = ErrVMNotFound
+	case codes.AlreadyExists:
+		typed = ErrAlreadyExists
+	case codes.ResourceExhausted:
+		typed = ErrResourceExhausted
+	case codes.Unavailable:
+		typed = ErrUnavailable
+	}
+	if typed == nil {
+		return fmt.Errorf("failed to %s: %w", op, err)
+	}
+	return fmt.Errorf("failed to %s: %w: %w", op, typed, err)
+}
+
+// IsTransient reports whether an error is expected to clear up when the call
+// is repeated later
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, context.DeadlineExceeded) ||
+		status.Code(err) == codes.DeadlineExceeded
+}
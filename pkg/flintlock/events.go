@@ -0,0 +1,139 @@
+package flintlock
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+
+	flintlockv1 "github.com/liquidmetal-dev/flintlock/api/services/microvm/v1alpha1"
+	flintlocktypes "github.com/liquidmetal-dev/flintlock/api/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultWatchInterval is how often Flintlock is listed for state changes
+const DefaultWatchInterval = 2 * time.Second
+
+// VMEvent reports a change of the state of a VM in the backend
+type VMEvent struct {
+	VMID  string                `json:"vmId"`
+	State v1alpha1.MicroVMState `json:"state"`
+	// Error describes why the VM failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// WatchMicroVMs publishes the state changes of all microVMs until ctx is done.
+// Flintlock has no change feed, so the VMs are streamed every interval with a
+// single call and changes against the previous listing are published. All
+// VMs are published on the first listing, which resyncs after a restart.
+func (c *Client) WatchMicroVMs(ctx context.Context, interval time.Duration) <-chan VMEvent {
+	events := make(chan VMEvent, 64)
+
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, mock VMs never change state on their own
+		go func() {
+			<-ctx.Done()
+			close(events)
+		}()
+		return events
+	}
+
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		states := make(map[string]v1alpha1.MicroVMState)
+		for {
+			current, err := c.listStates(ctx)
+			if err != nil {
+				log.Warnf("Failed to list microVMs for state changes: %v", err)
+			} else {
+				for vmID, state := range current {
+					if previous, ok := states[vmID]; ok && previous == state {
+						continue
+					}
+					if !sendEvent(ctx, events, VMEvent{VMID: vmID, State: state}) {
+						return
+					}
+				}
+				for vmID := range states {
+					if _, ok := current[vmID]; ok {
+						continue
+					}
+					if !sendEvent(ctx, events, VMEvent{VMID: vmID, State: v1alpha1.MicroVMStateDeleted}) {
+						return
+					}
+				}
+				states = current
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return events
+}
+
+// listStates returns the state of every microVM known to Flintlock
+func (c *Client) listStates(ctx context.Context) (map[string]v1alpha1.MicroVMState, error) {
+	var states map[string]v1alpha1.MicroVMState
+	err := c.caller.Call(ctx, "list microVMs", true, func(ctx context.Context) error {
+		stream, err := c.client.ListMicroVMsStream(ctx, &flintlockv1.ListMicroVMsRequest{})
+		if err != nil {
+			return err
+		}
+
+		states = make(map[string]v1alpha1.MicroVMState)
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			vm := msg.GetMicrovm()
+			if vm == nil || vm.Spec == nil || vm.Status == nil {
+				continue
+			}
+			if state := convertState(vm.Status.State); state != "" {
+				states[vm.Spec.Id] = state
+			}
+		}
+	})
+	return states, err
+}
+
+// convertState maps a Flintlock microVM state to a MicroVM state
+func convertState(state flintlocktypes.MicroVMStatus_MicroVMState) v1alpha1.MicroVMState {
+	switch state {
+	case flintlocktypes.MicroVMStatus_PENDING:
+		return v1alpha1.MicroVMStateCreating
+	case flintlocktypes.MicroVMStatus_CREATED:
+		return v1alpha1.MicroVMStateRunning
+	case flintlocktypes.MicroVMStatus_FAILED:
+		return v1alpha1.MicroVMStateError
+	case flintlocktypes.MicroVMStatus_DELETING:
+		return v1alpha1.MicroVMStateDeleted
+	}
+	return ""
+}
+
+// sendEvent publishes an event, returning false if ctx is done first
+func sendEvent(ctx context.Context, events chan<- VMEvent, event VMEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,111 @@
+package flintlock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/yourusername/tvm/pkg/tracing"
+)
+
+// FileClient sends execution requests to a flintlock Server through the
+// shared directory it serves
+type FileClient struct {
+	// Base directory for flintlock data, as seen by the client
+	BaseDir string
+}
+
+// NewFileClient creates a client for the Server serving baseDir
+func NewFileClient(baseDir string) *FileClient {
+	return &FileClient{BaseDir: baseDir}
+}
+
+// ExecuteCode writes a request for vmID under a new ID and waits for its
+// response until ctx is done. Requests still waiting to be claimed when ctx
+// is done are withdrawn.
+func (c *FileClient) ExecuteCode(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error) {
+	id, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	request := *req
+	request.VMID = vmID
+	request.Trace = tracing.Inject(ctx)
+	data, err := json.Marshal(&request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	requests := filepath.Join(c.BaseDir, "microvms", requestsDir)
+	responses := filepath.Join(c.BaseDir, "microvms", responsesDir)
+	name := id + ".json"
+
+	// Watch for the response before the request can be answered
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(responses); err != nil {
+		return nil, fmt.Errorf("failed to watch responses: %v", err)
+	}
+
+	if err := writeFileAtomic(requests, name, data); err != nil {
+		return nil, fmt.Errorf("failed to write request: %v", err)
+	}
+
+	// Poll as well in case an event is lost
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	responsePath := filepath.Join(responses, name)
+	for {
+		if resp, err := readResponse(responsePath); err != nil || resp != nil {
+			return resp, err
+		}
+
+		select {
+		case <-ctx.Done():
+			os.Remove(filepath.Join(requests, name))
+			return nil, ctx.Err()
+		case <-watcher.Events:
+		case <-watcher.Errors:
+		case <-ticker.C:
+		}
+	}
+}
+
+// readResponse reads and removes a response, it returns nil if there is none yet
+func readResponse(path string) (*ExecutionResponse, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	os.Remove(path)
+
+	var resp ExecutionResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return &resp, nil
+}
+
+// newRequestID returns a unique request ID, ordered by creation time
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate request ID: %v", err)
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
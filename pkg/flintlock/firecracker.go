@@ -2,11 +2,29 @@ package flintlock
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/audit"
+	"github.com/yourusername/tvm/pkg/image"
+	"github.com/yourusername/tvm/pkg/metrics"
+	"github.com/yourusername/tvm/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// defaultBootArgs are the kernel arguments every VM is booted with
+const defaultBootArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+
 // FirecrackerManager manages Firecracker VMs
 type FirecrackerManager struct {
 	// Base directory for VM data
@@ -15,16 +33,153 @@ type FirecrackerManager struct {
 	KernelImagePath string
 	// Path to rootfs image
 	RootfsImagePath string
+	// Path to the firecracker binary
+	FirecrackerBinary string
+	// SeccompFilter is a compiled seccomp filter replacing the default of
+	// Firecracker, which applies its own if empty
+	SeccompFilter string
+	// Images resolves VMConfig.Image to a cached rootfs, if set
+	Images *image.Cache
+	// Kernels resolves VMConfig.KernelName and InitrdName
+	Kernels *KernelCatalog
+	// VolumeDir holds the backing files of file backed drives, which may not
+	// be anywhere else on the node
+	VolumeDir string
+	// Audit records every execution, if set
+	Audit *audit.Logger
+	// Jailer runs VMs under the Firecracker jailer, if set
+	Jailer *JailerConfig
 	// Map of VM ID to VM instance
-	vms map[string]interface{}
+	vms map[string]*vmInstance
+	// jailUIDs maps the UIDs given to jailed VMs to their VM IDs
+	jailUIDs map[int]string
+	// jailGrants holds the files shared with each jailed VM through an ACL entry
+	jailGrants map[string][]string
+	// events receives the VMs that exited without being stopped
+	events chan VMEvent
+	mutex  sync.Mutex
 }
 
 // VMConfig represents the configuration for a VM
 type VMConfig struct {
-	VCPU   int    `json:"vcpu"`
-	Memory int    `json:"memory"`
-	Kernel string `json:"kernel"`
-	Rootfs string `json:"rootfs"`
+	VCPU   int `json:"vcpu"`
+	Memory int `json:"memory"`
+	// Kernel, Rootfs and Initrd are the paths the VM boots from. They are
+	// resolved on this node and rejected when set by the caller.
+	Kernel string `json:"kernel,omitempty"`
+	Rootfs string `json:"rootfs,omitempty"`
+	Initrd string `json:"initrd,omitempty"`
+	// KernelName is a kernel from the node catalog, the default kernel if empty
+	KernelName string `json:"kernelName,omitempty"`
+	// KernelArgs are appended to the kernel command line
+	KernelArgs []string `json:"kernelArgs,omitempty"`
+	// InitrdName is a catalog kernel whose initrd is used, no initrd if empty
+	InitrdName string `json:"initrdName,omitempty"`
+	// Image is an OCI image reference the rootfs is built from, the default rootfs if empty
+	Image string `json:"image,omitempty"`
+	// Drives are attached in order after the root drive, as /dev/vdb, /dev/vdc, ...
+	Drives []DriveConfig `json:"drives,omitempty"`
+	// Namespace is the namespace of the VM, its file backed drives must be volumes of it
+	Namespace string `json:"namespace,omitempty"`
+	// DiskRateLimit limits every drive, including the root drive
+	DiskRateLimit *RateLimit `json:"diskRateLimit,omitempty"`
+	// Balloon attaches a memory balloon device, so memory can be reclaimed from the guest
+	Balloon *BalloonConfig `json:"balloon,omitempty"`
+}
+
+// BalloonConfig configures the memory balloon of a VM
+type BalloonConfig struct {
+	// AmountMB is the memory taken from the guest at boot
+	AmountMB int `json:"amountMB"`
+	// DeflateOnOOM deflates the balloon when the guest runs out of memory
+	DeflateOnOOM bool `json:"deflateOnOOM,omitempty"`
+	// StatsIntervalSeconds is how often the guest reports its memory, 0 to disable
+	StatsIntervalSeconds int `json:"statsIntervalSeconds,omitempty"`
+}
+
+// BalloonStats describes the memory balloon of a VM and the guest memory
+type BalloonStats struct {
+	// TargetMB is the size the balloon is inflated or deflated to
+	TargetMB int64 `json:"targetMB"`
+	// ActualMB is the current size of the balloon
+	ActualMB int64 `json:"actualMB"`
+	// TotalMemoryMB, FreeMemoryMB and AvailableMemoryMB are reported by the guest
+	TotalMemoryMB     int64 `json:"totalMemoryMB,omitempty"`
+	FreeMemoryMB      int64 `json:"freeMemoryMB,omitempty"`
+	AvailableMemoryMB int64 `json:"availableMemoryMB,omitempty"`
+	MajorFaults       int64 `json:"majorFaults,omitempty"`
+	MinorFaults       int64 `json:"minorFaults,omitempty"`
+}
+
+// RateLimit is a token bucket limit per second, zero fields are unlimited
+type RateLimit struct {
+	BandwidthBytesPerSec int64 `json:"bandwidthBytesPerSec,omitempty"`
+	BandwidthBurstBytes  int64 `json:"bandwidthBurstBytes,omitempty"`
+	OpsPerSec            int64 `json:"opsPerSec,omitempty"`
+	OpsBurst             int64 `json:"opsBurst,omitempty"`
+}
+
+// DriveConfig represents an additional drive attached to a VM
+type DriveConfig struct {
+	ID string `json:"id"`
+	// PathOnHost is the backing file of the drive, relative to the volume
+	// directory of the manager and within the volumes of the namespace of the
+	// VM. If empty, an ephemeral file is created in the VM directory and
+	// deleted with the VM.
+	PathOnHost string `json:"pathOnHost,omitempty"`
+	SizeMB     int32  `json:"sizeMB"`
+	ReadOnly   bool   `json:"readOnly,omitempty"`
+	// MountPath is passed to the guest agent on the kernel command line
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+// vmInstance is a VM started by the FirecrackerManager
+type vmInstance struct {
+	id     string
+	dir    string
+	config VMConfig
+	cmd    *exec.Cmd
+	api    *firecrackerAPI
+	// vsock is the unix socket backing the vsock device on the host
+	vsock string
+	// jail is where the VMM runs, nil if it isn't jailed
+	jail *jail
+	// rootfsMethod is how the rootfs was copied from its base image
+	rootfsMethod string
+	// paused is whether the VM was paused with PauseVM, guarded by the manager mutex
+	paused bool
+	// done is closed when the firecracker process exits
+	done chan struct{}
+	// exitErr is the exit error of the firecracker process, set before done is closed
+	exitErr error
+	// exitedUnmanaged is whether the VM exited while it wasn't registered,
+	// guarded by the manager mutex
+	exitedUnmanaged bool
+}
+
+// VMInfo describes a VM managed by the FirecrackerManager
+type VMInfo struct {
+	ID      string `json:"id"`
+	Running bool   `json:"running"`
+	// RootfsMethod is how the rootfs was copied from its base image
+	RootfsMethod string `json:"rootfsMethod,omitempty"`
+	// RootfsDeltaBytes is the disk space used by the rootfs on top of its base image
+	RootfsDeltaBytes int64 `json:"rootfsDeltaBytes"`
+	// ExitError is why the VM exited, empty if it is running or shut down cleanly
+	ExitError string `json:"exitError,omitempty"`
+	// Paused is whether the vCPUs of a running VM are paused
+	Paused bool `json:"paused,omitempty"`
+	// Balloon describes the memory balloon of a running VM that has one
+	Balloon *BalloonStats `json:"balloon,omitempty"`
+}
+
+// SnapshotInfo describes a snapshot of a VM
+type SnapshotInfo struct {
+	Name string `json:"name"`
+	// StatePath is the file holding the VM state
+	StatePath string `json:"statePath"`
+	// MemoryPath is the file holding the guest memory
+	MemoryPath string `json:"memoryPath"`
 }
 
 // NewFirecrackerManager creates a new FirecrackerManager
@@ -36,68 +191,648 @@ func NewFirecrackerManager(baseDir, kernelImagePath, rootfsImagePath string) (*F
 			BaseDir:         baseDir,
 			KernelImagePath: kernelImagePath,
 			RootfsImagePath: rootfsImagePath,
-			vms:             make(map[string]interface{}),
+			Kernels:         NewKernelCatalog(DefaultKernelDir),
+			VolumeDir:       DefaultVolumeDir,
+			vms:             make(map[string]*vmInstance),
+			events:          make(chan VMEvent, 64),
 		}, nil
 	}
 
 	// On Linux, create a real manager
+	if err := os.MkdirAll(filepath.Join(baseDir, "vms"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create vms directory: %v", err)
+	}
+
 	return &FirecrackerManager{
-		BaseDir:         baseDir,
-		KernelImagePath: kernelImagePath,
-		RootfsImagePath: rootfsImagePath,
-		vms:             make(map[string]interface{}),
+		BaseDir:           baseDir,
+		KernelImagePath:   kernelImagePath,
+		RootfsImagePath:   rootfsImagePath,
+		FirecrackerBinary: "firecracker",
+		Kernels:           NewKernelCatalog(DefaultKernelDir),
+		VolumeDir:         DefaultVolumeDir,
+		vms:               make(map[string]*vmInstance),
+		events:            make(chan VMEvent, 64),
 	}, nil
 }
 
 // CreateVM creates a new Firecracker VM
 func (m *FirecrackerManager) CreateVM(ctx context.Context, config VMConfig) (string, error) {
+	ctx, span := tracing.Start(ctx, "CreateVM", attribute.String("tvm.image", config.Image))
+	vmID, err := m.createVM(ctx, config)
+	span.SetAttributes(attribute.String("tvm.vm", vmID))
+	tracing.End(span, err)
+	return vmID, err
+}
+
+// createVM creates a new Firecracker VM
+func (m *FirecrackerManager) createVM(ctx context.Context, config VMConfig) (string, error) {
+	// Boot files only come from the kernel catalog and the image cache, a path
+	// from the caller could be any file on the node
+	if config.Kernel != "" || config.Rootfs != "" || config.Initrd != "" {
+		return "", fmt.Errorf("kernel, rootfs and initrd paths can't be requested, use kernelName, initrdName and image")
+	}
+
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		// On non-Linux platforms, just return a mock VM ID
-		vmID := fmt.Sprintf("mock-vm-%d", time.Now().Unix())
-		m.vms[vmID] = struct{}{}
+		vmID := fmt.Sprintf("mock-vm-%d", time.Now().UnixNano())
+		m.mutex.Lock()
+		m.vms[vmID] = &vmInstance{id: vmID, config: config}
+		m.mutex.Unlock()
 		return vmID, nil
 	}
 
 	// On Linux, create a real VM
-	// This would use the Firecracker SDK in a real implementation
-	vmID := fmt.Sprintf("vm-%d", time.Now().Unix())
-	m.vms[vmID] = struct{}{}
+	if err := m.resolveBoot(&config); err != nil {
+		return "", err
+	}
+
+	vmID := fmt.Sprintf("vm-%d", time.Now().UnixNano())
+	vmDir := m.vmDir(vmID)
+	if err := os.MkdirAll(vmDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create VM directory: %v", err)
+	}
+
+	if config.Image != "" {
+		if m.Images == nil {
+			os.RemoveAll(vmDir)
+			return "", fmt.Errorf("image %s requested but no image cache is configured", config.Image)
+		}
+		entry, err := m.Images.Acquire(ctx, config.Image, vmID)
+		if err != nil {
+			os.RemoveAll(vmDir)
+			return "", err
+		}
+		config.Rootfs = entry.RootfsPath
+	}
+	if config.Rootfs == "" {
+		config.Rootfs = m.RootfsImagePath
+	}
+
+	// Give the VM its own copy-on-write rootfs so the base can be shared
+	rootfsPath := filepath.Join(vmDir, "rootfs.ext4")
+	rootfsMethod, err := cloneRootfs(config.Rootfs, rootfsPath)
+	if err != nil {
+		m.cleanupVM(vmID)
+		return "", err
+	}
+	config.Rootfs = rootfsPath
+
+	// Allocate ephemeral drives in the VM directory. File backed drives live on
+	// this node, so they are created or grown here rather than by the caller,
+	// and only within the volume directory.
+	config.Drives = append([]DriveConfig(nil), config.Drives...)
+	for i := range config.Drives {
+		drive := &config.Drives[i]
+		if drive.PathOnHost == "" {
+			drive.PathOnHost = filepath.Join(vmDir, drive.ID+".img")
+		} else {
+			err := CheckVolumeNamespace(drive.PathOnHost, config.Namespace)
+			if err != nil {
+				m.cleanupVM(vmID)
+				return "", fmt.Errorf("drive %s: %v", drive.ID, err)
+			}
+			path, err := ResolveVolumePath(m.VolumeDir, drive.PathOnHost)
+			if err != nil {
+				m.cleanupVM(vmID)
+				return "", fmt.Errorf("drive %s: %v", drive.ID, err)
+			}
+			drive.PathOnHost = path
+		}
+		if _, err := EnsureVolumeFile(ctx, drive.PathOnHost, drive.SizeMB); err != nil {
+			m.cleanupVM(vmID)
+			return "", fmt.Errorf("failed to create drive %s: %v", drive.ID, err)
+		}
+	}
+
+	bootCtx, span := tracing.Start(ctx, "BootVM", attribute.String("tvm.vm", vmID))
+	vm, err := m.startVM(bootCtx, vmID, vmDir, config)
+	tracing.End(span, err)
+	if err != nil {
+		m.cleanupVM(vmID)
+		return "", err
+	}
+	vm.rootfsMethod = rootfsMethod
+	m.register(vm)
+
+	log.Infof("Created Firecracker VM %s", vmID)
 	return vmID, nil
 }
 
+// startVM starts a firecracker process for a VM and boots it
+func (m *FirecrackerManager) startVM(ctx context.Context, vmID, vmDir string, config VMConfig) (*vmInstance, error) {
+	logFile, err := os.Create(filepath.Join(vmDir, "firecracker.log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %v", err)
+	}
+	defer logFile.Close()
+
+	// The process must outlive the request, so it is not bound to ctx
+	start := time.Now()
+	socketPath := filepath.Join(vmDir, "firecracker.sock")
+	vsockPath := filepath.Join(vmDir, vsockSocket)
+	var cmd *exec.Cmd
+	var j *jail
+	if m.Jailer != nil {
+		cmd, j, err = m.jailCommand(ctx, vmID, config)
+		if err != nil {
+			return nil, err
+		}
+		// The sockets live in the chroot, the API socket is linked from the
+		// VM directory where the running VMs are counted
+		vsockPath = filepath.Join(j.root, "run", vsockSocket)
+		if err := os.Symlink(filepath.Join(j.root, jailAPISocket), socketPath); err != nil {
+			return nil, fmt.Errorf("failed to link API socket: %v", err)
+		}
+	} else {
+		args := []string{"--api-sock", socketPath, "--id", vmID}
+		if m.SeccompFilter != "" {
+			args = append(args, "--seccomp-filter", m.SeccompFilter)
+		}
+		cmd = exec.Command(m.FirecrackerBinary, args...)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start firecracker: %v", err)
+	}
+
+	vm := &vmInstance{
+		id:     vmID,
+		dir:    vmDir,
+		config: config,
+		cmd:    cmd,
+		api:    newFirecrackerAPI(socketPath),
+		vsock:  vsockPath,
+		jail:   j,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		log.Infof("Firecracker process of VM %s exited: %v", vmID, err)
+		vm.exitErr = err
+		close(vm.done)
+		m.vmExited(vm, err)
+	}()
+
+	if err := m.configureVM(ctx, vm); err != nil {
+		cmd.Process.Kill()
+		<-vm.done
+		return nil, err
+	}
+	metrics.VMBootDuration.Observe(time.Since(start).Seconds())
+
+	return vm, nil
+}
+
+// register adds a booted VM to the managed VMs. The VM may already have
+// exited, its exit wasn't published then, so it is published now.
+func (m *FirecrackerManager) register(vm *vmInstance) {
+	m.mutex.Lock()
+	m.vms[vm.id] = vm
+	exited := vm.exitedUnmanaged
+	m.mutex.Unlock()
+	if exited {
+		m.publishExit(vm, vm.exitErr)
+	}
+}
+
+// vmExited publishes the exit of a VM that is still managed, which means it
+// crashed or was shut down from inside the guest rather than stopped
+func (m *FirecrackerManager) vmExited(vm *vmInstance, err error) {
+	m.mutex.Lock()
+	managed := m.vms[vm.id] == vm
+	if !managed {
+		vm.exitedUnmanaged = true
+	}
+	m.mutex.Unlock()
+	if !managed {
+		return
+	}
+	m.publishExit(vm, err)
+}
+
+// publishExit publishes the exit of a VM
+func (m *FirecrackerManager) publishExit(vm *vmInstance, err error) {
+	event := VMEvent{VMID: vm.id, State: v1alpha1.MicroVMStateStopped}
+	if err != nil {
+		event.State = v1alpha1.MicroVMStateError
+		event.Error = fmt.Sprintf("firecracker exited: %v", err)
+	}
+
+	// Never block the process reaper, consumers resync periodically
+	select {
+	case m.events <- event:
+	default:
+		log.Warnf("Dropping exit event of VM %s, event channel is full", vm.id)
+	}
+}
+
+// Events returns the channel VM exits are published on
+func (m *FirecrackerManager) Events() <-chan VMEvent {
+	return m.events
+}
+
+// configureVM configures the machine, boot source and drives of a VM and starts it
+func (m *FirecrackerManager) configureVM(ctx context.Context, vm *vmInstance) error {
+	if err := vm.api.waitForSocket(ctx, 5*time.Second); err != nil {
+		return err
+	}
+
+	config := vm.config
+	if err := vm.api.put(ctx, "/machine-config", machineConfig{
+		VCPUCount:  config.VCPU,
+		MemSizeMib: config.Memory,
+	}); err != nil {
+		return fmt.Errorf("failed to configure machine: %v", err)
+	}
+
+	if err := vm.api.put(ctx, "/boot-source", bootSource{
+		KernelImagePath: vm.vmmPath(config.Kernel),
+		BootArgs:        bootArgs(config),
+		InitrdPath:      vm.vmmPath(config.Initrd),
+	}); err != nil {
+		return fmt.Errorf("failed to configure boot source: %v", err)
+	}
+
+	if err := vm.api.put(ctx, "/drives/rootfs", drive{
+		DriveID:      "rootfs",
+		PathOnHost:   vm.vmmPath(config.Rootfs),
+		IsRootDevice: true,
+		RateLimiter:  newRateLimiter(config.DiskRateLimit),
+	}); err != nil {
+		return fmt.Errorf("failed to attach root drive: %v", err)
+	}
+
+	// The guest agent is reached over vsock
+	if err := vm.api.put(ctx, "/vsock", vsockDevice{
+		GuestCID: guestCID,
+		UDSPath:  vm.vmmPath(vm.vsock),
+	}); err != nil {
+		return fmt.Errorf("failed to configure vsock: %v", err)
+	}
+
+	if b := config.Balloon; b != nil {
+		if err := vm.api.put(ctx, "/balloon", balloon{
+			AmountMib:             b.AmountMB,
+			DeflateOnOOM:          b.DeflateOnOOM,
+			StatsPollingIntervalS: b.StatsIntervalSeconds,
+		}); err != nil {
+			return fmt.Errorf("failed to configure balloon: %v", err)
+		}
+	}
+
+	for _, d := range config.Drives {
+		if err := vm.api.put(ctx, "/drives/"+d.ID, drive{
+			DriveID:     d.ID,
+			PathOnHost:  vm.vmmPath(d.PathOnHost),
+			IsReadOnly:  d.ReadOnly,
+			RateLimiter: newRateLimiter(config.DiskRateLimit),
+		}); err != nil {
+			return fmt.Errorf("failed to attach drive %s: %v", d.ID, err)
+		}
+	}
+
+	if err := vm.api.put(ctx, "/actions", instanceAction{ActionType: "InstanceStart"}); err != nil {
+		return fmt.Errorf("failed to start instance: %v", err)
+	}
+
+	return nil
+}
+
+// vmmPath returns the path of a host file as the VMM of the VM sees it
+func (vm *vmInstance) vmmPath(path string) string {
+	if vm.jail == nil || path == "" {
+		return path
+	}
+	return vm.jail.path(path)
+}
+
+// resolveBoot resolves the kernel and initrd of a VM to paths on the node and
+// checks they exist, so a missing kernel fails before anything is allocated
+func (m *FirecrackerManager) resolveBoot(config *VMConfig) error {
+	if config.KernelName != "" {
+		if m.Kernels == nil {
+			return fmt.Errorf("kernel %s requested but no kernel catalog is configured", config.KernelName)
+		}
+		path, err := m.Kernels.Kernel(config.KernelName)
+		if err != nil {
+			return err
+		}
+		config.Kernel = path
+	}
+	if config.Kernel == "" {
+		config.Kernel = m.KernelImagePath
+	}
+	if _, err := os.Stat(config.Kernel); err != nil {
+		return fmt.Errorf("kernel not found on this node: %v", err)
+	}
+
+	if config.InitrdName != "" {
+		if m.Kernels == nil {
+			return fmt.Errorf("initrd %s requested but no kernel catalog is configured", config.InitrdName)
+		}
+		path, err := m.Kernels.Initrd(config.InitrdName)
+		if err != nil {
+			return err
+		}
+		config.Initrd = path
+	}
+	if config.Initrd != "" {
+		if _, err := os.Stat(config.Initrd); err != nil {
+			return fmt.Errorf("initrd not found on this node: %v", err)
+		}
+	}
+
+	for _, arg := range config.KernelArgs {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"") {
+			return fmt.Errorf("invalid kernel argument %q", arg)
+		}
+	}
+	return nil
+}
+
+// bootArgs returns the kernel command line for a VM. Mount paths of additional
+// drives are passed as tvm.mounts=vdb:/data,vdc:/workspace for the guest agent,
+// followed by the user supplied arguments.
+func bootArgs(config VMConfig) string {
+	args := []string{defaultBootArgs}
+
+	var mounts []string
+	for i, d := range config.Drives {
+		if d.MountPath == "" {
+			continue
+		}
+		mounts = append(mounts, fmt.Sprintf("vd%c:%s", 'b'+i, d.MountPath))
+	}
+	if len(mounts) > 0 {
+		args = append(args, "tvm.mounts="+strings.Join(mounts, ","))
+	}
+
+	args = append(args, config.KernelArgs...)
+	return strings.Join(args, " ")
+}
+
+// GetVM returns information about a VM
+func (m *FirecrackerManager) GetVM(vmID string) (*VMInfo, error) {
+	m.mutex.Lock()
+	vm, ok := m.vms[vmID]
+	var paused bool
+	if ok {
+		paused = vm.paused
+	}
+	m.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrVMNotFound, vmID)
+	}
+
+	info := &VMInfo{ID: vmID, RootfsMethod: vm.rootfsMethod}
+
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, mock VMs are always running
+		info.Running = true
+		info.Paused = paused
+		return info, nil
+	}
+
+	select {
+	case <-vm.done:
+		if vm.exitErr != nil {
+			info.ExitError = vm.exitErr.Error()
+		}
+	default:
+		info.Running = true
+		info.Paused = paused
+	}
+
+	delta, err := rootfsDelta(vm.config.Rootfs, vm.rootfsMethod)
+	if err != nil {
+		log.Warnf("Failed to measure rootfs of VM %s: %v", vmID, err)
+	}
+	info.RootfsDeltaBytes = delta
+
+	if info.Running && vm.config.Balloon != nil {
+		stats, err := vm.balloonStats()
+		if err != nil {
+			log.Warnf("Failed to get balloon of VM %s: %v", vmID, err)
+		}
+		info.Balloon = stats
+	}
+
+	return info, nil
+}
+
+// balloonStats returns the balloon statistics of a running VM. Without
+// statistics polling only the balloon size is known.
+func (vm *vmInstance) balloonStats() (*BalloonStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if vm.config.Balloon.StatsIntervalSeconds == 0 {
+		var config balloon
+		if err := vm.api.get(ctx, "/balloon", &config); err != nil {
+			return nil, err
+		}
+		return &BalloonStats{TargetMB: int64(config.AmountMib)}, nil
+	}
+
+	var stats balloonStatistics
+	if err := vm.api.get(ctx, "/balloon/statistics", &stats); err != nil {
+		return nil, err
+	}
+	return &BalloonStats{
+		TargetMB:          stats.TargetMib,
+		ActualMB:          stats.ActualMib,
+		TotalMemoryMB:     stats.TotalMemory >> 20,
+		FreeMemoryMB:      stats.FreeMemory >> 20,
+		AvailableMemoryMB: stats.AvailableMemory >> 20,
+		MajorFaults:       stats.MajorFaults,
+		MinorFaults:       stats.MinorFaults,
+	}, nil
+}
+
+// ResizeBalloon inflates or deflates the balloon of a running VM to amountMB,
+// taking that much memory from the guest
+func (m *FirecrackerManager) ResizeBalloon(ctx context.Context, vmID string, amountMB int) error {
+	if amountMB < 0 {
+		return fmt.Errorf("invalid balloon size %d", amountMB)
+	}
+
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, mock VMs have no balloon to resize
+		return nil
+	}
+
+	// On Linux, resize the balloon of the real VM
+	vm, err := m.runningVM(vmID)
+	if err != nil {
+		return err
+	}
+	if vm.config.Balloon == nil {
+		return fmt.Errorf("VM %s has no balloon", vmID)
+	}
+	if err := vm.api.do(ctx, http.MethodPatch, "/balloon", balloonUpdate{AmountMib: amountMB}); err != nil {
+		return fmt.Errorf("failed to resize balloon: %v", err)
+	}
+
+	log.Infof("Resized balloon of VM %s to %d MB", vmID, amountMB)
+	return nil
+}
+
+// ListVMs returns information about all VMs
+func (m *FirecrackerManager) ListVMs() []*VMInfo {
+	m.mutex.Lock()
+	ids := make([]string, 0, len(m.vms))
+	for id := range m.vms {
+		ids = append(ids, id)
+	}
+	m.mutex.Unlock()
+
+	infos := make([]*VMInfo, 0, len(ids))
+	for _, id := range ids {
+		// VMs deleted since they were listed are skipped
+		if info, err := m.GetVM(id); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// vmDir returns the directory holding the data of a VM
+func (m *FirecrackerManager) vmDir(vmID string) string {
+	return filepath.Join(m.BaseDir, "vms", vmID)
+}
+
 // StopVM stops a Firecracker VM
 func (m *FirecrackerManager) StopVM(ctx context.Context, vmID string) error {
+	m.mutex.Lock()
+	vm, ok := m.vms[vmID]
+	delete(m.vms, vmID)
+	m.mutex.Unlock()
+
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		// On non-Linux platforms, just remove the VM from the map
-		delete(m.vms, vmID)
 		return nil
 	}
 
 	// On Linux, stop the real VM
-	// This would use the Firecracker SDK in a real implementation
-	delete(m.vms, vmID)
+	if !ok || vm.cmd == nil {
+		return nil
+	}
+
+	// Ask the guest to shut down, and kill the VMM if it doesn't in time
+	if err := vm.api.put(ctx, "/actions", instanceAction{ActionType: "SendCtrlAltDel"}); err != nil {
+		log.Warnf("Failed to send Ctrl+Alt+Del to VM %s: %v", vmID, err)
+	}
+	select {
+	case <-vm.done:
+	case <-time.After(10 * time.Second):
+		vm.cmd.Process.Kill()
+		<-vm.done
+	}
+
 	return nil
 }
 
 // DeleteVM deletes a Firecracker VM
 func (m *FirecrackerManager) DeleteVM(ctx context.Context, vmID string) error {
+	if vmID == "" || filepath.Base(vmID) != vmID {
+		return fmt.Errorf("invalid VM ID: %q", vmID)
+	}
+
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		// On non-Linux platforms, just remove the VM from the map
+		m.mutex.Lock()
 		delete(m.vms, vmID)
+		m.mutex.Unlock()
 		return nil
 	}
 
-	// On Linux, delete the real VM
-	// This would use the Firecracker SDK in a real implementation
-	delete(m.vms, vmID)
+	// On Linux, delete the real VM along with its ephemeral drives
+	if err := m.StopVM(ctx, vmID); err != nil {
+		return err
+	}
+	return m.cleanupVM(vmID)
+}
+
+// cleanupVM removes the directory and jail of a VM and releases its image
+func (m *FirecrackerManager) cleanupVM(vmID string) error {
+	if m.Jailer != nil {
+		m.cleanupJail(vmID)
+	}
+	if m.Images != nil {
+		if err := m.Images.Release(vmID); err != nil {
+			log.Errorf("Failed to release image of VM %s: %v", vmID, err)
+		}
+	}
+	if err := os.RemoveAll(m.vmDir(vmID)); err != nil {
+		return fmt.Errorf("failed to remove VM directory: %v", err)
+	}
+	return nil
+}
+
+// DeleteVolume removes the volume file of namespace at path, relative to the volume directory
+func (m *FirecrackerManager) DeleteVolume(namespace, path string) error {
+	if err := CheckVolumeNamespace(path, namespace); err != nil {
+		return err
+	}
+	file, err := ResolveVolumePath(m.VolumeDir, path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove volume file %s: %v", path, err)
+	}
 	return nil
 }
 
-// ExecuteCode executes code in a Firecracker VM
+// ExecuteCode executes code in a Firecracker VM and records it in the audit log
 func (m *FirecrackerManager) ExecuteCode(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error) {
+	start := time.Now()
+
+	// Anonymous executions are rejected, and recorded as such
+	if req.UserID == "" || req.SessionID == "" {
+		err := fmt.Errorf("%w: rejected execution in VM %s", ErrNoIdentity, vmID)
+		auditExecution(m.Audit, vmID, req, start, nil, err)
+		return nil, err
+	}
+
+	resp, err := m.executeCode(ctx, vmID, req)
+	auditExecution(m.Audit, vmID, req, start, resp, err)
+	return resp, err
+}
+
+// auditExecution records an execution that started at start in l
+func auditExecution(l *audit.Logger, vmID string, req *ExecutionRequest, start time.Time, resp *ExecutionResponse, err error) {
+	event := audit.Event{
+		Time:       start.UTC(),
+		Action:     audit.ActionExecute,
+		UserID:     req.UserID,
+		GroupID:    req.GroupID,
+		SessionID:  req.SessionID,
+		VMID:       vmID,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	event.CodeSHA256, event.CodeBytes = audit.HashCode(req.Command, req.Args)
+	if err != nil {
+		event.Status = "error"
+		event.Error = err.Error()
+	} else {
+		exitCode := resp.ExitCode
+		event.ExitCode = &exitCode
+		event.Status = resp.Status
+		event.OutputBytes = len(resp.Output)
+		event.Error = resp.Error
+	}
+	l.Record(event)
+}
+
+// executeCode executes code in a Firecracker VM
+func (m *FirecrackerManager) executeCode(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error) {
 	// Check if we're on Linux
 	if runtime.GOOS != "linux" {
 		// On non-Linux platforms, just return a mock response
@@ -108,11 +843,186 @@ func (m *FirecrackerManager) ExecuteCode(ctx context.Context, vmID string, req *
 		}, nil
 	}
 
-	// On Linux, execute the code in the real VM
-	// This would use the Firecracker SDK in a real implementation
-	return &ExecutionResponse{
-		Status:   "success",
-		Output:   fmt.Sprintf("Execution of %s with args %v", req.Command, req.Args),
-		ExitCode: 0,
-	}, nil
-}
\ No newline at end of file
+	// On Linux, execute the code through the guest agent
+	vm, err := m.runningVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+	if m.isPaused(vm) {
+		return nil, fmt.Errorf("VM %s is paused", vmID)
+	}
+
+	ctx, span := tracing.Start(ctx, "ExecuteCode", attribute.String("tvm.vm", vmID), attribute.String("tvm.command", req.Command))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	resp, err := executeInGuest(ctx, vm.vsock, req)
+	if resp != nil {
+		span.SetAttributes(attribute.String("tvm.status", resp.Status), attribute.Int("tvm.exit_code", resp.ExitCode))
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (resp != nil && resp.Status == "timeout"):
+		metrics.ObserveExecution(start, "timeout")
+	case err != nil:
+		metrics.ObserveExecution(start, "error")
+	case resp.Status != "success":
+		metrics.ObserveExecution(start, "error")
+		metrics.ObserveExitCode(resp.ExitCode)
+	default:
+		metrics.ObserveExecution(start, "success")
+		metrics.ObserveExitCode(resp.ExitCode)
+	}
+	return resp, err
+}
+
+// SnapshotVM takes a full snapshot of a running VM into its directory. The
+// VM is paused while the snapshot is taken and resumed afterwards.
+func (m *FirecrackerManager) SnapshotVM(ctx context.Context, vmID, name string) (*SnapshotInfo, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, just return a mock snapshot
+		return &SnapshotInfo{Name: name}, nil
+	}
+
+	// On Linux, snapshot the real VM
+	vm, err := m.runningVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are kept in the VM directory. A jailed VMM can only write into
+	// its chroot, which is removed with the jail, so it writes them there and
+	// they are moved out afterwards.
+	dir := filepath.Join(vm.dir, "snapshots", name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	vmmDir := dir
+	if vm.jail != nil {
+		vmmDir = filepath.Join(vm.jail.root, "snapshot-"+name)
+		if err := os.MkdirAll(vmmDir, 0700); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to create snapshot directory in chroot: %v", err)
+		}
+		defer os.RemoveAll(vmmDir)
+		if err := os.Chown(vmmDir, vm.jail.uid, vm.jail.uid); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to chown snapshot directory: %v", err)
+		}
+	}
+	info := &SnapshotInfo{
+		Name:       name,
+		StatePath:  filepath.Join(dir, "vmstate"),
+		MemoryPath: filepath.Join(dir, "memory"),
+	}
+
+	// A VM paused with PauseVM is snapshotted as is and stays paused
+	paused := m.isPaused(vm)
+	if !paused {
+		if err := vm.api.do(ctx, http.MethodPatch, "/vm", vmState{State: "Paused"}); err != nil {
+			return nil, fmt.Errorf("failed to pause VM: %v", err)
+		}
+	}
+	err = vm.api.put(ctx, "/snapshot/create", snapshotCreate{
+		SnapshotType: "Full",
+		SnapshotPath: vm.vmmPath(filepath.Join(vmmDir, "vmstate")),
+		MemFilePath:  vm.vmmPath(filepath.Join(vmmDir, "memory")),
+	})
+	if !paused {
+		// Resume even if ctx is done, the VM must not stay paused
+		if resumeErr := vm.api.do(context.Background(), http.MethodPatch, "/vm", vmState{State: "Resumed"}); resumeErr != nil {
+			log.Errorf("Failed to resume VM %s after snapshot: %v", vmID, resumeErr)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	if vmmDir != dir {
+		for _, file := range []string{"vmstate", "memory"} {
+			if err := moveFile(filepath.Join(vmmDir, file), filepath.Join(dir, file)); err != nil {
+				os.RemoveAll(dir)
+				return nil, fmt.Errorf("failed to move snapshot out of chroot: %v", err)
+			}
+		}
+	}
+
+	log.Infof("Created snapshot %s of VM %s", name, vmID)
+	return info, nil
+}
+
+// PauseVM pauses the vCPUs of a running VM. Its memory stays allocated, and
+// it can't execute code until it is resumed.
+func (m *FirecrackerManager) PauseVM(ctx context.Context, vmID string) error {
+	return m.setPaused(ctx, vmID, true)
+}
+
+// ResumeVM resumes a VM paused with PauseVM
+func (m *FirecrackerManager) ResumeVM(ctx context.Context, vmID string) error {
+	return m.setPaused(ctx, vmID, false)
+}
+
+// setPaused pauses or resumes a running VM. Pausing a paused VM and resuming
+// a running one succeed.
+func (m *FirecrackerManager) setPaused(ctx context.Context, vmID string, paused bool) error {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, just record the state of the mock VM
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		vm, ok := m.vms[vmID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrVMNotFound, vmID)
+		}
+		vm.paused = paused
+		return nil
+	}
+
+	// On Linux, pause or resume the real VM
+	vm, err := m.runningVM(vmID)
+	if err != nil {
+		return err
+	}
+	state, verb := "Resumed", "resume"
+	if paused {
+		state, verb = "Paused", "pause"
+	}
+	if err := vm.api.do(ctx, http.MethodPatch, "/vm", vmState{State: state}); err != nil {
+		return fmt.Errorf("failed to %s VM: %v", verb, err)
+	}
+
+	m.mutex.Lock()
+	vm.paused = paused
+	m.mutex.Unlock()
+
+	log.Infof("%s VM %s", state, vmID)
+	return nil
+}
+
+// isPaused reports whether a VM was paused with PauseVM
+func (m *FirecrackerManager) isPaused(vm *vmInstance) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return vm.paused
+}
+
+// runningVM returns a VM whose firecracker process is running
+func (m *FirecrackerManager) runningVM(vmID string) (*vmInstance, error) {
+	m.mutex.Lock()
+	vm, ok := m.vms[vmID]
+	m.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrVMNotFound, vmID)
+	}
+
+	select {
+	case <-vm.done:
+		return nil, fmt.Errorf("VM %s is not running", vmID)
+	default:
+		return vm, nil
+	}
+}
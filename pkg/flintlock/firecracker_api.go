@@ -0,0 +1,208 @@
+package flintlock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// firecrackerAPI is a client for the Firecracker API on a VM's unix socket
+type firecrackerAPI struct {
+	socketPath string
+	client     *http.Client
+}
+
+// machineConfig is the body of PUT /machine-config
+type machineConfig struct {
+	VCPUCount  int  `json:"vcpu_count"`
+	MemSizeMib int  `json:"mem_size_mib"`
+	SMT        bool `json:"smt"`
+}
+
+// bootSource is the body of PUT /boot-source
+type bootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	BootArgs        string `json:"boot_args,omitempty"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
+}
+
+// drive is the body of PUT /drives/{drive_id}
+type drive struct {
+	DriveID      string       `json:"drive_id"`
+	PathOnHost   string       `json:"path_on_host"`
+	IsRootDevice bool         `json:"is_root_device"`
+	IsReadOnly   bool         `json:"is_read_only"`
+	RateLimiter  *rateLimiter `json:"rate_limiter,omitempty"`
+}
+
+// rateLimiter limits the I/O of a drive or network interface
+type rateLimiter struct {
+	Bandwidth *tokenBucket `json:"bandwidth,omitempty"`
+	Ops       *tokenBucket `json:"ops,omitempty"`
+}
+
+// tokenBucket refills size tokens every refill_time milliseconds
+type tokenBucket struct {
+	Size         int64 `json:"size"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+	RefillTime   int64 `json:"refill_time"`
+}
+
+// newRateLimiter converts a rate limit to the rate limiter of Firecracker, nil if unlimited
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	limiter := &rateLimiter{}
+	if limit.BandwidthBytesPerSec > 0 {
+		limiter.Bandwidth = &tokenBucket{Size: limit.BandwidthBytesPerSec, OneTimeBurst: limit.BandwidthBurstBytes, RefillTime: 1000}
+	}
+	if limit.OpsPerSec > 0 {
+		limiter.Ops = &tokenBucket{Size: limit.OpsPerSec, OneTimeBurst: limit.OpsBurst, RefillTime: 1000}
+	}
+	if limiter.Bandwidth == nil && limiter.Ops == nil {
+		return nil
+	}
+	return limiter
+}
+
+// instanceAction is the body of PUT /actions
+type instanceAction struct {
+	ActionType string `json:"action_type"`
+}
+
+// vsockDevice is the body of PUT /vsock
+type vsockDevice struct {
+	GuestCID uint32 `json:"guest_cid"`
+	UDSPath  string `json:"uds_path"`
+}
+
+// vmState is the body of PATCH /vm
+type vmState struct {
+	State string `json:"state"`
+}
+
+// balloon is the body of PUT /balloon
+type balloon struct {
+	AmountMib             int  `json:"amount_mib"`
+	DeflateOnOOM          bool `json:"deflate_on_oom"`
+	StatsPollingIntervalS int  `json:"stats_polling_interval_s"`
+}
+
+// balloonUpdate is the body of PATCH /balloon
+type balloonUpdate struct {
+	AmountMib int `json:"amount_mib"`
+}
+
+// balloonStatistics is the response of GET /balloon/statistics
+type balloonStatistics struct {
+	TargetMib       int64 `json:"target_mib"`
+	ActualMib       int64 `json:"actual_mib"`
+	MajorFaults     int64 `json:"major_faults"`
+	MinorFaults     int64 `json:"minor_faults"`
+	FreeMemory      int64 `json:"free_memory"`
+	TotalMemory     int64 `json:"total_memory"`
+	AvailableMemory int64 `json:"available_memory"`
+}
+
+// snapshotCreate is the body of PUT /snapshot/create
+type snapshotCreate struct {
+	SnapshotType string `json:"snapshot_type"`
+	SnapshotPath string `json:"snapshot_path"`
+	MemFilePath  string `json:"mem_file_path"`
+}
+
+// newFirecrackerAPI creates a client for the API socket at socketPath
+func newFirecrackerAPI(socketPath string) *firecrackerAPI {
+	return &firecrackerAPI{
+		socketPath: socketPath,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// waitForSocket waits until the API socket has been created by Firecracker
+func (a *firecrackerAPI) waitForSocket(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(a.socketPath); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("timed out waiting for firecracker API socket %s", a.socketPath)
+}
+
+// put sends a PUT request with a JSON body to the API
+func (a *firecrackerAPI) put(ctx context.Context, path string, body interface{}) error {
+	return a.do(ctx, http.MethodPut, path, body)
+}
+
+// get sends a GET request to the API and decodes its JSON response into result
+func (a *firecrackerAPI) get(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call firecracker API GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("firecracker API GET %s returned %d: %s", path, resp.StatusCode, string(msg))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode firecracker API GET %s: %v", path, err)
+	}
+	return nil
+}
+
+// do sends a request with a JSON body to the API and checks the response status
+func (a *firecrackerAPI) do(ctx context.Context, method, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call firecracker API %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("firecracker API %s %s returned %d: %s", method, path, resp.StatusCode, string(msg))
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package flintlock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+)
+
+func TestVMExitEvents(t *testing.T) {
+	crash := errors.New("signal: killed")
+	tests := []struct {
+		name string
+		// exit runs the exit watcher and registration of vm in order
+		exit func(m *FirecrackerManager, vm *vmInstance)
+		want []v1alpha1.MicroVMState
+	}{
+		{
+			name: "exits while running",
+			exit: func(m *FirecrackerManager, vm *vmInstance) {
+				m.register(vm)
+				m.vmExited(vm, crash)
+			},
+			want: []v1alpha1.MicroVMState{v1alpha1.MicroVMStateError},
+		},
+		{
+			name: "exits before it is registered",
+			exit: func(m *FirecrackerManager, vm *vmInstance) {
+				m.vmExited(vm, crash)
+				m.register(vm)
+			},
+			want: []v1alpha1.MicroVMState{v1alpha1.MicroVMStateError},
+		},
+		{
+			name: "shuts down before it is registered",
+			exit: func(m *FirecrackerManager, vm *vmInstance) {
+				vm.exitErr = nil
+				m.vmExited(vm, nil)
+				m.register(vm)
+			},
+			want: []v1alpha1.MicroVMState{v1alpha1.MicroVMStateStopped},
+		},
+		{
+			name: "fails to boot",
+			exit: func(m *FirecrackerManager, vm *vmInstance) {
+				m.vmExited(vm, crash)
+			},
+		},
+		{
+			name: "is deleted",
+			exit: func(m *FirecrackerManager, vm *vmInstance) {
+				m.register(vm)
+				delete(m.vms, vm.id)
+				m.vmExited(vm, crash)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &FirecrackerManager{vms: make(map[string]*vmInstance), events: make(chan VMEvent, 10)}
+			vm := &vmInstance{id: "vm-1", exitErr: crash}
+			tt.exit(m, vm)
+			close(m.events)
+
+			var got []v1alpha1.MicroVMState
+			for event := range m.events {
+				if event.VMID != vm.id {
+					t.Errorf("event of VM %s, want %s", event.VMID, vm.id)
+				}
+				got = append(got, event.State)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("published %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("published %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
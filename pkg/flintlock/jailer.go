@@ -0,0 +1,312 @@
+package flintlock
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultJailerUIDBase is the first UID and GID given to jailed VMs
+	DefaultJailerUIDBase = 200000
+	// DefaultJailerUIDCount is the number of UIDs available to jailed VMs
+	DefaultJailerUIDCount = 10000
+	// DefaultJailerCgroupParent is the cgroup the cgroups of jailed VMs are created in
+	DefaultJailerCgroupParent = "firecracker"
+
+	// jailAPISocket is the API socket of a jailed VMM, inside its chroot
+	jailAPISocket = "/run/firecracker.socket"
+	// jailNetnsDir holds the network namespaces created with ip netns
+	jailNetnsDir = "/var/run/netns"
+	// cgroupRoot is where the cgroup v2 hierarchy is mounted
+	cgroupRoot = "/sys/fs/cgroup"
+	// vmmOverheadMB is the memory of the VMM itself on top of the guest memory
+	vmmOverheadMB = 64
+	// cpuPeriod is the cpu.max period, in microseconds
+	cpuPeriod = 100000
+)
+
+// JailerConfig runs VMs under the Firecracker jailer, each with its own UID
+// and GID, chroot, cgroup and network namespace, so a VMM escape doesn't land
+// as root on the node
+type JailerConfig struct {
+	// Binary is the path of the jailer binary
+	Binary string
+	// ChrootBase holds the chroots, BaseDir/jailer if empty
+	ChrootBase string
+	// CgroupParent is the cgroup, relative to the cgroup v2 root, VM cgroups are created in
+	CgroupParent string
+	// UIDBase and UIDCount are the range of UIDs given to VMs
+	UIDBase  int
+	UIDCount int
+}
+
+// jail is where a jailed VM runs
+type jail struct {
+	uid int
+	// root is the chroot of the VM on the host
+	root string
+	// files maps the host paths of the files of the VM to their paths in the chroot
+	files map[string]string
+	// netns is the name of the network namespace of the VM
+	netns string
+}
+
+// jailChrootBase returns the directory the chroots are created in
+func (m *FirecrackerManager) jailChrootBase() string {
+	if m.Jailer.ChrootBase != "" {
+		return m.Jailer.ChrootBase
+	}
+	return filepath.Join(m.BaseDir, "jailer")
+}
+
+// jailDir returns the directory the jailer creates for a VM, holding its chroot
+func (m *FirecrackerManager) jailDir(vmID string) string {
+	return filepath.Join(m.jailChrootBase(), filepath.Base(m.FirecrackerBinary), vmID)
+}
+
+// jailCgroup returns the cgroup the jailer creates for a VM
+func (m *FirecrackerManager) jailCgroup(vmID string) string {
+	return filepath.Join(cgroupRoot, m.Jailer.CgroupParent, vmID)
+}
+
+// jailNetns returns the name of the network namespace of a VM
+func jailNetns(vmID string) string {
+	return "tvm-" + vmID
+}
+
+// allocateUID reserves a free UID of the jailer range for a VM
+func (m *FirecrackerManager) allocateUID(vmID string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.jailUIDs == nil {
+		m.jailUIDs = make(map[int]string)
+	}
+	for uid := m.Jailer.UIDBase; uid < m.Jailer.UIDBase+m.Jailer.UIDCount; uid++ {
+		if _, used := m.jailUIDs[uid]; !used {
+			m.jailUIDs[uid] = vmID
+			return uid, nil
+		}
+	}
+	return 0, fmt.Errorf("no free jailer UID, all %d are used", m.Jailer.UIDCount)
+}
+
+// releaseUID frees the UID of a VM and returns the files shared with it
+func (m *FirecrackerManager) releaseUID(vmID string) (int, []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	uid := -1
+	for u, id := range m.jailUIDs {
+		if id == vmID {
+			uid = u
+			delete(m.jailUIDs, u)
+		}
+	}
+	grants := m.jailGrants[vmID]
+	delete(m.jailGrants, vmID)
+	return uid, grants
+}
+
+// share links a file the VM uses but doesn't own, such as the backing file
+// of a volume, into the chroot. The VM is given access with an ACL entry
+// rather than by changing the owner of the file, and cleanupJail revokes it.
+func (m *FirecrackerManager) share(vmID string, j *jail, hostPath, name string, writable bool) error {
+	perms := "r"
+	if writable {
+		perms = "rw"
+	}
+	if err := runJailTool(context.Background(), "setfacl", "-m", fmt.Sprintf("u:%d:%s", j.uid, perms), hostPath); err != nil {
+		return fmt.Errorf("failed to give VM access to %s: %v", hostPath, err)
+	}
+
+	m.mutex.Lock()
+	if m.jailGrants == nil {
+		m.jailGrants = make(map[string][]string)
+	}
+	m.jailGrants[vmID] = append(m.jailGrants[vmID], hostPath)
+	m.mutex.Unlock()
+
+	return j.link(hostPath, name, false)
+}
+
+// jailCommand prepares the chroot and network namespace of a VM and returns
+// the jailer command starting its VMM, along with the jail
+func (m *FirecrackerManager) jailCommand(ctx context.Context, vmID string, config VMConfig) (*exec.Cmd, *jail, error) {
+	execFile, err := exec.LookPath(m.FirecrackerBinary)
+	if err != nil {
+		return nil, nil, fmt.Errorf("firecracker binary not found: %v", err)
+	}
+	execFile, err = filepath.Abs(execFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, err := m.allocateUID(vmID)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &jail{
+		uid:   uid,
+		root:  filepath.Join(m.jailDir(vmID), "root"),
+		files: make(map[string]string),
+		netns: jailNetns(vmID),
+	}
+
+	// The VMM only sees what is placed in its chroot
+	if err := os.MkdirAll(filepath.Join(j.root, "run"), 0755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create chroot: %v", err)
+	}
+	if err := os.Chown(filepath.Join(j.root, "run"), uid, uid); err != nil {
+		return nil, nil, fmt.Errorf("failed to chown chroot: %v", err)
+	}
+	if err := j.link(config.Kernel, "vmlinux", false); err != nil {
+		return nil, nil, err
+	}
+	if config.Initrd != "" {
+		if err := j.link(config.Initrd, "initrd", false); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := j.link(config.Rootfs, "rootfs.ext4", true); err != nil {
+		return nil, nil, err
+	}
+	for _, d := range config.Drives {
+		// Ephemeral drives belong to the VM, file backed ones are shared
+		if withinDir(m.vmDir(vmID), d.PathOnHost) {
+			err = j.link(d.PathOnHost, d.ID+".img", !d.ReadOnly)
+		} else {
+			err = m.share(vmID, j, d.PathOnHost, d.ID+".img", !d.ReadOnly)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	vmmArgs := []string{"--api-sock", jailAPISocket}
+	if m.SeccompFilter != "" {
+		if err := j.link(m.SeccompFilter, "seccomp.bpf", false); err != nil {
+			return nil, nil, err
+		}
+		vmmArgs = append(vmmArgs, "--seccomp-filter", j.path(m.SeccompFilter))
+	}
+
+	// An empty network namespace, the VM is only reached over vsock
+	if err := runJailTool(ctx, "ip", "netns", "add", j.netns); err != nil {
+		return nil, nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
+
+	vcpu := config.VCPU
+	if vcpu < 1 {
+		vcpu = 1
+	}
+	memoryMB := config.Memory
+	if memoryMB < 1 {
+		memoryMB = 128
+	}
+	args := []string{
+		"--id", vmID,
+		"--exec-file", execFile,
+		"--uid", strconv.Itoa(uid),
+		"--gid", strconv.Itoa(uid),
+		"--chroot-base-dir", m.jailChrootBase(),
+		"--netns", filepath.Join(jailNetnsDir, j.netns),
+		"--cgroup-version", "2",
+		"--parent-cgroup", m.Jailer.CgroupParent,
+		"--cgroup", fmt.Sprintf("cpu.max=%d %d", vcpu*cpuPeriod, cpuPeriod),
+		"--cgroup", fmt.Sprintf("memory.max=%d", int64(memoryMB+vmmOverheadMB)<<20),
+		"--",
+	}
+	cmd := exec.Command(m.Jailer.Binary, append(args, vmmArgs...)...)
+	return cmd, j, nil
+}
+
+// link places the file at hostPath in the chroot as name, owned by the VM if
+// it is writable, which is only done for the files of the VM itself. Files on
+// another filesystem are bind mounted.
+func (j *jail) link(hostPath, name string, writable bool) error {
+	path := filepath.Join(j.root, name)
+	if err := os.Link(hostPath, path); err != nil {
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			return fmt.Errorf("failed to place %s in chroot: %v", hostPath, err)
+		}
+		if err := runJailTool(context.Background(), "mount", "--bind", hostPath, path); err != nil {
+			return fmt.Errorf("failed to bind mount %s into chroot: %v", hostPath, err)
+		}
+	}
+	if writable {
+		if err := os.Chown(hostPath, j.uid, j.uid); err != nil {
+			return fmt.Errorf("failed to chown %s: %v", hostPath, err)
+		}
+	}
+	j.files[hostPath] = "/" + name
+	return nil
+}
+
+// path returns the path of a host file as the jailed VMM sees it
+func (j *jail) path(hostPath string) string {
+	if p, ok := j.files[hostPath]; ok {
+		return p
+	}
+	if rel, err := filepath.Rel(j.root, hostPath); err == nil && !strings.HasPrefix(rel, "..") {
+		return "/" + rel
+	}
+	return hostPath
+}
+
+// cleanupJail removes the chroot, cgroup and network namespace of a VM and
+// frees its UID. Its VMM must have exited.
+func (m *FirecrackerManager) cleanupJail(vmID string) {
+	dir := m.jailDir(vmID)
+
+	// Unmount the files bind mounted into the chroot before removing it, so
+	// their sources are left alone
+	if entries, err := ioutil.ReadDir(filepath.Join(dir, "root")); err == nil {
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() {
+				exec.Command("umount", "-l", filepath.Join(dir, "root", entry.Name())).Run()
+			}
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("Failed to remove chroot of VM %s: %v", vmID, err)
+	}
+
+	if err := os.Remove(m.jailCgroup(vmID)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove cgroup of VM %s: %v", vmID, err)
+	}
+
+	netns := jailNetns(vmID)
+	if _, err := os.Stat(filepath.Join(jailNetnsDir, netns)); err == nil {
+		if err := runJailTool(context.Background(), "ip", "netns", "delete", netns); err != nil {
+			log.Errorf("Failed to remove network namespace of VM %s: %v", vmID, err)
+		}
+	}
+
+	// Revoke the access to the files shared with the VM, its UID is reused
+	uid, grants := m.releaseUID(vmID)
+	for _, path := range grants {
+		if err := runJailTool(context.Background(), "setfacl", "-x", fmt.Sprintf("u:%d", uid), path); err != nil {
+			log.Errorf("Failed to revoke access of VM %s to %s: %v", vmID, path, err)
+		}
+	}
+}
+
+// runJailTool runs a tool setting up or tearing down a jail
+func runJailTool(ctx context.Context, name string, args ...string) error {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%s failed: %s", name, strings.TrimSpace(string(output)))
+		}
+		return fmt.Errorf("failed to run %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package flintlock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+)
+
+const (
+	// DefaultKernelDir is the node directory holding the kernel catalog
+	DefaultKernelDir = "/var/lib/flintlock/kernels"
+
+	// kernelFile and initrdFile are the files of a catalog entry
+	kernelFile = "vmlinux"
+	initrdFile = "initrd"
+
+	// defaultKernelFilename is the path of the kernel inside a kernel image
+	defaultKernelFilename = "boot/vmlinux"
+)
+
+var kernelNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]*[a-z0-9])?$`)
+
+// KernelCatalog is a directory of named kernels on a node. Each kernel is a
+// subdirectory holding a vmlinux and optionally an initrd, e.g.
+// <dir>/linux-6.1/vmlinux and <dir>/linux-6.1/initrd.
+type KernelCatalog struct {
+	Dir string
+}
+
+// NewKernelCatalog creates a catalog of the kernels in dir
+func NewKernelCatalog(dir string) *KernelCatalog {
+	return &KernelCatalog{Dir: dir}
+}
+
+// Kernel returns the path of a named kernel
+func (c *KernelCatalog) Kernel(name string) (string, error) {
+	return c.lookup(name, kernelFile)
+}
+
+// Initrd returns the path of the initrd of a named kernel
+func (c *KernelCatalog) Initrd(name string) (string, error) {
+	return c.lookup(name, initrdFile)
+}
+
+// lookup returns the path of a file of a catalog entry, checking it exists
+func (c *KernelCatalog) lookup(name, file string) (string, error) {
+	if !kernelNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid kernel name %q", name)
+	}
+
+	path := filepath.Join(c.Dir, name, file)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("kernel %s has no %s on this node", name, file)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s of kernel %s: %v", file, name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s of kernel %s is not a regular file", file, name)
+	}
+	return path, nil
+}
+
+// ValidateKernel checks a kernel spec for errors that don't depend on the node
+func ValidateKernel(spec *v1alpha1.KernelSpec) error {
+	if spec == nil {
+		return nil
+	}
+
+	if (spec.Name == "") == (spec.Image == "") {
+		return fmt.Errorf("kernel must set exactly one of name and image")
+	}
+	if spec.Filename != "" && spec.Image == "" {
+		return fmt.Errorf("kernel filename requires a kernel image")
+	}
+
+	for _, arg := range spec.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"") {
+			return fmt.Errorf("invalid kernel argument %q", arg)
+		}
+	}
+
+	if initrd := spec.Initrd; initrd != nil {
+		if (initrd.Name == "") == (initrd.Image == "") {
+			return fmt.Errorf("initrd must set exactly one of name and image")
+		}
+		if initrd.Filename != "" && initrd.Image == "" {
+			return fmt.Errorf("initrd filename requires an initrd image")
+		}
+	}
+	return nil
+}
+
+// kernelCmdline converts kernel arguments to the key value form used by
+// Flintlock. Flags without a value map to an empty value.
+func kernelCmdline(args []string) map[string]string {
+	if len(args) == 0 {
+		return nil
+	}
+
+	cmdline := make(map[string]string, len(args))
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		cmdline[key] = value
+	}
+	return cmdline
+}
@@ -0,0 +1,164 @@
+package flintlock
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/metrics"
+	"github.com/yourusername/tvm/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// retryAttempts is the number of times a call is tried
+	retryAttempts = 4
+	// retryBackoffBase is the delay before the first retry, doubled for each further one
+	retryBackoffBase = 200 * time.Millisecond
+	// retryBackoffMax caps the delay between retries
+	retryBackoffMax = 5 * time.Second
+
+	// breakerThreshold is the number of consecutive failures that open the circuit
+	breakerThreshold = 5
+	// breakerCooldown is how long the circuit stays open before a call is let through
+	breakerCooldown = 30 * time.Second
+)
+
+// Caller makes the calls to one endpoint, retrying transient failures with
+// jittered exponential backoff. After repeated failures its circuit opens and
+// calls fail fast with ErrUnavailable until a trial call succeeds.
+type Caller struct {
+	endpoint string
+
+	// failures is the number of consecutive failed calls
+	failures int
+	// openUntil is when an open circuit lets a trial call through
+	openUntil time.Time
+	// probing is set while the trial call of a half-open circuit runs
+	probing bool
+	mutex   sync.Mutex
+}
+
+// NewCaller creates a Caller for endpoint
+func NewCaller(endpoint string) *Caller {
+	return &Caller{endpoint: endpoint}
+}
+
+// Call calls fn until it succeeds, fails permanently, runs out of attempts or
+// ctx is done, and wraps its error with WrapError. Calls that are not
+// idempotent are only retried when they didn't reach the server.
+func (c *Caller) Call(ctx context.Context, op string, idempotent bool, fn func(ctx context.Context) error) (err error) {
+	ctx, span := tracing.Start(ctx, op, attribute.String("tvm.backend.endpoint", c.endpoint))
+	defer func() { tracing.End(span, err) }()
+
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		span.SetAttributes(attribute.Int("tvm.backend.attempts", attempt+1))
+		if attempt > 0 {
+			delay := retryBackoff(attempt)
+			log.Debugf("Retrying %s on %s in %s: %v", op, c.endpoint, delay, err)
+			select {
+			case <-ctx.Done():
+				return WrapError(op, err)
+			case <-time.After(delay):
+			}
+		}
+
+		if !c.allow() {
+			return fmt.Errorf("failed to %s: %w: circuit breaker for %s is open", op, ErrUnavailable, c.endpoint)
+		}
+
+		err = fn(ctx)
+		c.record(ctx, err)
+		if err == nil {
+			return nil
+		}
+		metrics.BackendErrors.WithLabelValues(op, status.Code(err).String()).Inc()
+		if !retryable(err, idempotent) || ctx.Err() != nil {
+			break
+		}
+	}
+	return WrapError(op, err)
+}
+
+// allow reports whether a call may be made. An open circuit lets one trial
+// call through once its cooldown passed.
+func (c *Caller) allow() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.failures < breakerThreshold {
+		return true
+	}
+	if c.probing || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// record updates the circuit with the result of a call. Only failures to
+// reach the endpoint count, errors returned by the server don't, and neither
+// do failures caused by the caller canceling the call or its deadline.
+func (c *Caller) record(ctx context.Context, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.probing = false
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err != nil && unreachable(err) {
+		c.failures++
+		if c.failures >= breakerThreshold {
+			if c.failures == breakerThreshold {
+				log.Warnf("Opening circuit breaker for %s after %d failures: %v", c.endpoint, c.failures, err)
+			}
+			c.openUntil = time.Now().Add(breakerCooldown)
+		}
+		return
+	}
+
+	if c.failures >= breakerThreshold {
+		log.Infof("Closing circuit breaker for %s", c.endpoint)
+	}
+	c.failures = 0
+}
+
+// unreachable reports whether an error means the endpoint couldn't serve the call
+func unreachable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a failed call may be repeated
+func retryable(err error, idempotent bool) bool {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded:
+		// The call may have been executed before the deadline hit
+		return idempotent
+	}
+	return false
+}
+
+// retryBackoff returns the delay before the given retry, a random duration
+// between half and all of the exponential backoff
+func retryBackoff(attempt int) time.Duration {
+	backoff := retryBackoffBase
+	for i := 1; i < attempt && backoff < retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > retryBackoffMax {
+		backoff = retryBackoffMax
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
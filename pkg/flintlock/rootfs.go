@@ -0,0 +1,194 @@
+package flintlock
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Methods used to give a VM its own copy of a base rootfs
+const (
+	// RootfsMethodReflink shares the blocks of the base image until they are written
+	RootfsMethodReflink = "reflink"
+	// RootfsMethodCopy is a sparse full copy of the base image
+	RootfsMethodCopy = "copy"
+)
+
+// ioctl numbers for cloning files and mapping their extents on Linux
+const (
+	ioctlFICLONE     = 0x40049409
+	ioctlFSIOCFIEMAP = 0xC020660B
+
+	fiemapFlagSync     = 0x1
+	fiemapExtentLast   = 0x1
+	fiemapExtentShared = 0x2000
+	fiemapBatch        = 256
+)
+
+// fiemap is struct fiemap from linux/fiemap.h
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+}
+
+// fiemapExtent is struct fiemap_extent from linux/fiemap.h
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// cloneRootfs gives a VM a private writable copy of a base rootfs at target.
+// Where the filesystem supports reflinks the copy shares all blocks with the
+// base until they are written, otherwise the base is copied sparsely.
+func cloneRootfs(base, target string) (string, error) {
+	src, err := os.Open(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to open base rootfs: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create rootfs: %v", err)
+	}
+	defer dst.Close()
+
+	if runtime.GOOS == "linux" {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ioctlFICLONE, src.Fd())
+		if errno == 0 {
+			return RootfsMethodReflink, nil
+		}
+		log.Debugf("Reflink of %s not supported, copying: %v", base, errno)
+	}
+
+	if err := sparseCopy(dst, src); err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to copy rootfs: %v", err)
+	}
+	return RootfsMethodCopy, nil
+}
+
+// moveFile moves the file src to dst, copying it when they are on different
+// filesystems. The moved file is owned by the agent.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return os.Chown(dst, os.Getuid(), os.Getgid())
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := sparseCopy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// sparseCopy copies src to dst, leaving holes where src has zero blocks
+func sparseCopy(dst, src *os.File) error {
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	var size int64
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := dst.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Trailing holes are only materialised by setting the size
+	return dst.Truncate(size)
+}
+
+// rootfsDelta returns the number of bytes a VM's rootfs uses on top of its base
+// image. For reflinked copies these are the extents no longer shared with the
+// base, for full copies the whole allocated size of the file.
+func rootfsDelta(path, method string) (int64, error) {
+	if method != RootfsMethodReflink || runtime.GOOS != "linux" {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			return 0, err
+		}
+		return int64(st.Blocks) * 512, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// struct fiemap followed by its extent array
+	buf := make([]byte, unsafe.Sizeof(fiemap{})+fiemapBatch*unsafe.Sizeof(fiemapExtent{}))
+	header := (*fiemap)(unsafe.Pointer(&buf[0]))
+	extents := (*[fiemapBatch]fiemapExtent)(unsafe.Pointer(&buf[unsafe.Sizeof(fiemap{})]))
+
+	var delta int64
+	var start uint64
+	for {
+		*header = fiemap{
+			start:       start,
+			length:      ^uint64(0) - start,
+			flags:       fiemapFlagSync,
+			extentCount: fiemapBatch,
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlFSIOCFIEMAP, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return 0, errno
+		}
+		if header.mappedExtents == 0 {
+			return delta, nil
+		}
+
+		for i := uint32(0); i < header.mappedExtents; i++ {
+			extent := &extents[i]
+			if extent.flags&fiemapExtentShared == 0 {
+				delta += int64(extent.length)
+			}
+			if extent.flags&fiemapExtentLast != 0 {
+				return delta, nil
+			}
+			start = extent.logical + extent.length
+		}
+	}
+}
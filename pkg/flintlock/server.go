@@ -1,21 +1,53 @@
 package flintlock
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/tracing"
 )
 
-// Server represents the flintlock server
+const (
+	// requestsDir holds the execution requests, one <id>.json file each
+	requestsDir = "requests"
+	// processingDir holds the requests being executed
+	processingDir = "processing"
+	// responsesDir holds the execution responses, one <id>.json file each
+	responsesDir = "responses"
+
+	// DefaultResponseTTL is how long uncollected responses are kept
+	DefaultResponseTTL = 10 * time.Minute
+
+	// cleanupInterval is how often stale files are removed
+	cleanupInterval = time.Minute
+)
+
+// Server serves the file based hand-off of execution requests on a directory
+// shared with lime-ctrl. Clients write each request to its own file under a
+// unique ID and the response is written back under the same ID, so any number
+// of executions can be in flight.
 type Server struct {
 	// Base directory for flintlock data
 	BaseDir string
+	// Execute runs a request in a VM
+	Execute func(ctx context.Context, vmID string, req *ExecutionRequest) (*ExecutionResponse, error)
+	// ResponseTTL is how long uncollected responses and abandoned files are kept
+	ResponseTTL time.Duration
 	// Stop channel
 	stopCh chan struct{}
+	// ctx is cancelled on Stop to abort the in-flight executions
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 // NewServer creates a new flintlock server
@@ -26,14 +58,19 @@ func NewServer(baseDir string) (*Server, error) {
 	}
 
 	// Create directories for requests and responses
-	microVMsDir := filepath.Join(baseDir, "microvms")
-	if err := os.MkdirAll(microVMsDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create microvms directory: %v", err)
+	for _, dir := range []string{requestsDir, processingDir, responsesDir} {
+		if err := os.MkdirAll(filepath.Join(baseDir, "microvms", dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create %s directory: %v", dir, err)
+		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		BaseDir: baseDir,
-		stopCh:  make(chan struct{}),
+		BaseDir:     baseDir,
+		ResponseTTL: DefaultResponseTTL,
+		stopCh:      make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
 	}, nil
 }
 
@@ -41,87 +78,259 @@ func NewServer(baseDir string) (*Server, error) {
 func (s *Server) Start() error {
 	log.Info("Starting flintlock server...")
 
-	// Start request handlers
-	go s.handleRequests()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %v", err)
+	}
+	if err := watcher.Add(s.dir(requestsDir)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch requests: %v", err)
+	}
+
+	// Answer the requests interrupted by a restart, then pick up the ones
+	// written while the server was down
+	s.failInterrupted()
+	s.scanRequests()
+
+	go s.handleRequests(watcher)
+	go s.cleanup()
 
 	return nil
 }
 
-// Stop stops the flintlock server
+// Stop stops the flintlock server and cancels the in-flight executions
 func (s *Server) Stop() error {
 	log.Info("Stopping flintlock server...")
 	close(s.stopCh)
+	s.cancel()
+	s.wg.Wait()
 	return nil
 }
 
-// handleRequests handles all requests
-func (s *Server) handleRequests() {
-	requestFile := filepath.Join(s.BaseDir, "microvms", "requests.txt")
-	responseFile := filepath.Join(s.BaseDir, "microvms", "response.txt")
-	executeRequestFile := filepath.Join(s.BaseDir, "microvms", "execute_request.txt")
-	executeResponseFile := filepath.Join(s.BaseDir, "microvms", "execute_response.txt")
+// dir returns a directory of the protocol
+func (s *Server) dir(name string) string {
+	return filepath.Join(s.BaseDir, "microvms", name)
+}
+
+// handleRequests starts an execution for every request renamed into place
+func (s *Server) handleRequests(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
 
 	for {
 		select {
 		case <-s.stopCh:
 			return
-		default:
-			// Check if there's a request file
-			if _, err := os.Stat(requestFile); err == nil {
-				log.Info("Processing request...")
-
-				// Read request
-				_, err := ioutil.ReadFile(requestFile)
-				if err != nil {
-					log.Errorf("Failed to read request file: %v", err)
-					continue
-				}
-
-				// Write response
-				if err := ioutil.WriteFile(responseFile, []byte("Request processed"), 0644); err != nil {
-					log.Errorf("Failed to write response file: %v", err)
-					continue
-				}
-
-				// Remove request file
-				if err := os.Remove(requestFile); err != nil {
-					log.Errorf("Failed to remove request file: %v", err)
-				}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if id, ok := requestID(filepath.Base(event.Name)); ok {
+				s.claim(id)
 			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, so look for requests directly
+			log.Errorf("Watcher error: %v", err)
+			s.scanRequests()
+		}
+	}
+}
+
+// scanRequests claims all requests waiting in the requests directory
+func (s *Server) scanRequests() {
+	files, err := ioutil.ReadDir(s.dir(requestsDir))
+	if err != nil {
+		log.Errorf("Failed to list requests: %v", err)
+		return
+	}
+	for _, f := range files {
+		if id, ok := requestID(f.Name()); ok {
+			s.claim(id)
+		}
+	}
+}
+
+// claim moves a request to the processing directory and executes it. The
+// rename fails for requests already claimed, so each one runs once.
+func (s *Server) claim(id string) {
+	name := id + ".json"
+	processing := filepath.Join(s.dir(processingDir), name)
+	if err := os.Rename(filepath.Join(s.dir(requestsDir), name), processing); err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to claim request %s: %v", id, err)
+		}
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.process(id, processing)
+	}()
+}
+
+// process executes a claimed request and writes its response
+func (s *Server) process(id, path string) {
+	defer os.Remove(path)
+
+	log.Infof("Processing execute request %s...", id)
+	resp := s.execute(path)
+	if err := s.respond(id, resp); err != nil {
+		log.Errorf("Failed to write response to request %s: %v", id, err)
+		return
+	}
+	log.Infof("Processed execute request %s: %s", id, resp.Status)
+}
+
+// execute runs the request in path, failures are reported in the response
+func (s *Server) execute(path string) *ExecutionResponse {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errorResponse(fmt.Errorf("failed to read request: %v", err))
+	}
+	var req ExecutionRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return errorResponse(fmt.Errorf("failed to parse request: %v", err))
+	}
+	if s.Execute == nil {
+		return errorResponse(fmt.Errorf("no executor configured"))
+	}
+
+	resp, err := s.Execute(tracing.Extract(s.ctx, req.Trace), req.VMID, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resp
+}
+
+// respond writes the response to a request into place
+func (s *Server) respond(id string, resp *ExecutionResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %v", err)
+	}
+	return writeFileAtomic(s.dir(responsesDir), id+".json", data)
+}
+
+// failInterrupted answers the requests whose execution was interrupted by a restart
+func (s *Server) failInterrupted() {
+	files, err := ioutil.ReadDir(s.dir(processingDir))
+	if err != nil {
+		log.Errorf("Failed to list interrupted requests: %v", err)
+		return
+	}
+	for _, f := range files {
+		id, ok := requestID(f.Name())
+		if !ok {
+			continue
+		}
+		log.Warnf("Execute request %s was interrupted by a restart", id)
+		if err := s.respond(id, errorResponse(fmt.Errorf("execution interrupted by a flintlock restart"))); err != nil {
+			log.Errorf("Failed to write response to request %s: %v", id, err)
+		}
+		os.Remove(filepath.Join(s.dir(processingDir), f.Name()))
+	}
+}
+
+// cleanup periodically removes stale responses and abandoned temporary files
+func (s *Server) cleanup() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
 
-			// Check if there's an execute request file
-			if _, err := os.Stat(executeRequestFile); err == nil {
-				log.Info("Processing execute request...")
-
-				// Read request
-				_, err := ioutil.ReadFile(executeRequestFile)
-				if err != nil {
-					log.Errorf("Failed to read execute request file: %v", err)
-					continue
-				}
-
-				// Create response
-				response := &ExecutionResponse{
-					Status:   "success",
-					Output:   "Mock execution output",
-					ExitCode: 0,
-				}
-
-				// Write response
-				responseText := fmt.Sprintf("=== Execution Output ===\n%s\n=== End of Execution ===\nExit code: %d", response.Output, response.ExitCode)
-				if err := ioutil.WriteFile(executeResponseFile, []byte(responseText), 0644); err != nil {
-					log.Errorf("Failed to write execute response file: %v", err)
-					continue
-				}
-
-				// Remove request file
-				if err := os.Remove(executeRequestFile); err != nil {
-					log.Errorf("Failed to remove execute request file: %v", err)
-				}
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			for _, dir := range []string{requestsDir, responsesDir} {
+				removeStale(s.dir(dir), s.ResponseTTL, dir == responsesDir)
 			}
+		}
+	}
+}
+
+// removeStale removes the temporary files in dir older than ttl, and the
+// other files as well if all is set
+func removeStale(dir string, ttl time.Duration, all bool) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Errorf("Failed to list %s: %v", dir, err)
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) < ttl || (!all && !strings.HasSuffix(f.Name(), ".tmp")) {
+			continue
+		}
+		log.Infof("Removing stale file %s", f.Name())
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to remove stale file %s: %v", f.Name(), err)
+		}
+	}
+}
+
+// errorResponse reports a failed execution
+func errorResponse(err error) *ExecutionResponse {
+	return &ExecutionResponse{
+		Status:   "error",
+		ExitCode: -1,
+		Error:    err.Error(),
+	}
+}
+
+// requestID returns the ID of a request or response file name. Temporary
+// files, which are hidden, have no ID.
+func requestID(name string) (string, bool) {
+	id := strings.TrimSuffix(name, ".json")
+	if id == name || !validRequestID(id) {
+		return "", false
+	}
+	return id, true
+}
 
-			// Sleep for a bit
-			time.Sleep(1 * time.Second)
+// validRequestID reports whether id is safe to use as a file name
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
 		}
 	}
-}
\ No newline at end of file
+	return true
+}
+
+// writeFileAtomic writes data to a hidden temporary file in dir and renames it
+// to name, so readers never see a partial file
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, "."+name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set permissions: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to move file into place: %v", err)
+	}
+	return nil
+}
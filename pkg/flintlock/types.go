@@ -2,10 +2,18 @@ package flintlock
 
 // ExecutionRequest represents a request to execute code in a VM
 type ExecutionRequest struct {
+	// VMID is the VM to execute in, set by clients of the file transport
+	VMID    string            `json:"vmId,omitempty"`
 	Command string            `json:"command"`
 	Args    []string          `json:"args"`
 	Env     map[string]string `json:"env"`
 	Timeout int               `json:"timeout"`
+	// Trace carries the W3C trace context of the caller to the guest agent
+	Trace map[string]string `json:"trace,omitempty"`
+	// SessionID, UserID and GroupID identify who requested the execution, for the audit log
+	SessionID string `json:"sessionId,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
 }
 
 // ExecutionResponse represents the response from executing code in a VM
@@ -0,0 +1,270 @@
+package flintlock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+)
+
+// DefaultVolumeDir is the directory on the node holding the backing files of
+// file backed volumes. Volume files outside of it are never touched.
+const DefaultVolumeDir = "/var/lib/flintlock/volumes"
+
+const (
+	// namespaceVolumeDir holds the host path volumes of each namespace, as
+	// namespaces/<namespace>/<path> in the volume directory
+	namespaceVolumeDir = "namespaces"
+
+	// workspaceVolumeDir holds the workspaces of MCP sessions, as
+	// workspaces/<namespace>/<session>.img in the volume directory
+	workspaceVolumeDir = "workspaces"
+)
+
+// MaxVolumes is the maximum number of volumes of a VM, the root filesystem is
+// vda and the volumes are vdb to vdz in the guest
+const MaxVolumes = 25
+
+// ValidateVolumes checks the volumes of a MicroVM for consistency
+func ValidateVolumes(volumes []v1alpha1.Volume) error {
+	if len(volumes) > MaxVolumes {
+		return fmt.Errorf("too many volumes: %d, at most %d are supported", len(volumes), MaxVolumes)
+	}
+
+	names := make(map[string]bool)
+	for _, vol := range volumes {
+		if vol.Name == "" {
+			return fmt.Errorf("volume name must not be empty")
+		}
+		if vol.Name == "root" {
+			return fmt.Errorf("volume name root is reserved for the root filesystem")
+		}
+		if names[vol.Name] {
+			return fmt.Errorf("duplicate volume name: %s", vol.Name)
+		}
+		names[vol.Name] = true
+
+		if vol.SizeMB <= 0 {
+			return fmt.Errorf("volume %s: size must be positive", vol.Name)
+		}
+		if !filepath.IsAbs(vol.MountPath) {
+			return fmt.Errorf("volume %s: mount path must be absolute", vol.Name)
+		}
+
+		sources := 0
+		if vol.Source.Ephemeral != nil {
+			sources++
+		}
+		if vol.Source.HostPath != nil {
+			path := vol.Source.HostPath.Path
+			if err := validateVolumeFilePath(path); err != nil {
+				return fmt.Errorf("volume %s: %v", vol.Name, err)
+			}
+			if path == workspaceVolumeDir || strings.HasPrefix(path, workspaceVolumeDir+"/") {
+				return fmt.Errorf("volume %s: host path %s is reserved for session workspaces", vol.Name, path)
+			}
+			sources++
+		}
+		if vol.Source.Workspace != nil {
+			sources++
+		}
+		if vol.Source.PersistentVolumeClaim != nil {
+			return fmt.Errorf("volume %s: persistentVolumeClaim volumes are not supported yet, the host agent can't attach a PVC to a VM; use a hostPath volume", vol.Name)
+		}
+		if sources > 1 {
+			return fmt.Errorf("volume %s: only one source may be set", vol.Name)
+		}
+	}
+	return nil
+}
+
+// validateVolumeFilePath checks that a host path stays within the volume directory
+func validateVolumeFilePath(path string) error {
+	if path == "" || filepath.IsAbs(path) {
+		return fmt.Errorf("host path must be relative to the volume directory")
+	}
+	if clean := filepath.Clean(path); clean != path || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("host path %s must be a clean path within the volume directory", path)
+	}
+	return nil
+}
+
+// ResolveVolumePath returns the absolute path of the volume file at path,
+// relative to volumeDir, creating its parent directories. Paths that resolve
+// outside of volumeDir, also through symlinks, and existing files that aren't
+// regular files, such as block devices, are rejected.
+func ResolveVolumePath(volumeDir, path string) (string, error) {
+	if err := validateVolumeFilePath(path); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create volume directory: %v", err)
+	}
+	root, err := filepath.EvalSymlinks(volumeDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve volume directory: %v", err)
+	}
+
+	// Resolve the deepest existing directory, what is below it is created here
+	dir := filepath.Dir(filepath.Join(root, path))
+	missing := ""
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to stat %s: %v", dir, err)
+		}
+		missing = filepath.Join(filepath.Base(dir), missing)
+		dir = filepath.Dir(dir)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", path, err)
+	}
+	if !withinDir(root, dir) {
+		return "", fmt.Errorf("host path %s resolves outside of the volume directory", path)
+	}
+	dir = filepath.Join(dir, missing)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory of %s: %v", path, err)
+	}
+
+	file := filepath.Join(dir, filepath.Base(path))
+	info, err := os.Lstat(file)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("host path %s is not a regular file", path)
+	}
+	return file, nil
+}
+
+// withinDir reports whether path is dir or below it
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// VolumePath returns the path of the backing file of a host path volume of a
+// VM in namespace, relative to the volume directory of the node. Host paths
+// are rooted in the directory of the namespace, so VMs can't reach the volumes
+// of other namespaces. Other volumes have no path.
+func VolumePath(vol *v1alpha1.Volume, namespace string) string {
+	if vol.Source.HostPath != nil {
+		return filepath.Join(namespaceVolumeDir, namespace, vol.Source.HostPath.Path)
+	}
+	return ""
+}
+
+// WorkspacePath returns the path of the workspace file of an MCP session,
+// relative to the volume directory of the node
+func WorkspacePath(namespace, session string) string {
+	return filepath.Join(workspaceVolumeDir, namespace, session+".img")
+}
+
+// CheckVolumeNamespace checks that a volume path, relative to the volume
+// directory, is a volume of namespace. Backends check the paths they are given
+// against the namespace of the VM rather than trusting them.
+func CheckVolumeNamespace(path, namespace string) error {
+	if namespace == "" || strings.ContainsRune(namespace, '/') || namespace == "." || namespace == ".." {
+		return fmt.Errorf("invalid namespace %q", namespace)
+	}
+	if err := validateVolumeFilePath(path); err != nil {
+		return err
+	}
+	for _, dir := range []string{namespaceVolumeDir, workspaceVolumeDir} {
+		if strings.HasPrefix(path, dir+"/"+namespace+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("volume path %s is not in the volumes of namespace %s", path, namespace)
+}
+
+// EnsureVolumeFile creates an ext4 formatted backing file of sizeMB at path, or
+// grows an existing file to sizeMB. Files are never shrunk. It returns the size
+// of the file in MB.
+func EnsureVolumeFile(ctx context.Context, path string, sizeMB int32) (int32, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create volume directory: %v", err)
+	}
+
+	size := int64(sizeMB) * 1024 * 1024
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to stat volume file: %v", err)
+	}
+
+	// Create a new sparse file and put a filesystem on it
+	if os.IsNotExist(err) {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create volume file: %v", err)
+		}
+		err = f.Truncate(size)
+		f.Close()
+		if err != nil {
+			os.Remove(path)
+			return 0, fmt.Errorf("failed to size volume file: %v", err)
+		}
+
+		if err := runFilesystemTool(ctx, "mkfs.ext4", "-F", "-q", path); err != nil {
+			os.Remove(path)
+			return 0, fmt.Errorf("failed to format volume file: %v", err)
+		}
+
+		log.Infof("Created volume file %s (%d MB)", path, sizeMB)
+		return sizeMB, nil
+	}
+
+	// Grow an existing file and its filesystem
+	if info.Size() < size {
+		if err := os.Truncate(path, size); err != nil {
+			return 0, fmt.Errorf("failed to grow volume file: %v", err)
+		}
+
+		// e2fsck exits with 1 when it corrected errors, which is fine before a resize
+		if err := runFilesystemTool(ctx, "e2fsck", "-f", "-y", path); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() > 1 {
+				return 0, fmt.Errorf("failed to check volume filesystem: %v", err)
+			}
+		}
+		if err := runFilesystemTool(ctx, "resize2fs", path); err != nil {
+			return 0, fmt.Errorf("failed to resize volume filesystem: %v", err)
+		}
+
+		log.Infof("Resized volume file %s to %d MB", path, sizeMB)
+		return sizeMB, nil
+	}
+
+	return int32(info.Size() / (1024 * 1024)), nil
+}
+
+// runFilesystemTool runs an e2fsprogs tool on a volume file
+func runFilesystemTool(ctx context.Context, name string, args ...string) error {
+	// Check if we're on Linux
+	if runtime.GOOS != "linux" {
+		// On non-Linux platforms, leave the file unformatted
+		log.Warnf("Skipping %s on non-Linux platform", name)
+		return nil
+	}
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			log.Errorf("%s failed: %s", name, strings.TrimSpace(string(output)))
+			return err
+		}
+		return fmt.Errorf("failed to run %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package flintlock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+)
+
+func TestCheckVolumeNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		namespace string
+		// want is a substring of the error, empty if the path is accepted
+		want string
+	}{
+		{
+			name:      "host path of the namespace",
+			path:      "namespaces/team-a/data.img",
+			namespace: "team-a",
+		},
+		{
+			name:      "workspace of the namespace",
+			path:      "workspaces/team-a/session.img",
+			namespace: "team-a",
+		},
+		{
+			name:      "host path of another namespace",
+			path:      "namespaces/team-b/data.img",
+			namespace: "team-a",
+			want:      "not in the volumes of namespace team-a",
+		},
+		{
+			name:      "workspace of another namespace",
+			path:      "workspaces/team-b/session.img",
+			namespace: "team-a",
+			want:      "not in the volumes of namespace team-a",
+		},
+		{
+			name:      "namespace prefix of another namespace",
+			path:      "namespaces/team-ab/data.img",
+			namespace: "team-a",
+			want:      "not in the volumes of namespace team-a",
+		},
+		{
+			name:      "outside of the namespace directories",
+			path:      "data.img",
+			namespace: "team-a",
+			want:      "not in the volumes of namespace team-a",
+		},
+		{
+			name:      "escape through parent directory",
+			path:      "namespaces/team-a/../team-b/data.img",
+			namespace: "team-a",
+			want:      "must be a clean path",
+		},
+		{
+			name:      "empty namespace",
+			path:      "namespaces//data.img",
+			namespace: "",
+			want:      "invalid namespace",
+		},
+		{
+			name:      "namespace with a slash",
+			path:      "namespaces/team-a/b/data.img",
+			namespace: "team-a/b",
+			want:      "invalid namespace",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckVolumeNamespace(tt.path, tt.namespace)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("CheckVolumeNamespace() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("CheckVolumeNamespace() = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVolumePathStaysInNamespace(t *testing.T) {
+	vol := &v1alpha1.Volume{
+		Name: "data",
+		Source: v1alpha1.VolumeSource{
+			HostPath: &v1alpha1.HostPathVolumeSource{Path: "namespaces/team-b/data.img"},
+		},
+	}
+
+	path := VolumePath(vol, "team-a")
+	if path != "namespaces/team-a/namespaces/team-b/data.img" {
+		t.Fatalf("VolumePath() = %s, want it rooted in namespace team-a", path)
+	}
+	if err := CheckVolumeNamespace(path, "team-a"); err != nil {
+		t.Fatalf("CheckVolumeNamespace(%s) = %v, want nil", path, err)
+	}
+	if err := CheckVolumeNamespace(path, "team-b"); err == nil {
+		t.Fatalf("CheckVolumeNamespace(%s) accepted namespace team-b", path)
+	}
+}
+
+func TestValidateVolumesReservesWorkspaces(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		// want is a substring of the error, empty if the volume is accepted
+		want string
+	}{
+		{name: "own file", path: "data.img"},
+		{name: "workspace of another session", path: "workspaces/team-b/session.img", want: "reserved for session workspaces"},
+		{name: "workspaces directory", path: "workspaces", want: "reserved for session workspaces"},
+		{name: "parent directory", path: "../team-b/data.img", want: "must be a clean path"},
+		{name: "absolute path", path: "/var/lib/flintlock/volumes/workspaces/team-b/session.img", want: "must be relative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateVolumes([]v1alpha1.Volume{{
+				Name:      "data",
+				SizeMB:    64,
+				MountPath: "/data",
+				Source: v1alpha1.VolumeSource{
+					HostPath: &v1alpha1.HostPathVolumeSource{Path: tt.path},
+				},
+			}})
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("ValidateVolumes() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("ValidateVolumes() = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateVolumesRejectsClaims(t *testing.T) {
+	err := ValidateVolumes([]v1alpha1.Volume{{
+		Name:      "data",
+		SizeMB:    64,
+		MountPath: "/data",
+		Source: v1alpha1.VolumeSource{
+			PersistentVolumeClaim: &v1alpha1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+		},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "persistentVolumeClaim volumes are not supported") {
+		t.Fatalf("ValidateVolumes() = %v, want persistentVolumeClaim volumes rejected", err)
+	}
+}
+
+func TestResolveVolumePath(t *testing.T) {
+	base := t.TempDir()
+	volumeDir := filepath.Join(base, "volumes")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(volumeDir, "data"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(volumeDir, "data", "disk.img"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.img"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"escape":        outside,
+		"escape.img":    filepath.Join(outside, "secret.img"),
+		"data/up":       "../..",
+		"data/same.img": "disk.img",
+		"data/inside":   ".",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(volumeDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		path string
+		// want is the resolved path relative to the volume directory, or a
+		// substring of the error if wantErr is set
+		want    string
+		wantErr bool
+	}{
+		{name: "existing file", path: "data/disk.img", want: "data/disk.img"},
+		{name: "new file in a new directory", path: "new/dir/disk.img", want: "new/dir/disk.img"},
+		{name: "symlinked directory inside", path: "data/inside/disk.img", want: "data/disk.img"},
+		{name: "parent directory", path: "../outside/secret.img", want: "must be a clean path", wantErr: true},
+		{name: "parent directory inside the path", path: "data/../../outside/secret.img", want: "must be a clean path", wantErr: true},
+		{name: "absolute path", path: filepath.Join(outside, "secret.img"), want: "must be relative", wantErr: true},
+		{name: "empty path", path: "", want: "must be relative", wantErr: true},
+		{name: "volume directory itself", path: ".", want: "must be a clean path", wantErr: true},
+		{name: "symlinked directory outside", path: "escape/secret.img", want: "resolves outside of the volume directory", wantErr: true},
+		{name: "symlink to a directory above", path: "data/up/outside/secret.img", want: "resolves outside of the volume directory", wantErr: true},
+		{name: "new file below a symlink outside", path: "escape/new/disk.img", want: "resolves outside of the volume directory", wantErr: true},
+		{name: "symlinked file outside", path: "escape.img", want: "is not a regular file", wantErr: true},
+		{name: "symlinked file inside", path: "data/same.img", want: "is not a regular file", wantErr: true},
+		{name: "directory", path: "data", want: "is not a regular file", wantErr: true},
+	}
+
+	root, err := filepath.EvalSymlinks(volumeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveVolumePath(volumeDir, tt.path)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("ResolveVolumePath() = %s, %v, want error containing %q", got, err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveVolumePath() error = %v", err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Fatalf("ResolveVolumePath() = %s, want %s", got, want)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("ResolveVolumePath() created directories outside of the volume directory")
+	}
+}
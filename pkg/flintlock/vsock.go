@@ -0,0 +1,111 @@
+package flintlock
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/yourusername/tvm/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// guestCID is the vsock context ID of every guest, each VM has its own device
+	guestCID = 3
+
+	// GuestAgentPort is the vsock port the guest agent listens on
+	GuestAgentPort = 1024
+
+	// vsockSocket is the name of the unix socket backing the vsock device of a VM
+	vsockSocket = "vsock.sock"
+)
+
+// dialGuest connects to a vsock port in the guest through the unix socket of
+// the Firecracker vsock device, using its CONNECT handshake
+func dialGuest(ctx context.Context, udsPath string, port int) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", udsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to vsock device: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to guest port %d: %v", port, err)
+	}
+
+	// Read the acknowledgement byte by byte so no payload is buffered away
+	var ack []byte
+	buf := make([]byte, 1)
+	for len(ack) < 64 {
+		if _, err := conn.Read(buf); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to guest port %d: %v", port, err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		ack = append(ack, buf[0])
+	}
+	if !strings.HasPrefix(string(ack), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("guest refused connection to port %d: %q", port, string(ack))
+	}
+
+	return conn, nil
+}
+
+// executeInGuest sends an execution request to the guest agent. The agent
+// reads one JSON ExecutionRequest per line and answers with one JSON
+// ExecutionResponse per line. The trace context is passed in the Trace field
+// of the request so the agent can continue the trace.
+func executeInGuest(ctx context.Context, udsPath string, req *ExecutionRequest) (resp *ExecutionResponse, err error) {
+	ctx, span := tracing.Start(ctx, "GuestAgent.Execute", attribute.Int("tvm.guest.port", GuestAgentPort))
+	defer func() { tracing.End(span, err) }()
+
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		// Leave the agent time to report the timeout itself
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second+5*time.Second)
+		defer cancel()
+	}
+
+	conn, err := dialGuest(ctx, udsPath, GuestAgentPort)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Unblock the connection if ctx is cancelled before the agent answers
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	traced := *req
+	traced.Trace = tracing.Inject(ctx)
+	if err := json.NewEncoder(conn).Encode(&traced); err != nil {
+		return nil, fmt.Errorf("failed to send execution request: %v", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read execution response: %v", err)
+	}
+
+	resp = &ExecutionResponse{}
+	if err := json.Unmarshal(line, resp); err != nil {
+		return nil, fmt.Errorf("failed to parse execution response: %v", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,413 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache converts OCI images into ext4 root filesystems for Firecracker and
+// caches them by manifest digest. Entries are reference counted by the VMs
+// using them and garbage collected once unused.
+type Cache struct {
+	// Directory holding the cache
+	Dir string
+	// Directory of OCI image layouts, one per repository, e.g. <dir>/library/ubuntu
+	LayoutDir string
+	// URL of a registry mirror to pull images from when they are not in LayoutDir
+	MirrorURL string
+	// Path of the guest agent binary injected into every rootfs
+	AgentPath string
+
+	agentDigest string
+	client      *http.Client
+	entries     map[string]*Entry
+	building    map[string]chan struct{}
+	mutex       sync.Mutex
+}
+
+// Entry is a cached rootfs
+type Entry struct {
+	// Key identifies the entry by image and guest agent digest
+	Key string `json:"key"`
+	// Reference is the image reference the entry was first built for
+	Reference string `json:"reference"`
+	// Digest is the digest of the image manifest
+	Digest string `json:"digest"`
+	// RootfsPath is the path of the ext4 image
+	RootfsPath string `json:"rootfsPath"`
+	// SizeBytes is the size of the ext4 image
+	SizeBytes int64 `json:"sizeBytes"`
+	// Owners are the IDs of the VMs using the entry
+	Owners map[string]bool `json:"owners,omitempty"`
+	// LastUsed is when the entry was last acquired or released
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// NewCache creates a new image cache in dir, loading existing entries
+func NewCache(dir, layoutDir, mirrorURL, agentPath string) (*Cache, error) {
+	if layoutDir == "" && mirrorURL == "" {
+		return nil, fmt.Errorf("either an image layout directory or a registry mirror is required")
+	}
+
+	for _, d := range []string{"rootfs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %v", err)
+		}
+	}
+
+	// Remove leftovers of builds interrupted by a restart
+	tmpDirs, _ := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	for _, d := range tmpDirs {
+		os.RemoveAll(filepath.Join(dir, "tmp", d.Name()))
+	}
+
+	c := &Cache{
+		Dir:       dir,
+		LayoutDir: layoutDir,
+		MirrorURL: mirrorURL,
+		AgentPath: agentPath,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+		entries:   make(map[string]*Entry),
+		building:  make(map[string]chan struct{}),
+	}
+
+	// The agent is part of the rootfs, so a new agent invalidates the entries
+	if agentPath != "" {
+		digest, err := fileDigest(agentPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read guest agent: %v", err)
+		}
+		c.agentDigest = digest
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Acquire resolves an image reference to a cache entry, building it if
+// needed, and records owner as a user of the entry
+func (c *Cache) Acquire(ctx context.Context, ref, owner string) (*Entry, error) {
+	for {
+		entry, err := c.get(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mutex.Lock()
+		// The entry may have been garbage collected since it was looked up
+		if c.entries[entry.Key] != entry {
+			c.mutex.Unlock()
+			continue
+		}
+
+		entry.Owners[owner] = true
+		entry.LastUsed = time.Now()
+		err = c.save()
+		copied := *entry
+		c.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Acquired image %s (%s) for %s", ref, entry.Digest, owner)
+		copied.Owners = nil
+		return &copied, nil
+	}
+}
+
+// Release removes owner from the users of all entries
+func (c *Cache) Release(owner string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	changed := false
+	for _, entry := range c.entries {
+		if entry.Owners[owner] {
+			delete(entry.Owners, owner)
+			entry.LastUsed = time.Now()
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return c.save()
+}
+
+// GC removes entries that have had no owners for longer than maxAge
+func (c *Cache) GC(maxAge time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	removed := 0
+	for key, entry := range c.entries {
+		if len(entry.Owners) > 0 || time.Since(entry.LastUsed) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(c.entryDir(key)); err != nil {
+			log.Errorf("Failed to remove image cache entry %s: %v", key, err)
+			continue
+		}
+		delete(c.entries, key)
+		removed++
+	}
+
+	if removed == 0 {
+		return nil
+	}
+	log.Infof("Garbage collected %d image cache entries", removed)
+	return c.save()
+}
+
+// RunGC runs GC every interval until stopCh is closed
+func (c *Cache) RunGC(stopCh <-chan struct{}, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := c.GC(maxAge); err != nil {
+				log.Errorf("Failed to garbage collect image cache: %v", err)
+			}
+		}
+	}
+}
+
+// get returns the entry for an image reference, building it if it is not cached
+func (c *Cache) get(ctx context.Context, ref string) (*Entry, error) {
+	repository, reference, err := parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	src, m, digest, err := c.resolve(ctx, repository, reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve image %s: %v", ref, err)
+	}
+	key := c.key(digest)
+
+	var building chan struct{}
+	for {
+		c.mutex.Lock()
+		if entry, ok := c.entries[key]; ok {
+			c.mutex.Unlock()
+			return entry, nil
+		}
+		inProgress, ok := c.building[key]
+		if !ok {
+			building = make(chan struct{})
+			c.building[key] = building
+			c.mutex.Unlock()
+			break
+		}
+		c.mutex.Unlock()
+
+		// Another request is building the same image, wait for it
+		select {
+		case <-inProgress:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	entry, err := c.build(ctx, src, m, ref, digest, key)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.building, key)
+	close(building)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build rootfs for image %s: %v", ref, err)
+	}
+
+	c.entries[key] = entry
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// resolve finds the manifest of an image in the layout directory, falling back to the mirror
+func (c *Cache) resolve(ctx context.Context, repository, reference string) (source, *manifest, string, error) {
+	var sources []source
+	if c.LayoutDir != "" {
+		sources = append(sources, &layoutSource{dir: filepath.Join(c.LayoutDir, repository)})
+	}
+	if c.MirrorURL != "" {
+		sources = append(sources, &registrySource{url: c.MirrorURL, repository: repository, client: c.client})
+	}
+
+	for _, src := range sources {
+		m, digest, err := resolveManifest(ctx, src, reference)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return src, m, digest, nil
+	}
+
+	return nil, nil, "", fmt.Errorf("image %s:%s not found", repository, reference)
+}
+
+// build unpacks an image, injects the guest agent and creates the rootfs image
+func (c *Cache) build(ctx context.Context, src source, m *manifest, ref, digest, key string) (*Entry, error) {
+	log.Infof("Building rootfs for image %s (%s)", ref, digest)
+	start := time.Now()
+
+	workDir, err := ioutil.TempDir(filepath.Join(c.Dir, "tmp"), key[:12]+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	root := filepath.Join(workDir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create root directory: %v", err)
+	}
+
+	if err := unpackLayers(ctx, src, m.Layers, root); err != nil {
+		return nil, err
+	}
+	if c.AgentPath != "" {
+		if err := installAgent(root, c.AgentPath); err != nil {
+			return nil, err
+		}
+	}
+
+	size, err := buildRootfs(ctx, root, filepath.Join(workDir, "rootfs.ext4"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Move the finished image into place
+	entryDir := c.entryDir(key)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create entry directory: %v", err)
+	}
+	rootfsPath := filepath.Join(entryDir, "rootfs.ext4")
+	if err := os.Rename(filepath.Join(workDir, "rootfs.ext4"), rootfsPath); err != nil {
+		return nil, fmt.Errorf("failed to move rootfs into cache: %v", err)
+	}
+
+	// VMs get copy-on-write clones, the cached image itself is never written
+	if err := os.Chmod(rootfsPath, 0444); err != nil {
+		return nil, fmt.Errorf("failed to make rootfs read-only: %v", err)
+	}
+
+	log.Infof("Built rootfs for image %s in %s", ref, time.Since(start))
+	return &Entry{
+		Key:        key,
+		Reference:  ref,
+		Digest:     digest,
+		RootfsPath: rootfsPath,
+		SizeBytes:  size,
+		Owners:     make(map[string]bool),
+		LastUsed:   time.Now(),
+	}, nil
+}
+
+// key returns the cache key for an image digest and the current guest agent
+func (c *Cache) key(digest string) string {
+	if c.agentDigest == "" {
+		return strings.TrimPrefix(digest, "sha256:")
+	}
+	return strings.TrimPrefix(digestOf([]byte(digest+c.agentDigest)), "sha256:")
+}
+
+// entryDir returns the directory of a cache entry
+func (c *Cache) entryDir(key string) string {
+	return filepath.Join(c.Dir, "rootfs", key)
+}
+
+// indexPath returns the path of the file the entries are persisted in
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.Dir, "index.json")
+}
+
+// load reads the persisted entries, dropping those whose rootfs is gone
+func (c *Cache) load() error {
+	data, err := ioutil.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read image cache index: %v", err)
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse image cache index: %v", err)
+	}
+
+	for _, entry := range entries {
+		if _, err := os.Stat(entry.RootfsPath); err != nil {
+			log.Warnf("Dropping image cache entry %s: %v", entry.Key, err)
+			continue
+		}
+		if entry.Owners == nil {
+			entry.Owners = make(map[string]bool)
+		}
+		c.entries[entry.Key] = entry
+	}
+	return nil
+}
+
+// save persists the entries. It must be called with the mutex held.
+func (c *Cache) save() error {
+	entries := make([]*Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image cache index: %v", err)
+	}
+
+	// Write to a temporary file and rename it so the index is never torn
+	tmp := c.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write image cache index: %v", err)
+	}
+	if err := os.Rename(tmp, c.indexPath()); err != nil {
+		return fmt.Errorf("failed to write image cache index: %v", err)
+	}
+	return nil
+}
+
+// fileDigest returns the sha256 digest of a file
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
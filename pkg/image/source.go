@@ -0,0 +1,339 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Media types of OCI and Docker manifests and layers
+const (
+	mediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest     = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList      = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCILayer        = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// refNameAnnotation is the annotation holding the tag of a manifest in an OCI layout index
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+var (
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	tagRegexp        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRegexp     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// errNotFound is returned by sources that don't have an image
+var errNotFound = fmt.Errorf("not found")
+
+// descriptor references a manifest or blob by digest
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// index is an OCI image index or Docker manifest list
+type index struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// manifest is an OCI or Docker image manifest
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// source fetches the manifests and blobs of one repository
+type source interface {
+	// manifest returns a manifest by tag or digest and its media type
+	manifest(ctx context.Context, reference string) ([]byte, string, error)
+	// blob returns the content of a blob by digest
+	blob(ctx context.Context, digest string) (io.ReadCloser, error)
+}
+
+// parseReference splits an image reference into a repository and a tag or
+// digest. The registry host is dropped as images are pulled from a local
+// layout or a mirror, and Docker Hub images get the library/ prefix.
+func parseReference(ref string) (string, string, error) {
+	name, reference := ref, "latest"
+	if i := strings.Index(ref, "@"); i >= 0 {
+		name, reference = ref[:i], ref[i+1:]
+		if !digestRegexp.MatchString(reference) {
+			return "", "", fmt.Errorf("invalid digest in image reference %q", ref)
+		}
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, reference = ref[:i], ref[i+1:]
+		if !tagRegexp.MatchString(reference) {
+			return "", "", fmt.Errorf("invalid tag in image reference %q", ref)
+		}
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) > 1 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		parts = parts[1:]
+	}
+	if len(parts) == 1 {
+		parts = append([]string{"library"}, parts...)
+	}
+
+	repository := strings.Join(parts, "/")
+	if !repositoryRegexp.MatchString(repository) {
+		return "", "", fmt.Errorf("invalid repository in image reference %q", ref)
+	}
+
+	return repository, reference, nil
+}
+
+// resolveManifest fetches the image manifest for reference, selecting the
+// manifest for the current platform from an index. It returns the manifest
+// and the digest of the manifest the image is cached by.
+func resolveManifest(ctx context.Context, src source, reference string) (*manifest, string, error) {
+	for i := 0; i < 3; i++ {
+		body, mediaType, err := src.manifest(ctx, reference)
+		if err != nil {
+			return nil, "", err
+		}
+		digest := digestOf(body)
+		if digestRegexp.MatchString(reference) && digest != reference {
+			return nil, "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", reference, digest)
+		}
+
+		switch mediaType {
+		case mediaTypeOCIIndex, mediaTypeDockerList:
+			var idx index
+			if err := json.Unmarshal(body, &idx); err != nil {
+				return nil, "", fmt.Errorf("failed to parse image index: %v", err)
+			}
+			reference = ""
+			for _, desc := range idx.Manifests {
+				if desc.Platform == nil || (desc.Platform.OS == "linux" && desc.Platform.Architecture == runtime.GOARCH) {
+					reference = desc.Digest
+					break
+				}
+			}
+			if reference == "" {
+				return nil, "", fmt.Errorf("image has no manifest for linux/%s", runtime.GOARCH)
+			}
+		case mediaTypeOCIManifest, mediaTypeDockerManifest:
+			var m manifest
+			if err := json.Unmarshal(body, &m); err != nil {
+				return nil, "", fmt.Errorf("failed to parse image manifest: %v", err)
+			}
+			return &m, digest, nil
+		default:
+			return nil, "", fmt.Errorf("unsupported manifest media type %q", mediaType)
+		}
+	}
+
+	return nil, "", fmt.Errorf("image index nested too deeply")
+}
+
+// layoutSource reads images from an OCI image layout directory
+type layoutSource struct {
+	dir string
+}
+
+// manifest implements source
+func (s *layoutSource) manifest(ctx context.Context, reference string) ([]byte, string, error) {
+	if !digestRegexp.MatchString(reference) {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, "index.json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, "", errNotFound
+			}
+			return nil, "", fmt.Errorf("failed to read layout index: %v", err)
+		}
+
+		var idx index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, "", fmt.Errorf("failed to parse layout index: %v", err)
+		}
+
+		tag := reference
+		reference = ""
+		for _, desc := range idx.Manifests {
+			if desc.Annotations[refNameAnnotation] == tag {
+				reference = desc.Digest
+				break
+			}
+		}
+		if reference == "" {
+			return nil, "", errNotFound
+		}
+	}
+
+	rc, err := s.blob(ctx, reference)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	body, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return body, manifestMediaType(body), nil
+}
+
+// blob implements source
+func (s *layoutSource) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("invalid digest %q", digest)
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNotFound
+		}
+		return nil, fmt.Errorf("failed to open blob %s: %v", digest, err)
+	}
+	return f, nil
+}
+
+// registrySource pulls images from a registry mirror using the distribution API
+type registrySource struct {
+	url        string
+	repository string
+	client     *http.Client
+}
+
+// manifest implements source
+func (s *registrySource) manifest(ctx context.Context, reference string) ([]byte, string, error) {
+	resp, err := s.get(ctx, "manifests", reference, strings.Join([]string{
+		mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerList, mediaTypeDockerManifest,
+	}, ", "))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	if mediaType == "" || mediaType == "application/json" {
+		mediaType = manifestMediaType(body)
+	}
+	return body, mediaType, nil
+}
+
+// blob implements source
+func (s *registrySource) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("invalid digest %q", digest)
+	}
+
+	resp, err := s.get(ctx, "blobs", digest, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// get sends a GET request for a manifest or blob to the mirror
+func (s *registrySource) get(ctx context.Context, kind, reference, accept string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/v2/%s/%s/%s", strings.TrimSuffix(s.url, "/"), s.repository, kind, reference)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// manifestMediaType returns the media type declared in a manifest body
+func manifestMediaType(body []byte) string {
+	var m struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ""
+	}
+	if m.MediaType != "" {
+		return m.MediaType
+	}
+	// The media type is optional in OCI manifests
+	if m.Manifests != nil {
+		return mediaTypeOCIIndex
+	}
+	return mediaTypeOCIManifest
+}
+
+// digestOf returns the sha256 digest of data
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyingReader checks the digest of a blob once it has been read completely
+type verifyingReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	digest string
+}
+
+// newVerifyingReader wraps r to verify its content matches digest
+func newVerifyingReader(r io.Reader, digest string) *verifyingReader {
+	h := sha256.New()
+	return &verifyingReader{r: io.TeeReader(r, h), hash: h, digest: digest}
+}
+
+// Read implements io.Reader
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	return v.r.Read(p)
+}
+
+// verify drains the reader and compares the digest of the content
+func (v *verifyingReader) verify() error {
+	if _, err := io.Copy(ioutil.Discard, v.r); err != nil {
+		return fmt.Errorf("failed to read blob %s: %v", v.digest, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); digest != v.digest {
+		return fmt.Errorf("blob digest mismatch: expected %s, got %s", v.digest, digest)
+	}
+	return nil
+}
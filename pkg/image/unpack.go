@@ -0,0 +1,307 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// whiteoutPrefix marks a file deleted by a layer
+	whiteoutPrefix = ".wh."
+
+	// opaqueWhiteout marks a directory whose lower layer contents are hidden
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// AgentInstallPath is where the guest agent is installed in the rootfs
+	AgentInstallPath = "/usr/local/bin/tvm-agent"
+
+	// maxSymlinks is the number of symlinks followed when resolving a path
+	maxSymlinks = 255
+)
+
+// unpackLayers applies the layers of an image to root in order
+func unpackLayers(ctx context.Context, src source, layers []descriptor, root string) error {
+	for _, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := unpackLayer(ctx, src, layer, root); err != nil {
+			return fmt.Errorf("failed to unpack layer %s: %v", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// unpackLayer downloads, verifies and extracts a single layer
+func unpackLayer(ctx context.Context, src source, layer descriptor, root string) error {
+	rc, err := src.blob(ctx, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	verifier := newVerifyingReader(rc, layer.Digest)
+	var r io.Reader = verifier
+	switch layer.MediaType {
+	case mediaTypeOCILayerGzip, mediaTypeDockerLayerGzip:
+		gz, err := gzip.NewReader(verifier)
+		if err != nil {
+			return fmt.Errorf("failed to decompress layer: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	case mediaTypeOCILayer:
+	default:
+		return fmt.Errorf("unsupported layer media type %q", layer.MediaType)
+	}
+
+	if err := extractLayer(r, root); err != nil {
+		return err
+	}
+
+	return verifier.verify()
+}
+
+// extractLayer extracts a layer tarball onto root, applying whiteouts
+func extractLayer(r io.Reader, root string) error {
+	tr := tar.NewReader(r)
+	// written holds the paths created by this layer, which opaque whiteouts keep
+	written := make(map[string]bool)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer: %v", err)
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := filepath.Split(name)
+
+		// Resolve the parent inside root so symlinks can't escape it
+		parent, err := resolveInRoot(root, dir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", dir, err)
+		}
+
+		switch {
+		case base == opaqueWhiteout:
+			if err := removeLowerEntries(parent, dir, written); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err := os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return fmt.Errorf("failed to apply whiteout %s: %v", name, err)
+			}
+			continue
+		}
+
+		target := filepath.Join(parent, base)
+		if err := extractEntry(tr, hdr, root, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", name, err)
+		}
+
+		for p := name; p != "/"; p = filepath.Dir(p) {
+			written[p] = true
+		}
+	}
+}
+
+// extractEntry creates a single file, directory or link at target
+func extractEntry(tr *tar.Reader, hdr *tar.Header, root, target string) error {
+	mode := os.FileMode(hdr.Mode).Perm() | os.FileMode(hdr.Mode)&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+
+	// Replace whatever a lower layer left at the path, unless both are directories
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// Symlinks are stored as is, they are resolved inside the guest
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		source, err := resolveInRoot(root, filepath.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	default:
+		// Device nodes are provided by devtmpfs in the guest
+		log.Debugf("Skipping %s with unsupported type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	// Ownership can only be kept when running as root, which mkfs then preserves
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+		log.Debugf("Failed to chown %s: %v", target, err)
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// removeLowerEntries empties a directory for an opaque whiteout, keeping the
+// entries that were created by the current layer
+func removeLowerEntries(path, dir string, written map[string]bool) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %v", dir, err)
+	}
+
+	for _, entry := range entries {
+		if written[filepath.Join(dir, entry.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return fmt.Errorf("failed to apply opaque whiteout in %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// resolveInRoot resolves path as if root were the filesystem root, following
+// symlinks without ever leaving root. Missing components are not an error.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	links := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks resolving %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// installAgent copies the guest agent binary into the rootfs
+func installAgent(root, agentPath string) error {
+	dir, err := resolveInRoot(root, filepath.Dir(AgentInstallPath))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create agent directory: %v", err)
+	}
+
+	src, err := os.Open(agentPath)
+	if err != nil {
+		return fmt.Errorf("failed to open guest agent: %v", err)
+	}
+	defer src.Close()
+
+	target := filepath.Join(dir, filepath.Base(AgentInstallPath))
+	os.RemoveAll(target)
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create guest agent: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to copy guest agent: %v", err)
+	}
+	return nil
+}
+
+// buildRootfs creates an ext4 image at path populated from the directory root.
+// The image is sized to the content plus headroom for metadata and guest writes.
+func buildRootfs(ctx context.Context, root, path string) (int64, error) {
+	var used int64
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Account a block per inode on top of the content
+		used += info.Size() + 4096
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure rootfs: %v", err)
+	}
+
+	size := used + used/4 + 64<<20
+	size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create rootfs image: %v", err)
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to size rootfs image: %v", err)
+	}
+
+	output, err := exec.CommandContext(ctx, "mkfs.ext4", "-F", "-q", "-L", "rootfs", "-d", root, path).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create ext4 filesystem: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return size, nil
+}
@@ -4,18 +4,42 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/yourusername/tvm/pkg/apis/vvm/v1alpha1"
+	"github.com/yourusername/tvm/pkg/audit"
+	"github.com/yourusername/tvm/pkg/metrics"
+	"github.com/yourusername/tvm/pkg/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// resumeTimeout bounds how long a request waits for the paused VM of its session
+	resumeTimeout = 30 * time.Second
+	// resumePollInterval is how often the state of a resuming VM is checked
+	resumePollInterval = 500 * time.Millisecond
 )
 
 // Server is an MCP server
 type Server struct {
-	sessions     map[string]*Session
+	// sessions are keyed by namespace and name, sessions of different
+	// namespaces may have the same name
+	sessions     map[types.NamespacedName]*Session
 	sessionMutex sync.RWMutex
 	httpServer   *http.Server
+	// Audit records the session actions, if set
+	Audit *audit.Logger
+	// Client resumes the paused VMs of sessions on their next request, if set
+	Client client.Client
 }
 
 // Session represents an MCP session
@@ -23,6 +47,7 @@ type Session struct {
 	ID           string
 	UserID       string
 	GroupID      string
+	Namespace    string
 	VMID         string
 	LastActivity time.Time
 }
@@ -30,13 +55,13 @@ type Session struct {
 // NewServer creates a new MCP server
 func NewServer(addr string) *Server {
 	server := &Server{
-		sessions: make(map[string]*Session),
+		sessions: make(map[types.NamespacedName]*Session),
 	}
 
 	// Create HTTP server
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/sessions", server.handleSessions)
-	mux.HandleFunc("/api/sessions/", server.handleSession)
+	mux.Handle("/api/sessions", instrument("sessions", server.handleSessions))
+	mux.Handle("/api/sessions/", instrument("session", server.handleSession))
 
 	server.httpServer = &http.Server{
 		Addr:    addr,
@@ -63,54 +88,69 @@ func (s *Server) CreateSession(session *v1alpha1.MCPSession) error {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 
-	// Create a new session
-	s.sessions[session.Name] = &Session{
+	// Create a new session, replacing an existing one
+	key := types.NamespacedName{Name: session.Name, Namespace: session.Namespace}
+	if old, ok := s.sessions[key]; ok {
+		metrics.MCPSessions.WithLabelValues(old.UserID, old.GroupID).Dec()
+	}
+	s.sessions[key] = &Session{
 		ID:           session.Name,
 		UserID:       session.Spec.UserID,
 		GroupID:      session.Spec.GroupID,
+		Namespace:    session.Namespace,
 		VMID:         session.Spec.VMID,
 		LastActivity: time.Now(),
 	}
 
-	log.Infof("Created MCP session %s for user %s", session.Name, session.Spec.UserID)
+	metrics.MCPSessions.WithLabelValues(session.Spec.UserID, session.Spec.GroupID).Inc()
+	s.audit(audit.ActionSessionCreate, s.sessions[key])
+
+	log.Infof("Created MCP session %s for user %s", key, session.Spec.UserID)
 	return nil
 }
 
 // DeleteSession deletes an MCP session
-func (s *Server) DeleteSession(sessionID string) error {
+func (s *Server) DeleteSession(key types.NamespacedName) error {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 
 	// Delete the session
-	delete(s.sessions, sessionID)
+	session, ok := s.sessions[key]
+	if ok {
+		metrics.MCPSessions.WithLabelValues(session.UserID, session.GroupID).Dec()
+	} else {
+		session = &Session{ID: key.Name, Namespace: key.Namespace}
+	}
+	s.audit(audit.ActionSessionDelete, session)
+	delete(s.sessions, key)
 
-	log.Infof("Deleted MCP session %s", sessionID)
+	log.Infof("Deleted MCP session %s", key)
 	return nil
 }
 
 // GetSession gets an MCP session
-func (s *Server) GetSession(sessionID string) (*Session, error) {
+func (s *Server) GetSession(key types.NamespacedName) (*Session, error) {
 	s.sessionMutex.RLock()
 	defer s.sessionMutex.RUnlock()
 
 	// Get the session
-	session, ok := s.sessions[sessionID]
+	session, ok := s.sessions[key]
 	if !ok {
-		return nil, fmt.Errorf("session not found: %s", sessionID)
+		return nil, fmt.Errorf("session not found: %s", key)
 	}
 
 	return session, nil
 }
 
 // UpdateSessionActivity updates the last activity time for a session
-func (s *Server) UpdateSessionActivity(sessionID string) error {
+func (s *Server) UpdateSessionActivity(key types.NamespacedName) error {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 
 	// Get the session
-	session, ok := s.sessions[sessionID]
+	session, ok := s.sessions[key]
 	if !ok {
-		return fmt.Errorf("session not found: %s", sessionID)
+		return fmt.Errorf("session not found: %s", key)
 	}
 
 	// Update last activity
@@ -119,6 +159,79 @@ func (s *Server) UpdateSessionActivity(sessionID string) error {
 	return nil
 }
 
+// SessionActivity returns the time of the last request to a session
+func (s *Server) SessionActivity(key types.NamespacedName) (time.Time, error) {
+	s.sessionMutex.RLock()
+	defer s.sessionMutex.RUnlock()
+
+	session, ok := s.sessions[key]
+	if !ok {
+		return time.Time{}, fmt.Errorf("session not found: %s", key)
+	}
+
+	return session.LastActivity, nil
+}
+
+// resumeVM resumes the VM of a session if it was shrunk or paused while the
+// session was idle, and waits until it runs again
+func (s *Server) resumeVM(ctx context.Context, session *Session) error {
+	if s.Client == nil || session.VMID == "" {
+		return nil
+	}
+
+	key := types.NamespacedName{Name: session.VMID, Namespace: session.Namespace}
+	vm := &v1alpha1.MicroVM{}
+	if err := s.Client.Get(ctx, key, vm); err != nil {
+		return fmt.Errorf("failed to get MicroVM %s: %v", session.VMID, err)
+	}
+
+	// Resume the VM and give it back the memory it had before it was shrunk
+	previous, shrunk := vm.Annotations[v1alpha1.IdleMemoryTargetAnnotation]
+	if vm.Spec.Paused || shrunk {
+		patch := client.MergeFrom(vm.DeepCopy())
+		vm.Spec.Paused = false
+		if shrunk {
+			vm.Spec.MemoryTarget = nil
+			if target, err := strconv.Atoi(previous); err == nil {
+				memoryTarget := int32(target)
+				vm.Spec.MemoryTarget = &memoryTarget
+			}
+			delete(vm.Annotations, v1alpha1.IdleMemoryTargetAnnotation)
+		}
+		if err := s.Client.Patch(ctx, vm, patch); err != nil {
+			return fmt.Errorf("failed to resume MicroVM %s: %v", vm.Name, err)
+		}
+		log.Infof("Resuming MicroVM %s of MCP session %s", vm.Name, session.ID)
+	}
+
+	// The MicroVM controller resumes the VM
+	ctx, cancel := context.WithTimeout(ctx, resumeTimeout)
+	defer cancel()
+	for vm.Status.State == v1alpha1.MicroVMStatePaused {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("MicroVM %s was not resumed within %s", vm.Name, resumeTimeout)
+		case <-time.After(resumePollInterval):
+		}
+		if err := s.Client.Get(ctx, key, vm); err != nil {
+			return fmt.Errorf("failed to get MicroVM %s: %v", vm.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// audit records an action on a session
+func (s *Server) audit(action string, session *Session) {
+	s.Audit.Record(audit.Event{
+		Action:    action,
+		UserID:    session.UserID,
+		GroupID:   session.GroupID,
+		SessionID: session.ID,
+		VMID:      session.VMID,
+	})
+}
+
 // handleSessions handles requests to /api/sessions
 func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -140,19 +253,34 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleSession handles requests to /api/sessions/{id}
+// handleSession handles requests to /api/sessions/{namespace}/{name}
 func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
-	// Extract session ID from URL
+	// Extract the namespace and name of the session from URL
 	sessionID := r.URL.Path[len("/api/sessions/"):]
+	parts := strings.Split(sessionID, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
 
 	switch r.Method {
 	case http.MethodGet:
 		// Get session
-		session, err := s.GetSession(sessionID)
+		session, err := s.GetSession(key)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		s.audit(audit.ActionSessionRead, session)
+
+		// Requests keep the session active and wake up its VM
+		s.UpdateSessionActivity(key)
+		if err := s.resumeVM(r.Context(), session); err != nil {
+			log.Errorf("Failed to resume VM of MCP session %s: %v", sessionID, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -160,7 +288,7 @@ func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
 			session.ID, session.UserID, session.GroupID, session.VMID)
 	case http.MethodDelete:
 		// Delete session
-		err := s.DeleteSession(sessionID)
+		err := s.DeleteSession(key)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -171,3 +299,37 @@ func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument traces the calls to a tool, continuing the trace of the caller,
+// and counts them by method and status code
+func instrument(tool string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.ToLower(r.Method) + "_" + tool
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, "MCP "+name,
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.code))
+		if rec.code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.code))
+		}
+		metrics.MCPToolCalls.WithLabelValues(name, strconv.Itoa(rec.code)).Inc()
+	})
+}
@@ -0,0 +1,98 @@
+// Package metrics defines the Prometheus metrics of lime-ctrl and the host agent
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namespace prefixes all metric names
+const namespace = "tvm"
+
+var (
+	// VMCreateDuration is how long creating a VM on its backend takes, by image
+	VMCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vm_create_duration_seconds",
+		Help:      "Time taken to create a VM, by image.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"image"})
+
+	// VMBootDuration is how long Firecracker takes from start to a booted VM
+	VMBootDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vm_boot_duration_seconds",
+		Help:      "Time from starting Firecracker to the VM running.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+
+	// Executions counts executions by result: success, error or timeout
+	Executions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "executions_total",
+		Help:      "Code executions in VMs, by result.",
+	}, []string{"result"})
+
+	// ExecutionDuration is how long executions take
+	ExecutionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "execution_duration_seconds",
+		Help:      "Time taken by code executions in VMs, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 3, 10),
+	}, []string{"result"})
+
+	// ExecutionExitCodes counts the exit codes of completed executions
+	ExecutionExitCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "execution_exit_codes_total",
+		Help:      "Exit codes of completed code executions.",
+	}, []string{"code"})
+
+	// MCPSessions is the number of active MCP sessions by user and group
+	MCPSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mcp_sessions",
+		Help:      "Active MCP sessions, by user and group.",
+	}, []string{"user", "group"})
+
+	// MCPToolCalls counts the calls to the MCP server by tool and HTTP status code
+	MCPToolCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mcp_tool_calls_total",
+		Help:      "Calls to the MCP server, by tool and status code.",
+	}, []string{"tool", "code"})
+
+	// BackendErrors counts failed gRPC calls to backends by operation and status code
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "Failed gRPC calls to Flintlock and host agents, by operation and status code.",
+	}, []string{"operation", "code"})
+)
+
+// Register registers the metrics on reg
+func Register(reg prometheus.Registerer) {
+	reg.MustRegister(
+		VMCreateDuration,
+		VMBootDuration,
+		Executions,
+		ExecutionDuration,
+		ExecutionExitCodes,
+		MCPSessions,
+		MCPToolCalls,
+		BackendErrors,
+	)
+}
+
+// ObserveExecution records an execution that started at start
+func ObserveExecution(start time.Time, result string) {
+	Executions.WithLabelValues(result).Inc()
+	ExecutionDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// ObserveExitCode records the exit code of a completed execution
+func ObserveExitCode(code int) {
+	ExecutionExitCodes.WithLabelValues(strconv.Itoa(code)).Inc()
+}
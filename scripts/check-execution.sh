@@ -32,28 +32,29 @@ ls -la /tmp/flintlock-data/
 echo -e "${YELLOW}Checking Python script...${NC}"
 cat /tmp/flintlock-data/sample_script.py
 
-# Check the execution request
-echo -e "${YELLOW}Checking execution request...${NC}"
-if [ -f /tmp/flintlock-data/microvms/execute_request.txt ]; then
-    cat /tmp/flintlock-data/microvms/execute_request.txt
-else
-    echo "No execution request found"
-fi
-
-# Check the execution response
-echo -e "${YELLOW}Checking execution response...${NC}"
-if [ -f /tmp/flintlock-data/microvms/execute_response.txt ]; then
-    cat /tmp/flintlock-data/microvms/execute_response.txt
-else
-    echo "No execution response found"
-fi
-
-# Check the execution response JSON
-echo -e "${YELLOW}Checking execution response JSON...${NC}"
-if [ -f /tmp/flintlock-data/microvms/execute_response.json ]; then
-    cat /tmp/flintlock-data/microvms/execute_response.json
-else
-    echo "No execution response JSON found"
+# Check the pending and in-flight execution requests
+echo -e "${YELLOW}Checking execution requests...${NC}"
+for dir in requests processing; do
+    for f in /tmp/flintlock-data/microvms/$dir/*.json; do
+        [ -f "$f" ] || continue
+        echo "$dir/$(basename "$f"):"
+        cat "$f"
+        echo
+    done
+done
+
+# Check the uncollected execution responses
+echo -e "${YELLOW}Checking execution responses...${NC}"
+found=0
+for f in /tmp/flintlock-data/microvms/responses/*.json; do
+    [ -f "$f" ] || continue
+    found=1
+    echo "$(basename "$f"):"
+    cat "$f"
+    echo
+done
+if [ $found -eq 0 ]; then
+    echo "No execution responses found"
 fi
 
 echo -e "${GREEN}Execution check completed!${NC}"